@@ -9,19 +9,25 @@ Version 1.1 2017-09-10
 package main
 
 import (
+	"context"
+	"errors"
 	"math/rand"
 
 	"github.com/btittelbach/go-bbhw"
 
 	"bytes"
-	"container/ring"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
 	"sort"
-	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -36,6 +42,7 @@ import (
 
 const (
 	slotsPath = "/sys/devices/bone_capemgr.9/slots"
+	slotsGlob = "/sys/devices/bone_capemgr.*/slots" // the number varies by board
 	pwmPath   = "/sys/devices/ocp.3/pwm_test_P9_14.16/"
 	ainPath   = "/sys/devices/ocp.3/44e0d000.tscadc/tiadc/iio:device0/in_voltage4_raw"
 	// Using sysfs for PWM control
@@ -45,19 +52,24 @@ const (
 	pwmP9_21      = "bone_pwm_P9_21"
 	pwmP9_22      = "bone_pwm_P9_22"
 	pwmPeriod     = 500000 * time.Nanosecond
-	pwmResolution = 10 // smallest detectable unit
+	pwmResolution = 10 * time.Nanosecond // smallest detectable unit, by default
+	// 1kHz to 20kHz; some LEDs whine audibly at a given frequency
+	pwmPeriodMin = 50 * time.Microsecond
+	pwmPeriodMax = time.Millisecond
 	// Though analog input starts at zero, lowest value to trigger lights is 30.
-	// Values below 30 are dead zone on potentiometers, so we pad the bottom values.
+	// Values below 30 are dead zone on potentiometers, so we pad the bottom
+	// values of pots that have not been calibrated.
 	ainLevels       = 4096 // 0 - 4095
 	ainMinPad       = 25
+	gamma           = 2.2 // perceptual brightness curve
 	clockDividerMin = 1
 	clockDividerMax = 65534
 	sampleAvgMin    = 1
+	mockSweepLength = 4000 // readings per mock pot sweep
 	// Limit overall maximum current draw to 1.5 amps.
 	// 500K ns * 1.5 amps / 0.7 amps =
 	maxLEDCurrent   = 700  // enforced by resistors on light fixture
 	maxTotalCurrent = 1400 // previously determined to not overheat fixture
-	maxTotalDuty    = pwmPeriod * maxTotalCurrent / maxLEDCurrent
 
 	//
 	// AUTO MODE
@@ -65,13 +77,15 @@ const (
 	// thresholds for OFF and ON
 	aoutOff = 10
 	aoutOn  = 4000
+	// loops the gesture must hold before auto mode switches
+	gestureLoops = 5
 	// autoLoop controls when the aout offset is changed
 	autoLoopMax    = 400             // we add min pad to get minpad to max+minpad
-	autoLoopAdjust = 5 * time.Second // frequency of change to auto loop max
+	autoLoopAdjust = 5 * time.Second // default frequency of change to auto loop max
 	// autoOffset controls by how much aout is adjusted
 	autoOffsetDelta    = 2
 	autoOffsetMax      = 500             // outer bounds +/-
-	autoOffsetAdjust   = 5 * time.Second // frequency of change to auto offset max
+	autoOffsetAdjust   = 5 * time.Second // default frequency of change to auto offset max
 	autoOffsetMaxRatio = 2               // max ratio of autoOffsetMax to current aout setting
 )
 
@@ -84,127 +98,435 @@ var sampleAvgMap = map[int]byte{
 	16: ADC_AVG_16,
 }
 
+// Beyond 16 the hardware averages 16 samples per conversion and ReadAnalog
+// averages this many conversions of each step in software.
+var sampleAvgPasses = map[int]int{
+	32:  2,
+	64:  4,
+	128: 8,
+	256: 16,
+}
+
+// parseAveraging splits an -average value into the hardware averaging
+// setting and the number of software passes.
+func parseAveraging(n int) (byte, int, error) {
+	if avg, ok := sampleAvgMap[n]; ok {
+		return avg, 1, nil
+	}
+	if passes, ok := sampleAvgPasses[n]; ok {
+		return ADC_AVG_16, passes, nil
+	}
+	return 0, 0, fmt.Errorf("illegal ADC sample averaging %d: must be 1, 2, 4, 8, 16, 32, 64, 128 or 256", n)
+}
+
 // flags
 var (
-	debug      = flag.Bool("debug", false, "log debug messages")
-	sleep      = flag.String("sleep", "0ms", "duration (string) between updates (default 0ms)")
-	windowSize = flag.Int("window", 100, "size of averaging window (default 100)")
+	debug      = flag.Bool("debug", false, "log debug messages; same as -loglevel debug")
+	logLevel   = flag.String("loglevel", "info", "log level: debug, info, warn or error (default info)")
+	logFormat  = flag.String("debug-format", "text", "log format: text, key=value pairs for reading, or json, one object per record for jq and log aggregators (default text)")
+	sleep      = flag.String("sleep", "0ms", "period (string) of the update loop; 0 runs it flat out (default 0ms)")
+	maxRate    = flag.Float64("maxrate", 0, "most loop iterations per second, to leave CPU for the rest of the system whatever -sleep says (default 0, no cap)")
+	windowSize = flag.Int("window", 100, "size of averaging window, 1 to 10000; POST /window changes it while running (default 100)")
+	smoothing  = flag.String("smooth", "median", "pot smoothing: median or ema (default median)")
+	alpha      = flag.Float64("alpha", 0.1, "weight of the newest reading for -smooth ema (default 0.1)")
+	aggregate  = flag.String("aggregate", "median", "what -smooth median takes of the window: median, rejecting spikes, mean, the smoothest, or max, following brief peaks (default median)")
 	// program clock divider to actual value - 1, i.e., default register value 0
 	clockDivider = flag.Int("divider", clockDividerMin, "ADC clock divider (default 1; max 65534)")
-	sampleAvg    = flag.Int("average", sampleAvgMin, "ADC sample averaging (default 1; possible values 1, 2, 4, 8, 16)")
+	sampleAvg    = flag.Int("average", sampleAvgMin, "ADC sample averaging (default 1; possible values 1, 2, 4, 8, 16 in hardware, and 32, 64, 128, 256 adding software passes)")
+	fifoSamples  = flag.Int("fifo-samples", 1, "conversions of each pot averaged from one FIFO read, for quieter readings without a longer -window; one-shot mode only (default 1)")
+	threshold    = flag.Bool("threshold", false, "wait on the ADC FIFO threshold instead of a fixed delay")
+	continuous   = flag.Bool("continuous", false, "keep the ADC converting instead of starting it each loop")
+	adcTimeout   = flag.String("adc-timeout", "", "longest reading the ADC FIFO may take before the read fails, so a stuck converter stops the loop instead of hanging it (default 100ms)")
+	adcSettle    = flag.String("adc-settle", "", "time the ADC steps get to convert before the FIFO is read (default twice the conversion time at -divider and -average, at least 500us)")
+	pinList      = flag.String("pins", "", "header pins of the pots in channel order, e.g. P9_37,P9_38,P9_39,P9_40 (default P9_39, P9_40, P9_37, ... in AIN order)")
+	dmxDevice    = flag.String("dmx", "", "serial device of a DMX512 input dongle, e.g. /dev/ttyUSB0; replaces the pots (default off)")
+	dmxAddress   = flag.Int("dmx-address", 1, "DMX or Art-Net slot of the first LED (default 1)")
+	artNet       = flag.Bool("artnet", false, "listen for Art-Net on UDP port 6454; replaces the pots")
+	artNetUni    = flag.Int("artnet-universe", 0, "Art-Net universe to follow (default 0)")
+	mqttBroker   = flag.String("mqtt", "", "MQTT broker, e.g. tcp://hub.local:1883; takes over from the pots while connected (default off)")
+	mqttPrefix   = flag.String("mqtt-topic", "ledfixture", "MQTT topic prefix (default ledfixture)")
+	oscAddr      = flag.String("osc", "", "listen for OSC on this UDP address, e.g. :8000; replaces the pots (default off)")
+	startupFade  = flag.String("startup-fade", "0s", "fade the LEDs up from off over this long at startup; 0 snaps to the pots (default 0s)")
+	idle         = flag.String("idle", "0s", "disable the PWM lines after all LEDs have been off this long; 0 never does (default 0s)")
+	watchdog     = flag.String("watchdog", "0s", "fade the LEDs off when the control source sends nothing for this long; 0 disables (default 0s)")
+	freezePin    = flag.Int("freeze-gpio", -1, "kernel GPIO number of a switch to ground that holds the lights as they are while closed (default off)")
+	emergencyPin = flag.Int("emergency-gpio", -1, "kernel GPIO number of a switch to ground that turns on the emergency lights while closed, e.g. 60 for P9_12 (default off)")
+	recordPath   = flag.String("record", "", "write each loop's readings and duties to this CSV file (default off)")
+	replayPath   = flag.String("replay", "", "play back the duties of a -record file instead of reading the pots (default off)")
+	replayLoop   = flag.Bool("replay-loop", false, "start -replay over at the end of the file instead of handing back to the pots")
+	replaySpeed  = flag.Float64("replay-speed", 1, "play -replay this many times faster than recorded (default 1)")
+	oscReply     = flag.String("osc-reply", "", "send each LED's level back over OSC to this address, e.g. 10.0.0.5:9000 (default off)")
+	autoEffect   = flag.String("automode", autoRandom, "auto mode effect: random, dark, rainbow or chase (default random)")
+	showVersion  = flag.Bool("version", false, "print the version and build of this binary and exit")
+	selfTestRun  = flag.Bool("selftest", false, "light each LED in turn, then all, then none, logging its color and pin, before starting")
+	listPinsRun  = flag.Bool("list-pins", false, "print the analog input pins, their inputs and ADC steps, for -pins, then exit")
+	checkRun     = flag.Bool("check", false, "print which overlays are loaded, how the ADC steps are set up and the PWM outputs, then exit")
+	calibrateRun = flag.Bool("calibrate", false, "measure the travel of each pot and save it to the -config file, then exit")
+	mock         = flag.Bool("mock", false, "replace the ADC with scripted pot sweeps for testing off the BeagleBone")
+	pwmSysfs     = flag.String("pwm-sysfs", "auto", "PWM sysfs layout: capemgr for 3.8 kernels, class for the /sys/class/pwm of later ones, or auto to detect it (default auto)")
+	skipDTO      = flag.Bool("skip-dto", false, "do not load device tree overlays; for kernels that apply them at boot, e.g. from /boot/uEnv.txt")
+	simulate     = flag.Bool("simulate", false, "log PWM writes instead of driving the pins, with the -mock ADC; runs off the BeagleBone")
+	breatheList  = flag.String("breathe", "", "LEDs that breathe, as steps, e.g. 0,2, or all; the pot sets the peak (default none)")
+	strobeList   = flag.String("strobe", "", "strobe LEDs, as step=hz pairs, e.g. 0=10,2=4.5 (default none)")
+	cct          = flag.Float64("cct", 0, "start with the colored LEDs at this color temperature in Kelvin, 2000 to 6500 (default off, pots in control)")
+	statePath    = flag.String("state", "", "file to save the LED state in, to resume after a restart (default off)")
+	restoreState = flag.Bool("restore", true, "resume from the -state file at startup (default true)")
+	configPath   = flag.String("config", "", "JSON file of tuning values (default compiled-in values)")
+	httpAddr     = flag.String("http", "", "address for the HTTP status API, e.g. :8080 (default off)")
+	healthzStall = flag.String("healthz-stall", "", "time without a main loop iteration after which GET /healthz reports 503 (default three loop periods, at least 1s)")
+	thermalPath  = flag.String("thermal", "", "throttle the LEDs as this sysfs temperature in millidegrees rises, e.g. /sys/class/thermal/thermal_zone0/temp (default off)")
+	ambient      = flag.Bool("ambient", false, "dim all LEDs in a dark room using the light sensor on AIN4")
+	metrics      = flag.Bool("metrics", false, "serve Prometheus metrics at /metrics on the -http address")
+	pwmPeriodArg = flag.String("pwm-period", "", "PWM period, 50us to 1ms, e.g. 100us for 10kHz; overrides the config file (default 500us)")
+	gammaFlag    = flag.Float64("gamma", 0, "brightness curve gamma; overrides the config file (default 2.2)")
 )
 
-// calcMedian add aout to existing values to calculate median
-func calcMedian(window *ring.Ring, aout int) float64 {
-	var counts = make([]float64, 0, *windowSize)
-	count := func(v interface{}) {
-		counts = append(counts, v.(float64))
+// checkPWMPeriod warns about a PWM period that works but not well: one
+// whose duty steps are coarser than the pots, that is too short for a
+// channel's floor to register, or that is longer than a loop, so a duty
+// changes before its period is out.
+func checkPWMPeriod(c *Config, loop time.Duration) {
+	period := c.PWMPeriod.Duration
+	if steps := int(period / c.PWMResolution.Duration); steps < ainLevels {
+		slog.Warn("PWM period has fewer duty steps than the pots", "pwm_period", period, "duty_steps", steps, "pot_levels", ainLevels)
+	}
+	for i := range c.Channels {
+		if c.Channels[i].MinDuty > 0 && c.minDuty(byte(i)) < c.PWMResolution.Duration {
+			slog.Warn("min_duty is below the PWM resolution at this period", "step", i, "min_duty", c.Channels[i].MinDuty, "pwm_period", period)
+		}
+	}
+	if loop > 0 && loop < period {
+		slog.Warn("loop is shorter than the PWM period; duties change mid-period", "sleep", loop, "pwm_period", period)
 	}
-	window.Value = float64(aout)
-	window.Do(count)
-	sort.Float64s(counts)
-	return counts[*windowSize/2]
 }
 
+// Build identification; gobbb.sh sets commit and buildDate with
+// -ldflags "-X main.commit=... -X main.buildDate=...".
+var (
+	version   = "1.1"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// versionString describes the build for -version and the startup log.
+func versionString() string {
+	return fmt.Sprintf("LEDLightFantastic %s (commit %s, built %s)", version, commit, buildDate)
+}
+
+// calcDuty maps aout onto the PWM period through the configured brightness
+// curve, kept within the output range.
 func calcDuty(aout float64) time.Duration {
-	// theoretical max is 500000 but avoid hitting
-	// type Duration int64 as number of nanoseconds
-	return time.Duration(math.Min(.03*math.Pow(aout, 2)+ainMinPad, 499990))
+	return conf.curveDuty(brightness, aout)
 }
 
-func normalize(duties *[]time.Duration, duty time.Duration) time.Duration {
-	var sum time.Duration
-	for _, d := range *duties {
-		sum += d
+// curveDuty is calcDuty for any config and curve.
+func (c *Config) curveDuty(curve Curve, aout float64) time.Duration {
+	return c.clampOutput(curve.Duty(aout))
+}
+
+// normalize caps each raw duty at its LED's own limit and then scales them
+// all down in proportion if together they add up to more than the fixture
+// may draw, limit. The results go into applied. Normalizing the whole set at once
+// keeps the total within the cap even when several LEDs ramp together.
+// A lit LED below its floor is raised to it first, and only the part of
+// each duty above its floor is scaled, so the floors hold and still count
+// toward the cap. If the floors alone are over it, the cap wins and they
+// are scaled down too.
+//
+// With a knee below 1 the scaling starts earlier and gentler: a total up
+// to knee * limit passes untouched, and above that it is compressed
+// smoothly toward the limit, never reaching it, rather than cut off hard
+// the moment it goes over. See compress. It returns whether the duties
+// were scaled down.
+//
+// The total and the scale are worked out in float64, so however many
+// channels there are and however long their duties, the sum cannot
+// overflow and no duty is multiplied up before it is divided down. A
+// float64 holds a sum of duties exactly up to 2^53ns, over 100 days.
+func normalize(raw, minDuties, maxDuties, applied []time.Duration, limit time.Duration, knee float64) (scaled bool) {
+	var sum, floors float64
+	for i, d := range raw {
+		if d > maxDuties[i] {
+			d = maxDuties[i]
+		}
+		if d > 0 && d < minDuties[i] {
+			d = minDuties[i]
+		}
+		if d > 0 {
+			floors += float64(minDuties[i])
+		}
+		applied[i] = d
+		sum += float64(d)
 	}
 	// only normalize if needed
-	if sum > maxTotalDuty {
-		return maxTotalDuty * duty / sum
+	target := compress(sum, float64(limit), knee)
+	if target >= sum {
+		return false
 	}
+	if floors > target {
+		scale := target / sum
+		for i, d := range applied {
+			applied[i] = time.Duration(float64(d) * scale)
+		}
+		return true
+	}
+	// below 1, so no duty grows past what it was or falls below its floor
+	scale := (target - floors) / (sum - floors)
+	for i, d := range applied {
+		if d > 0 {
+			floor := float64(minDuties[i])
+			applied[i] = time.Duration(floor + (float64(d)-floor)*scale)
+		}
+	}
+	return true
+}
+
+// compress is the total duty, in nanoseconds, normalize scales a raw total
+// of sum down to. At a knee of 1, or for a total up to knee * limit, the
+// total is kept up to the limit. Past the knee the excess is squeezed
+// exponentially into the room left below limit, so the output rises at the
+// same slope as sum at the knee and flattens out toward limit.
+func compress(sum, limit, knee float64) float64 {
+	threshold := knee * limit
+	if knee >= 1 || sum <= threshold {
+		return math.Min(sum, limit)
+	}
+	room := limit - threshold
+	return threshold + room*(1-math.Exp(-(sum-threshold)/room))
+}
+
+// hold returns the reading the LED should follow: the last one it moved to,
+// until the smoothed reading leaves the deadband around it. A pot at either
+// end of its travel is always followed, so full off and full on are
+// reachable whatever the deadband.
+func (led *LED) hold(medAout float64) float64 {
+	if math.Abs(medAout-led.held) > conf.Deadband || medAout <= 0 || medAout >= ainLevels-1 {
+		led.held = medAout
+	}
+	return led.held
+}
+
+// slewTo moves the LED toward duty by at most its slew limit from where
+// the last loop left it. Before normalization, so the limits hold at
+// every point of the ramp.
+func (led *LED) slewTo(duty time.Duration) time.Duration {
+	if led.slew > 0 {
+		if duty > led.slewed+led.slew {
+			duty = led.slewed + led.slew
+		} else if duty < led.slewed-led.slew {
+			duty = led.slewed - led.slew
+		}
+	}
+	led.slewed = duty
 	return duty
 }
 
-// set duty based on median calculation
-func setDuty(pwm *bbhw.PWMLine, aout float64, step byte, duties *[]time.Duration, msgs *[]string) {
-	newDuty := calcDuty(aout)
-	normalDuty := normalize(duties, newDuty)
-	// we save raw values for normalization calcs but set pwm to normalized duty cycle
-	if newDuty != (*duties)[step] {
-		(*duties)[step] = newDuty
-		pwm.SetPWM(pwmPeriod, normalDuty)
+// potDuty is curveDuty for the pot of step, a channel whose floor is
+// minDuty, except that with a floor an input at or below aout_off is a
+// true off rather than a dim glow. Without calibration the curve is
+// padded by ainMinPad, so noise in the pot's dead zone cannot flicker the
+// LED down to zero.
+func (c *Config) potDuty(curve Curve, step byte, minDuty time.Duration, aout float64) time.Duration {
+	if minDuty > 0 && aout <= float64(c.AoutOff) {
+		return 0
 	}
-	if *debug {
-		(*msgs)[step] = fmt.Sprintf("%s   duty %9s", (*msgs)[step], normalDuty)
+	duty := curve.Duty(aout)
+	if !c.Channels[step].hasCalibration() {
+		duty += ainMinPad
+		if ceiling := c.PWMPeriod.Duration - c.PWMResolution.Duration; duty > ceiling {
+			duty = ceiling
+		}
 	}
+	return c.clampOutput(duty)
+}
+
+// roundDuty rounds a duty down to a step the PWM hardware can put out.
+// Down, so rounding never takes the total normalize kept within the cap
+// over it.
+func roundDuty(duty time.Duration) time.Duration {
+	res := conf.PWMResolution.Duration
+	return duty / res * res
 }
 
-func initWindow() *ring.Ring {
-	w := ring.New(*windowSize)
-	for i := 0; i < *windowSize; i++ {
-		w.Value = float64(0)
-		w = w.Next()
+// setDuties rounds each LED's applied duty to the PWM resolution and writes
+// it to its PWM line if it changed since the last write. A strobing LED
+// gets its duty through the strobe.
+//
+// Each write is a sysfs write that can block, so when several lines change
+// they are written in parallel, one goroutine per line. A goroutine only
+// touches its own LED and its own element of written, and applied is not
+// changed until they are all done.
+func setDuties(LEDMap map[byte]*LED, applied, written []time.Duration) {
+	var changed []byte
+	for step, led := range LEDMap {
+		duty := roundDuty(applied[step])
+		if applied[step] > 0 && duty == 0 && !led.roundedOff {
+			slog.Warn("duty is below the PWM resolution, so the LED stays off", "step", step, "name", led.name, "duty", applied[step], "pwm_resolution", conf.PWMResolution)
+			led.roundedOff = true
+		}
+		applied[step] = duty
+		if led.disabled && !led.invert {
+			continue // powered down by applyDisabled
+		}
+		if led.strobe != nil {
+			led.strobe.setDuty(applied[step])
+			written[step] = -1 // rewrite once the strobe stops
+			continue
+		}
+		if applied[step] != written[step] {
+			changed = append(changed, step)
+		}
+	}
+	if len(changed) == 1 {
+		step := changed[0]
+		LEDMap[step].setPWM(applied[step])
+		written[step] = applied[step]
+		return
 	}
-	return w
+	var wg sync.WaitGroup
+	for _, step := range changed {
+		wg.Add(1)
+		go func(step byte) {
+			defer wg.Done()
+			defer failsafe()
+			LEDMap[step].setPWM(applied[step])
+			written[step] = applied[step]
+		}(step)
+	}
+	wg.Wait()
 }
 
-func addDTOIfNotExists(dto string) {
-	log.Println("looking for slots file")
+// how long the cape manager gets to list an overlay it was asked to load
+const dtoLoadWait = 2 * time.Second
+
+// errNoCapeManager explains a missing slots file, which otherwise fails as
+// a bare "not found" from bbhw.
+var errNoCapeManager = errors.New("no cape manager at /sys/devices/bone_capemgr.*: overlays can only be loaded at runtime on the 3.8 kernel; on later kernels apply the PWM overlays at boot, e.g. in /boot/uEnv.txt, so the PWM chips show up in /sys/class/pwm, or run with -skip-dto")
+
+// readSlots returns the cape manager's list of loaded overlays.
+func readSlots() ([]byte, error) {
+	if found, _ := filepath.Glob(slotsGlob); len(found) == 0 {
+		return nil, errNoCapeManager
+	}
+	slog.Debug("looking for slots file")
 	slotsFileName, err := bbhw.FindSlotsFile()
 	if err != nil {
-		log.Fatalln(err)
+		return nil, fmt.Errorf("could not find slots file: %s", err)
 	}
-	log.Println("found slots file", slotsFileName)
+	slog.Debug("found slots file", "path", slotsFileName)
 	time.Sleep(100 * time.Millisecond)
-	log.Println("reading slots file")
 	slots, err := ioutil.ReadFile(slotsFileName)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, fmt.Errorf("could not read slots file %s: %s", slotsFileName, err)
+	}
+	return slots, nil
+}
+
+// addDTOIfNotExists asks the cape manager for an overlay unless it is
+// already loaded, and waits for it to show up in the slots file.
+func addDTOIfNotExists(dto string) {
+	if *skipDTO || pwmClass {
+		return
+	}
+	slots, err := readSlots()
+	if err != nil {
+		fatal("could not read overlays", "err", err)
 	}
 	if bytes.Contains(slots, []byte(dto)) {
-		log.Println("slots file already contains overlay", dto)
+		slog.Debug("slots file already contains overlay", "dto", dto)
 		return
 	}
-	log.Println("adding DTO", dto)
+	slog.Info("adding DTO", "dto", dto)
 	if err := bbhw.AddDeviceTreeOverlay(dto); err != nil {
-		log.Fatalln(err)
+		fatal("could not add DTO", "dto", dto, "err", err)
+	}
+	for deadline := time.Now().Add(dtoLoadWait); ; {
+		time.Sleep(100 * time.Millisecond)
+		slots, err := readSlots()
+		if err != nil {
+			fatal("could not read overlays", "err", err)
+		}
+		if bytes.Contains(slots, []byte(dto)) {
+			return
+		}
+		if time.Now().After(deadline) {
+			fatal("cape manager did not load DTO; see dmesg", "dto", dto, "wait", dtoLoadWait)
+		}
 	}
-	time.Sleep(100 * time.Millisecond)
 }
 
-func newPWM(pwmPin string) *bbhw.PWMLine {
-	addDTOIfNotExists("bone_pwm_" + pwmPin)
-	pwm, err := bbhw.NewBBBPWM(pwmPin)
-	if err != nil {
-		log.Fatalln(err)
+// openPWM opens the real PWM line of a header pin in the sysfs layout of
+// the running kernel.
+func openPWM(pwmPin string) (readablePWM, error) {
+	if pwmClass {
+		return newClassPWM(pwmPin)
 	}
-	pwm.SetPolarity(true)
+	return bbhw.NewBBBPWM(pwmPin)
+}
+
+func newPWM(pwmPin string, polarity bool) PWM {
+	var pwm PWM
+	if *simulate {
+		pwm = &simPWM{pin: pwmPin}
+	} else {
+		addDTOIfNotExists("bone_pwm_" + pwmPin)
+		line, err := openPWM(pwmPin)
+		if err != nil {
+			fatal("could not open PWM", "pin", pwmPin, "err", err)
+		}
+		pwm = line
+	}
+	pwm.SetPolarity(polarity)
 	return pwm
 }
 
 type LED struct {
-	pwm *bbhw.PWMLine
-	win *ring.Ring
+	pwm     PWM
+	invert  bool // write period - duty, for LEDs that light when the pin is low
+	smooth  Smoother
+	held    float64       // smoothed reading the LED follows, within the deadband
+	maxDuty time.Duration // this LED's ceiling, within the fixture's total
+	minDuty time.Duration // least duty that lights without flicker; 0 for none
+	trim    float64       // color balance factor, applied before normalization
+	slew    time.Duration // most the duty may change per loop; 0 for no limit
+	slewed  time.Duration // duty after the slew limit last loop
+	name    string        // for logs and the APIs, e.g. "white"
+	strobe  *strobe       // nil unless strobing
+	clipped uint64        // raw readings at or beyond the ADC range
+	// out of service; see disabledSteps
+	disabled bool
+	// warned that a duty rounded to the PWM resolution left it off
+	roundedOff bool
+	// pot sets the peak of a slow sine, from -breathe
+	breathe bool
+	// resuming from -state
+	restored     bool          // holding restoredDuty until the pot moves
+	restoredDuty time.Duration // duty saved before the restart
+	restoredAout float64       // first pot reading after the restart; -1 until read
 	// auto mode
-	autoLoop         int       // current loop number
-	autoLoopMax      int       // number of loops between changes to aout offset
-	updateLoopSize   bool      // flag indicating speed pot was changed
-	lastLoopAdjust   time.Time // most recent attempt to adjust loop size
-	autoOffset       int       // offset to aout in auto mode
-	autoOffsetDelta  int       // direction to change aout offset
-	autoOffsetMax    int       // outer bounds +/-
-	lastOffsetAdjust time.Time // most recent attempt to adjust offset size
+	rnd              *rand.Rand // own source so auto mode can be seeded deterministically
+	autoLoop         int        // current loop number
+	autoLoopMax      int        // number of loops between changes to aout offset
+	updateLoopSize   bool       // flag indicating speed pot was changed
+	lastLoopAdjust   time.Time  // most recent attempt to adjust loop size
+	autoOffset       int        // offset to aout in auto mode
+	autoOffsetDelta  int        // direction to change aout offset
+	autoOffsetMax    int        // outer bounds +/-
+	lastOffsetAdjust time.Time  // most recent attempt to adjust offset size
 }
 
 // Incoming aout always reflects the current pot setting. What varies
 // over time is the autoOffset, which starts out at zero and always
-// remains within +/-autoOffsetMax.
+// remains within the bounds of autoBounds, +/-autoOffsetMax unless the
+// walk is skewed.
 func (led *LED) autoAdjust(aout int, loopMax int) {
 	led.autoLoop++
+	lo, hi := led.autoBounds()
 
 	// Respond immediately when loop controlling pot is adjusted.
 	if led.updateLoopSize || led.autoLoop > led.autoLoopMax {
 		if led.updateLoopSize {
-			led.autoLoopMax = randomAutoLoopMax(loopMax)
+			led.autoLoopMax = randomAutoLoopMax(led.rnd, loopMax)
 			led.updateLoopSize = false
 		}
 
@@ -216,25 +538,26 @@ func (led *LED) autoAdjust(aout int, loopMax int) {
 		// happen when the boundary is reset.) Boundaries includes zero and the
 		// maximum possible level.  The two fixed boundaries prevent an LED
 		// from parking at either extreme.
-		if (led.autoOffset > led.autoOffsetMax && led.autoOffsetDelta > 0) || (led.autoOffset < -led.autoOffsetMax && led.autoOffsetDelta < 0) || (aout+led.autoOffset) <= aoutOff || (aout+led.autoOffset) >= aoutOn {
+		if (led.autoOffset > hi && led.autoOffsetDelta > 0) || (led.autoOffset < lo && led.autoOffsetDelta < 0) || (aout+led.autoOffset) <= conf.AoutOff || (aout+led.autoOffset) >= conf.AoutOn {
 			led.autoOffsetDelta = -led.autoOffsetDelta
 			// Every so often change max size of offset for variety
 			// esp. important for fast changing settings
-			if time.Since(led.lastOffsetAdjust) > autoOffsetAdjust {
+			if time.Since(led.lastOffsetAdjust) > conf.AutoOffsetAdjust.Duration {
 				led.lastOffsetAdjust = time.Now()
-				if rand.Intn(2) == 0 {
+				if led.rnd.Intn(2) == 0 {
 					// We limit intensity range at lower intensity settings.
 					offsetMax := aout * autoOffsetMaxRatio
-					if offsetMax > autoOffsetMax {
-						offsetMax = autoOffsetMax
+					if offsetMax > conf.AutoOffsetMax {
+						offsetMax = conf.AutoOffsetMax
 					}
-					led.autoOffsetMax = randomAutoOffsetMax(offsetMax)
+					led.autoOffsetMax = randomAutoOffsetMax(led.rnd, offsetMax)
+					lo, hi = led.autoBounds()
 					// Is possible that current offset is well outside new boundary
 					// Set direction so led moves to get back inside boundaries
-					if led.autoOffset > led.autoOffsetMax {
-						led.autoOffsetDelta = -autoOffsetDelta
-					} else if led.autoOffset < -led.autoOffsetMax {
-						led.autoOffsetDelta = autoOffsetDelta
+					if led.autoOffset > hi {
+						led.autoOffsetDelta = -conf.AutoOffsetDelta
+					} else if led.autoOffset < lo {
+						led.autoOffsetDelta = conf.AutoOffsetDelta
 					}
 				}
 			}
@@ -242,19 +565,31 @@ func (led *LED) autoAdjust(aout int, loopMax int) {
 
 		// every so often change size of auto loop to change the change
 		// this has no effect when changing at maximum rate
-		if !led.updateLoopSize && time.Since(led.lastLoopAdjust) > autoLoopAdjust {
+		if !led.updateLoopSize && time.Since(led.lastLoopAdjust) > conf.AutoLoopAdjust.Duration {
 			led.lastLoopAdjust = time.Now()
-			if rand.Intn(3) == 0 { // so LEDs do not follow in lockstep
-				led.autoLoopMax = randomAutoLoopMax(loopMax)
+			if led.rnd.Intn(3) == 0 { // so LEDs do not follow in lockstep
+				led.autoLoopMax = randomAutoLoopMax(led.rnd, loopMax)
 			}
 		}
 	}
 
 }
 
+// autoBounds are the offsets at which the walk turns back. For -automode
+// dark both are shifted down by auto_skew of autoOffsetMax, so the LED
+// spends most of its time dimmer than the pot and only now and then
+// flares above it.
+func (led *LED) autoBounds() (lo, hi int) {
+	if *autoEffect != autoDark {
+		return -led.autoOffsetMax, led.autoOffsetMax
+	}
+	shift := int(conf.AutoSkew * float64(led.autoOffsetMax))
+	return -led.autoOffsetMax - shift, led.autoOffsetMax - shift
+}
+
 // Adds a degree of randomness to the maximum size of the offset applied to the
 // LED intensity value dialed by the user.
-func randomAutoOffsetMax(offsetMax int) int {
+func randomAutoOffsetMax(r *rand.Rand, offsetMax int) int {
 	if offsetMax < 1 {
 		offsetMax = 1
 	}
@@ -262,12 +597,12 @@ func randomAutoOffsetMax(offsetMax int) int {
 	// Larger value lowers lower limit of variability.
 	const offsetRangeRatio int = 2
 	offsetMinPad := offsetMax / offsetRangeRatio
-	return rand.Intn(offsetMax-offsetMinPad) + offsetMinPad
+	return r.Intn(offsetMax-offsetMinPad) + offsetMinPad
 }
 
 // Adds a degree of randomness to the size of the loops used to inc/dec the LED
 // intensities.
-func randomAutoLoopMax(loopMax int) int {
+func randomAutoLoopMax(rnd *rand.Rand, loopMax int) int {
 	if loopMax < 1 {
 		loopMax = 1
 	}
@@ -276,7 +611,7 @@ func randomAutoLoopMax(loopMax int) int {
 	// For loop speed if user says slow down, we try to comply.
 	const loopRangeRatio int = 2
 	loopMinPad := loopMax / loopRangeRatio
-	r := rand.Intn(loopMax-loopMinPad) + loopMinPad
+	r := rnd.Intn(loopMax-loopMinPad) + loopMinPad
 	if r == 0 {
 		return 1
 	}
@@ -284,156 +619,805 @@ func randomAutoLoopMax(loopMax int) int {
 }
 
 // Randomize whether to increase or decrease color intensity.
-func randomAutoOffsetDelta() int {
-	if rand.Intn(2) == 0 {
-		return autoOffsetDelta
+func randomAutoOffsetDelta(r *rand.Rand) int {
+	if r.Intn(2) == 0 {
+		return conf.AutoOffsetDelta
 	}
-	return -autoOffsetDelta
+	return -conf.AutoOffsetDelta
 }
 
+// initPWMs sets up a PWM line for each configured channel, keyed by the
+// ADC step of the pot controlling it.
 func initPWMs() map[byte]*LED {
 	// do not remove pwm; will crash BBB
-	addDTOIfNotExists(pwmDTO)
-	pwm14 := newPWM("P9_14") // green
-	pwm16 := newPWM("P9_21") // red
-	pwm21 := newPWM("P9_16") // white
-	pwm22 := newPWM("P9_22") // blue
+	if !*simulate {
+		addDTOIfNotExists(pwmDTO)
+	}
 
 	// map ADC step channels to PWM pins
-	// adjusted LEDs to mirror RGBW on my potentiometer test board
-	LEDMap := map[byte]*LED{
-		0: &LED{
-			pwm:             pwm21,
-			win:             initWindow(),
-			autoLoopMax:     randomAutoLoopMax(autoLoopMax),
-			autoOffsetDelta: randomAutoOffsetDelta(),
-			autoOffsetMax:   randomAutoOffsetMax(autoOffsetMax),
-		},
-		1: &LED{
-			pwm:             pwm14,
-			win:             initWindow(),
-			autoLoopMax:     randomAutoLoopMax(autoLoopMax),
-			autoOffsetDelta: randomAutoOffsetDelta(),
-			autoOffsetMax:   randomAutoOffsetMax(autoOffsetMax),
-		},
-		2: &LED{
-			pwm:             pwm22,
-			win:             initWindow(),
-			autoLoopMax:     randomAutoLoopMax(autoLoopMax),
-			autoOffsetDelta: randomAutoOffsetDelta(),
-			autoOffsetMax:   randomAutoOffsetMax(autoOffsetMax),
-		},
-		3: &LED{
-			pwm:             pwm16,
-			win:             initWindow(),
-			autoLoopMax:     randomAutoLoopMax(autoLoopMax),
-			autoOffsetDelta: randomAutoOffsetDelta(),
-			autoOffsetMax:   randomAutoOffsetMax(autoOffsetMax),
-		},
+	LEDMap := make(map[byte]*LED, len(conf.Channels))
+	for i, ch := range conf.Channels {
+		step := byte(i)
+		smooth, err := newSmoother()
+		if err != nil {
+			fatal("could not set up smoothing", "err", err)
+		}
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano() + int64(i)))
+		LEDMap[step] = &LED{
+			pwm:             newPWM(ch.PWM, ch.polarity()),
+			invert:          ch.Invert,
+			maxDuty:         conf.maxDuty(step),
+			minDuty:         conf.minDuty(step),
+			slew:            conf.slew(step),
+			trim:            conf.trim(step),
+			name:            conf.channelName(step),
+			smooth:          smooth,
+			rnd:             rnd,
+			autoLoopMax:     randomAutoLoopMax(rnd, conf.AutoLoopMax),
+			autoOffsetDelta: randomAutoOffsetDelta(rnd),
+			autoOffsetMax:   randomAutoOffsetMax(rnd, conf.AutoOffsetMax),
+		}
 	}
 	return LEDMap
 }
 
-// translate pot aout to auto loop max size
+// setPWM writes a duty to the LED's PWM line. The duty is the light wanted,
+// clamped to the period; inverted LEDs get the rest of the period instead.
+// Strobes call it from their own goroutines, so it takes the period with
+// currentConfig.
+func (led *LED) setPWM(duty time.Duration) {
+	period := currentConfig().PWMPeriod.Duration
+	if duty < 0 {
+		duty = 0
+	} else if duty > period {
+		duty = period
+	}
+	if led.invert {
+		duty = period - duty
+	}
+	led.pwm.SetPWM(period, duty)
+}
+
+// disablePWMs turns off every LED.
+func disablePWMs(LEDMap map[byte]*LED) {
+	for _, led := range LEDMap {
+		if led == nil {
+			continue
+		}
+		if led.strobe != nil {
+			led.strobe.halt()
+		}
+		if led.invert {
+			// the pin may idle at the level that lights the LED
+			led.setPWM(0)
+		}
+		led.pwm.DisablePWM()
+	}
+}
+
+// What turns the LEDs and ADC off, run at most once on the way out.
+var shutdown struct {
+	once sync.Once
+	off  func()
+}
+
+// setOutputsOff registers off to run on exit or panic. It must be called
+// before any goroutine that defers failsafe is started.
+func setOutputsOff(off func()) {
+	shutdown.off = off
+}
+
+// outputsOff turns the LEDs and ADC off, if they have been set up.
+func outputsOff() {
+	shutdown.once.Do(func() {
+		if shutdown.off != nil {
+			shutdown.off()
+		}
+	})
+}
+
+// failsafe is deferred by main and every long running goroutine. A panic
+// would otherwise end the process with the LEDs stuck wherever they were,
+// and a fixture left fully on can overheat. It logs the panic with a stack
+// trace, turns the outputs off and panics again.
+func failsafe() {
+	if r := recover(); r != nil {
+		stack := make([]byte, 64<<10)
+		stack = stack[:runtime.Stack(stack, false)]
+		slog.Error("panic", "value", r, "stack", string(stack))
+		outputsOff()
+		panic(r)
+	}
+}
+
+// translate pot aout to auto loop max size, from the first loop speed whose
+// max_aout is above aout; validate keeps them sorted
 func calcStepLoopMax(aout float64) int {
-	switch {
-	case aout < 20:
-		return 1024 // lowest speed
-	case aout < 60:
-		return 512
-	case aout < 130:
-		return 256
-	case aout < 200:
-		return 128
-	case aout < 400:
-		return 64
-	case aout < 800:
-		return 32
-	case aout < 1200:
-		return 16
-	case aout < 2000:
-		return 8
-	case aout < 3500:
-		return 4
-	case aout < 4090:
-		return 2
-	}
-	return 1 // highest speed
-}
-
-// calcAutoMode sets autoMode to true if one pot is off and three are on,
-// false if all pots are off, and returns the input value otherwise.
+	speeds := conf.LoopSpeeds
+	i := sort.Search(len(speeds), func(i int) bool { return aout < speeds[i].MaxAout })
+	if i == len(speeds) {
+		return speeds[len(speeds)-1].LoopMax // highest speed
+	}
+	return speeds[i].LoopMax
+}
+
+// calcAutoMode sets autoMode to true if one pot is off and the rest are on,
+// false if all pots are below aout_exit, and returns the input value
+// otherwise.
 // Also calculated and returned is the step number that was set to off.
 // The off step is used to set the maximum loop speed.
 func calcAutoMode(autoMode bool, autoLoopStep byte, aoutMap map[byte]int) (bool, byte) {
-	var offCt, onCt uint8
+	var offCt, onCt, exitCt uint8
 	var ls byte
 	for step, aout := range aoutMap {
 		switch {
-		case aout < aoutOff:
+		case aout < conf.AoutOff:
 			offCt += 1
 			ls = step // iff auto mode switches on
-		case aout > aoutOn:
+		case aout > conf.AoutOn:
 			onCt += 1
 		}
+		if aout < conf.AoutExit {
+			exitCt += 1
+		}
 	}
-	if offCt == 4 {
+	if int(exitCt) == len(aoutMap) {
 		return false, autoLoopStep // set auto mode off
 	}
-	if offCt == 1 && onCt == 3 {
+	if offCt == 1 && int(onCt) == len(aoutMap)-1 {
 		return true, ls // set auto mode on
 	}
 	return autoMode, autoLoopStep // leaves as is
 }
 
+// autoGesture debounces calcAutoMode: a change of mode or speed pot takes
+// effect only once the pots have shown it for gesture_loops loops in a row,
+// so noise around the thresholds cannot flap auto mode on and off.
+type autoGesture struct {
+	on      bool
+	step    byte
+	pending bool // wantOn and wantStep are being counted
+	wantOn  bool
+	want    byte
+	count   int
+}
+
+// update feeds one loop's readings to the gesture and returns the settled
+// mode and speed pot.
+func (g *autoGesture) update(aoutMap map[byte]int) (bool, byte) {
+	on, step := calcAutoMode(g.on, g.step, aoutMap)
+	switch {
+	case on == g.on && step == g.step:
+		g.pending = false
+	case !g.pending || on != g.wantOn || step != g.want:
+		g.pending, g.wantOn, g.want, g.count = true, on, step, 1
+	default:
+		g.count++
+	}
+	if g.pending && g.count >= conf.GestureLoops {
+		g.on, g.step, g.pending = g.wantOn, g.want, false
+	}
+	return g.on, g.step
+}
+
 func main() {
-	rand.Seed(time.Now().UnixNano())
 	var sleepDuration time.Duration
 	var err error
 	flag.Parse()
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+	if *listPinsRun {
+		listPins(os.Stdout)
+		return
+	}
+	if err = setupLogging(); err != nil {
+		fatal("bad logging flags", "err", err)
+	}
+	slog.Info("starting", "version", version, "commit", commit, "built", buildDate)
 	if sleepDuration, err = time.ParseDuration(*sleep); err != nil {
-		log.Fatal("could not interpret sleep duration '%v'", *sleep)
+		fatal("could not interpret sleep duration", "sleep", *sleep)
+	}
+	if *maxRate < 0 {
+		fatal("-maxrate must not be negative", "maxrate", *maxRate)
+	}
+	health.stall = healthStall(sleepDuration, *maxRate)
+	if *healthzStall != "" {
+		if health.stall, err = time.ParseDuration(*healthzStall); err != nil || health.stall <= 0 {
+			fatal("could not interpret healthz stall time", "healthz-stall", *healthzStall)
+		}
+	}
+	if *windowSize < windowSizeMin || *windowSize > windowSizeMax {
+		fatal("illegal window size", "window", *windowSize, "min", windowSizeMin, "max", windowSizeMax)
+	}
+	// from here on the median windows only know the size they were given
+	window.size = *windowSize
+	fadeIn, err := time.ParseDuration(*startupFade)
+	if err != nil || fadeIn < 0 {
+		fatal("could not interpret startup fade", "startup-fade", *startupFade)
+	}
+	idleTimeout, err := time.ParseDuration(*idle)
+	if err != nil || idleTimeout < 0 {
+		fatal("could not interpret idle time", "idle", *idle)
+	}
+	watchdogTimeout, err := time.ParseDuration(*watchdog)
+	if err != nil || watchdogTimeout < 0 {
+		fatal("could not interpret watchdog timeout", "watchdog", *watchdog)
 	}
 	if (*clockDivider < clockDividerMin) || (*clockDivider > clockDividerMax) {
-		log.Fatalf("illegal ADC clock divider: must be %v to %v", clockDividerMin, clockDividerMax)
+		fatal("illegal ADC clock divider", "divider", *clockDivider, "min", clockDividerMin, "max", clockDividerMax)
+	}
+	hwAvg, avgPasses, err := parseAveraging(*sampleAvg)
+	if err != nil {
+		fatal("bad -average", "err", err)
+	}
+	if avgPasses > 1 && *continuous {
+		fatal("-average above 16 needs one-shot mode, without -continuous")
+	}
+	if *fifoSamples < 1 {
+		fatal("-fifo-samples must be at least 1", "fifo-samples", *fifoSamples)
+	}
+	if *fifoSamples > 1 && (*continuous || avgPasses > 1) {
+		fatal("-fifo-samples needs one-shot mode, without -continuous or -average above 16")
+	}
+	var settle time.Duration
+	if *adcSettle != "" {
+		if settle, err = time.ParseDuration(*adcSettle); err != nil || settle <= 0 {
+			fatal("could not interpret ADC settling delay", "adc-settle", *adcSettle)
+		}
+	}
+	var readTimeout time.Duration
+	if *adcTimeout != "" {
+		if readTimeout, err = time.ParseDuration(*adcTimeout); err != nil || readTimeout <= 0 {
+			fatal("could not interpret ADC read timeout", "adc-timeout", *adcTimeout)
+		}
+	}
+	// before the config, whose pins depend on it
+	switch *pwmSysfs {
+	case "auto":
+		pwmClass = !*simulate && detectPWMClass()
+	case "capemgr":
+	case "class":
+		pwmClass = true
+	default:
+		fatal("unknown -pwm-sysfs layout", "pwm-sysfs", *pwmSysfs)
+	}
+	if pwmClass {
+		slog.Debug("using the /sys/class/pwm layout")
+	}
+	if *calibrateRun && *configPath == "" {
+		fatal("-calibrate needs -config to save to")
+	}
+	if *configPath != "" {
+		if conf, err = loadConfig(*configPath); os.IsNotExist(err) && *calibrateRun {
+			// calibration starts the file
+			conf = defaultConfig()
+		} else if err != nil {
+			fatal("could not load config", "path", *configPath, "err", err)
+		}
+	}
+	if *gammaFlag != 0 {
+		conf.Gamma = *gammaFlag
+	}
+	if *pwmPeriodArg != "" {
+		if conf.PWMPeriod.Duration, err = time.ParseDuration(*pwmPeriodArg); err != nil {
+			fatal("could not interpret PWM period", "pwm-period", *pwmPeriodArg)
+		}
+	}
+	// the flags are checked with the rest of the config they override
+	if *gammaFlag != 0 || *pwmPeriodArg != "" {
+		if err = conf.validate(); err != nil {
+			fatal("bad -gamma or -pwm-period", "err", err)
+		}
+	}
+	checkPWMPeriod(conf, sleepDuration)
+	if brightness, err = newCurve(conf); err != nil {
+		fatal("could not set up brightness curve", "err", err)
+	}
+
+	pins := ainPins[:conf.potCount()]
+	if *pinList != "" {
+		if pins, err = parsePins(*pinList); err != nil {
+			fatal("bad -pins", "err", err)
+		}
+		if len(pins) != conf.potCount() {
+			fatal("-pins must name one pin per pot", "pins", len(pins), "channels", len(conf.Channels), "aux_pots", len(conf.AuxPots))
+		}
+	}
+	if *fifoSamples*len(pins) > ADC_FIFO_DEPTH {
+		fatal("-fifo-samples of every pot must fit in the ADC FIFO", "fifo-samples", *fifoSamples, "pots", len(pins), "fifo", ADC_FIFO_DEPTH)
+	}
+
+	if *checkRun {
+		if *simulate {
+			fatal("-check reads the BeagleBone hardware; it cannot be simulated")
+		}
+		if err := checkHardware(os.Stdout, pins); err != nil {
+			fatal("could not check hardware", "err", err)
+		}
+		return
+	}
+
+	switch *autoEffect {
+	case autoRandom, autoDark, autoChase:
+	case autoRainbow:
+		if !conf.hasColor(colorRed) && !conf.hasColor(colorGreen) && !conf.hasColor(colorBlue) {
+			fatal("-automode rainbow needs channels with a color")
+		}
+	default:
+		fatal("illegal -automode: must be random, dark, rainbow or chase", "automode", *autoEffect)
+	}
+
+	strobeRates, err := parseStrobes(*strobeList, len(conf.Channels))
+	if err != nil {
+		fatal("bad -strobe", "err", err)
+	}
+	for step, hz := range strobeRates {
+		setStrobe(step, hz)
+	}
+
+	if *cct != 0 {
+		if *cct < 0 {
+			fatal("illegal color temperature: must be positive", "cct", *cct)
+		}
+		if _, err := setCCT(conf, *cct, 1); err != nil {
+			fatal("bad -cct", "err", err)
+		}
+	}
+
+	breathing, err := parseSteps(*breatheList, len(conf.Channels))
+	if err != nil {
+		fatal("bad -breathe", "err", err)
 	}
 
 	LEDMap := initPWMs()
+	for step := range breathing {
+		LEDMap[step].breathe = true
+	}
+	breatheStart := time.Now()
+
+	ledCount := len(conf.Channels)
+	var adc ADC = &mmapADC{continuous: *continuous, threshold: *threshold, passes: avgPasses, samples: *fifoSamples, settle: settle, timeout: readTimeout, rangeMin: conf.ADCRangeMin, rangeMax: conf.ADCRangeMax, pins: len(pins)}
+	if *mock || *simulate {
+		m := newMockADC(sweepScript(stepCount(pins), mockSweepLength))
+		m.samples = *fifoSamples
+		adc = m
+	}
+	if err = adc.Init(byte(*clockDivider-1), hwAvg, stepCount(pins)); err != nil {
+		fatal("could not initialize ADC", "err", err)
+	}
+	if conversion := ADCConversionTime(byte(*clockDivider-1), hwAvg, stepCount(pins)); settle > 0 && settle < conversion {
+		slog.Warn("-adc-settle is shorter than the conversions; expect under-reads", "adc-settle", settle, "conversion", conversion)
+	}
+	// the lights go dark before the ADC is disabled, whether main returns
+	// or any goroutine panics
+	setADCReady(true)
+	setOutputsOff(func() {
+		disablePWMs(LEDMap)
+		setADCReady(false)
+		adc.Disable()
+	})
+	defer outputsOff()
+	defer failsafe()
 
-	ADCInit(byte(*clockDivider-1), sampleAvgMap[*sampleAvg])
-	defer ADCDisable()
+	// SIGINT or SIGTERM ends the loop so the deferred cleanup can run.
+	// A fixture left fully on can overheat.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	// SIGHUP reloads the -config file, as POST /reload does
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go watchSIGHUP(hup)
+
+	if *calibrateRun {
+		// only the channels' pots; aux pots are used as they read
+		ranges, err := calibrate(adc, pins[:ledCount], stop)
+		if err != nil {
+			slog.Error("could not read ADC", "err", err)
+			return
+		}
+		applyCalibration(conf, ranges)
+		if err := saveCalibration(*configPath, conf); err != nil {
+			slog.Error("could not save calibration", "path", *configPath, "err", err)
+			return
+		}
+		slog.Info("saved calibration", "path", *configPath)
+		return
+	}
+
+	var sensor *ambientSensor
+	if *ambient {
+		for _, pin := range pins {
+			if pin == P9_33 {
+				// the sensor is on AIN4, which is then a pot
+				fatal("-ambient needs AIN4 (P9_33) for the light sensor; leave it out of the pots", "channels", ledCount, "aux_pots", len(conf.AuxPots))
+			}
+		}
+		path := ainPath
+		if pwmClass {
+			path = ainClassPath
+		}
+		sensor = newAmbientSensor(path)
+	}
+	var thermal *thermalThrottle
+	if *thermalPath != "" {
+		thermal = newThermalThrottle(sysfsTemp{*thermalPath})
+	}
+
+	if *metrics {
+		if *httpAddr == "" {
+			fatal("-metrics needs -http")
+		}
+		registerMetrics()
+	}
+	if *httpAddr != "" {
+		go serveHTTP(*httpAddr)
+	}
+	if *emergencyPin >= 0 {
+		if err := watchEmergencyGPIO(uint(*emergencyPin)); err != nil {
+			fatal("could not open emergency input", "gpio", *emergencyPin, "err", err)
+		}
+	}
+	if *freezePin >= 0 {
+		if err := watchFreezeGPIO(uint(*freezePin)); err != nil {
+			fatal("could not open freeze input", "gpio", *freezePin, "err", err)
+		}
+	}
+
+	// an optional control source replaces the pots
+	var source controlSource
+	if *dmxDevice != "" {
+		if source, err = newDMXSource(*dmxDevice, *dmxAddress, ledCount); err != nil {
+			fatal("could not start DMX input", "device", *dmxDevice, "err", err)
+		}
+	}
+	if *artNet {
+		if source != nil {
+			fatal("choose only one control source")
+		}
+		if source, err = newArtNetSource(fmt.Sprintf(":%d", artNetPort), *artNetUni, *dmxAddress, ledCount); err != nil {
+			fatal("could not start Art-Net input", "err", err)
+		}
+	}
+	if *mqttBroker != "" {
+		if source != nil {
+			fatal("choose only one control source")
+		}
+		if source, err = newMQTTSource(*mqttBroker, *mqttPrefix, ledCount); err != nil {
+			fatal("could not connect to MQTT broker", "broker", *mqttBroker, "err", err)
+		}
+	}
+	if *oscAddr != "" {
+		if source != nil {
+			fatal("choose only one control source")
+		}
+		if source, err = newOSCSource(*oscAddr, *oscReply, ledCount); err != nil {
+			fatal("could not start OSC input", "addr", *oscAddr, "err", err)
+		}
+	}
+	if *replayPath != "" {
+		if source != nil {
+			fatal("choose only one control source")
+		}
+		if source, err = newReplaySource(*replayPath, ledCount, *replaySpeed, *replayLoop); err != nil {
+			fatal("could not start replay", "path", *replayPath, "err", err)
+		}
+	}
+	if source != nil {
+		slog.Info("LEDs controlled by control source", "source", source.name())
+	}
 
 	// setup a data structure to map steps to pins and pwms
 	// windows to average the analog input values
 	var led *LED
 	// for efficiency, though it seems to make no difference to cpu%
-	duties := make([]time.Duration, 4)
-	// for debug logging
-	msgs := make([]string, 4) // 4 LED colors max
+	// raw duties are what each LED asks for, applied are after normalization
+	duties := make([]time.Duration, ledCount)
+	applied := make([]time.Duration, ledCount)
+	inputs := make([]channelInput, ledCount)
+	disabled := make([]bool, ledCount)
+	written := make([]time.Duration, ledCount)
+	maxDuties := make([]time.Duration, ledCount)
+	minDuties := make([]time.Duration, ledCount)
+	for step, led := range LEDMap {
+		maxDuties[step] = led.maxDuty
+		minDuties[step] = led.minDuty
+		written[step] = -1 // force the first write
+	}
+	// set up before anything lights the LEDs, which fatal would leave on
+	aux, err := newAuxPots(byte(ledCount), conf.AuxPots)
+	if err != nil {
+		fatal("could not set up aux pots", "err", err)
+	}
+	var rec *recorder
+	if *recordPath != "" {
+		if rec, err = newRecorder(*recordPath); err != nil {
+			fatal("could not start recording", "path", *recordPath, "err", err)
+		}
+		defer rec.close()
+	}
+	disableFromConfig(conf)
+	applyDisabled(LEDMap, written)
+	if *selfTestRun && !selfTest(LEDMap, minDuties, maxDuties, applied, written, stop) {
+		return
+	}
+	if *statePath != "" && *restoreState {
+		saved, err := loadState(*statePath, ledCount)
+		if err != nil {
+			slog.Warn("not resuming from state file", "path", *statePath, "err", err)
+		} else if saved != nil {
+			saved.restore(LEDMap)
+			copy(duties, saved.Duties)
+			if fadeIn == 0 {
+				// otherwise the startup fade brings them up
+				normalize(duties, minDuties, maxDuties, applied, conf.maxTotalDuty(), conf.limiterKnee())
+				setDuties(LEDMap, applied, written)
+			}
+		}
+	}
+	lastSave := time.Now()
+	// per channel fields for the debug record
+	dbg := make([][]slog.Attr, ledCount)
+	// the playing scene's duties, copied each loop
+	sceneBuf := make([]time.Duration, ledCount)
+	// built up each loop and then published for the HTTP API
+	snap := fixtureStatus{Channels: make([]channelStatus, ledCount)}
 
 	var aoutMap map[byte]int
+	var levels map[byte]int // from the control source; nil while the pots are in charge
+	saver := powerSaver{after: idleTimeout}
+	var lastFrame time.Time          // when the control source last sent levels
+	var silent bool                  // the watchdog is fading out a silent source
 	var medAout float64              // median value of aout
 	var autoAout float64             // aout after auto mode offset
 	var autoMode bool                // auto mode continuously varies light intensity
 	var autoLoopStep byte            // pot that affects loop size, i.e., variation speed
+	var gesture autoGesture          // auto mode as set by the pots, whether or not forced
 	var stepLoopMax, prevLoopMax int // maximum loop size setting
+	var rainbow rainbowEffect        // hue of -automode rainbow
+	var rainbowDuties map[byte]time.Duration
+	var chase chaseEffect            // position of -automode chase
+	var osc lfo                      // shared by the channels with an lfo
+	var frozenDuties []time.Duration // latched by a freeze; nil when not frozen
+	// With -sleep the loop runs on a ticker, so each update starts one
+	// period after the last however long the work took, and auto mode
+	// timing stays the same under load.
+	var tick <-chan time.Time
+	if sleepDuration > 0 {
+		ticker := time.NewTicker(sleepDuration)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	lastTick := time.Now()
+	// -maxrate caps the loop on its own ticker, after any -sleep tick; a
+	// loop slower than the cap finds a tick waiting and does not wait
+	var rateTick <-chan time.Time
+	if *maxRate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / *maxRate))
+		defer ticker.Stop()
+		rateTick = ticker.C
+	}
+	// loops counted since rateStart, for the achieved rate in /status
+	rateStart, rateLoops := time.Now(), 0
+	// the startup fade uses the scene easing, so both feel the same
+	fadeStart := time.Now()
+	fadeEase := conf.sceneEase
+loop:
 	for {
-		if sleepDuration > 0 {
-			time.Sleep(sleepDuration)
+		if tick != nil {
+			select {
+			case sig := <-stop:
+				slog.Info("turning off LEDs", "signal", sig)
+				break loop
+			case now := <-tick:
+				// the ticker drops the ticks of an iteration that overran
+				if n := (now.Sub(lastTick) + sleepDuration/2) / sleepDuration; n > 1 {
+					missedTicks.Add(float64(n - 1))
+					slog.Debug("loop overran", "missed_ticks", n-1)
+				}
+				lastTick = now
+			}
+		} else {
+			select {
+			case sig := <-stop:
+				slog.Info("turning off LEDs", "signal", sig)
+				break loop
+			default:
+			}
+		}
+		if rateTick != nil {
+			select {
+			case sig := <-stop:
+				slog.Info("turning off LEDs", "signal", sig)
+				break loop
+			case <-rateTick:
+			}
+		}
+		start := time.Now()
+		rateLoops++
+		if elapsed := start.Sub(rateStart); elapsed >= time.Second {
+			snap.LoopRate = float64(rateLoops) / elapsed.Seconds()
+			rateStart, rateLoops = start, 0
 		}
 
-		aoutMap = ReadAnalog(P9_37, P9_38, P9_39, P9_40)
-		autoMode, autoLoopStep = calcAutoMode(autoMode, autoLoopStep, aoutMap)
+		if size, ok := pendingWindow(); ok {
+			for _, led := range LEDMap {
+				led.smooth = resizeSmoother(led.smooth, size)
+			}
+			aux.resize(size)
+			slog.Info("resized smoothing window", "window", size)
+		}
+		if c, curve := pendingReload(); c != nil {
+			applyConfig(c, curve, LEDMap, minDuties, maxDuties)
+			checkPWMPeriod(conf, sleepDuration)
+			slog.Info("reloaded config", "path", *configPath)
+		}
+
+		if source != nil {
+			// keep the last levels until the source sends new ones
+			select {
+			case levels = <-source.frames():
+				lastFrame = time.Now()
+				if silent {
+					slog.Info("control source is back", "source", source.name())
+					silent = false
+				}
+			default:
+			}
+		}
+		if levels != nil {
+			aoutMap = levels
+			// the pots always have a reading, so only a source can go silent
+			if watchdogTimeout > 0 && time.Since(lastFrame) > watchdogTimeout {
+				if !silent {
+					slog.Warn("control source went silent, fading out", "source", source.name(), "timeout", watchdogTimeout)
+					silent = true
+				}
+				aoutMap = fadeLevels(levels, time.Since(lastFrame)-watchdogTimeout)
+			}
+			autoMode = false
+		} else {
+			aoutMap, err = readPots(adc, pins)
+			aux.take(aoutMap)
+			for step, aout := range aoutMap {
+				if conf.clipped(aout) {
+					LEDMap[step].clipped++
+				}
+			}
+			// before any missing step is filled in from the last loop,
+			// which is already calibrated
+			calibrateReadings(aoutMap)
+			var underRead *UnderReadError
+			if errors.As(err, &underRead) {
+				// hold the previous reading of a pot that did not convert
+				// rather than dropping its LED to zero
+				for _, step := range underRead.Missing {
+					// aux pots hold their own last reading
+					if int(step) < ledCount {
+						aoutMap[step] = snap.Channels[step].Aout
+					}
+				}
+				underReads.Inc()
+				slog.Debug("ADC under-read", "missing", underRead.Missing)
+				err = nil
+			}
+			if err != nil {
+				// not fatal, so the deferred cleanup turns the LEDs off
+				slog.Error("could not read ADC", "err", err)
+				break loop
+			}
+			// the gesture is tracked while auto mode is forced over HTTP, so
+			// releasing it goes back to whatever the pots say
+			gestureAuto, gestureStep := gesture.update(aoutMap)
+			if forced, enabled, step := forcedAutoMode(); forced {
+				autoMode, autoLoopStep = enabled, step
+			} else {
+				autoMode, autoLoopStep = gestureAuto, gestureStep
+			}
+		}
+		// a playing scene suspends the pots, auto mode and any control source
+		snap.Scene = sceneDuties(sceneBuf)
+		snap.AutoMode = autoMode && snap.Scene == ""
+		snap.Frozen = frozen()
+		switch {
+		case snap.Frozen:
+			snap.Source = "frozen"
+		case snap.Scene != "":
+			snap.Source = "scene"
+		case levels != nil:
+			snap.Source = source.name()
+		case snap.AutoMode:
+			snap.Source = "auto"
+		default:
+			snap.Source = "pots"
+		}
+		applyDisabled(LEDMap, written)
+		overridden := currentOverrides()
+		emergencyOn, emergencyAll := emergencyLights()
+		snap.Emergency = emergencyOn
+		applyStrobes(LEDMap, emergencyOn)
+		if snap.AutoMode && *autoEffect == autoRainbow {
+			// from last loop's smoothed readings, before they are replaced
+			rainbowDuties = rainbow.duties(time.Now(), stepLoopMax, snap.Channels, autoLoopStep)
+		} else {
+			rainbow.pause()
+		}
+		if snap.AutoMode && *autoEffect == autoChase {
+			chase.advance(time.Now(), stepLoopMax, ledCount-1)
+		} else {
+			chase.pause()
+		}
+		snap.LFOHz = 0
+		if conf.usesLFO() {
+			snap.LFOHz = lfoRate(aux)
+			osc.advance(time.Now(), snap.LFOHz)
+		}
+		// recorded duties already went through everything up to the limits
+		replayed := levels != nil && replaying(source)
 		for step, aout := range aoutMap {
 			led = LEDMap[step]
-			medAout = calcMedian(led.win, aout)
-			led.win = led.win.Next()
+			if levels != nil {
+				// the source does its own smoothing, if any
+				medAout = float64(aout)
+			} else {
+				medAout = led.hold(led.smooth.Smooth(aout))
+			}
+			snap.Channels[step] = channelStatus{Step: step, Aout: aout, Median: medAout}
 
-			if autoMode {
+			if _, ok := overridden[step]; ok {
+				if debugLog {
+					dbg[step] = []slog.Attr{slog.String("mode", "override")}
+				}
+				inputs[step] = channelInput{direct: true}
+				continue
+			}
+
+			if led.restored {
+				// the pot, auto mode or a control source take over once
+				// the input moves
+				if led.restoredAout < 0 {
+					led.restoredAout = medAout
+				}
+				if levels != nil || snap.AutoMode || math.Abs(medAout-led.restoredAout) > restoreDeadband {
+					led.restored = false
+				}
+			}
+
+			if snap.Scene != "" {
+				if debugLog {
+					dbg[step] = []slog.Attr{slog.String("mode", "scene")}
+				}
+				inputs[step] = channelInput{duty: sceneBuf[step], direct: true}
+				continue
+			}
+
+			if replayed {
+				if debugLog {
+					dbg[step] = []slog.Attr{slog.String("mode", "replay")}
+				}
+				snap.Channels[step] = channelStatus{Step: step}
+				inputs[step] = channelInput{duty: time.Duration(aout), direct: true}
+				continue
+			}
+
+			if led.restored {
+				if debugLog {
+					dbg[step] = []slog.Attr{slog.String("mode", "resumed"), slog.Int("aout", aout)}
+				}
+				inputs[step] = channelInput{duty: led.restoredDuty, direct: true}
+				continue
+			}
+
+			if snap.AutoMode {
 				// One LED is off and its pot used to control overall rate of
 				// color intensity change
 				if step == autoLoopStep {
-					stepLoopMax = calcStepLoopMax(medAout)
+					speed := medAout
+					if aout, ok := aux.value(auxSpeed); ok {
+						speed = aout
+					}
+					stepLoopMax = calcStepLoopMax(speed)
 					// If user changes loop, then LEDs need to recalculate theirs.
 					if stepLoopMax != prevLoopMax {
 						for _, led := range LEDMap {
@@ -441,14 +1425,39 @@ func main() {
 						}
 						prevLoopMax = stepLoopMax
 					}
-					if *debug {
-						msgs[step] = fmt.Sprintf("STEP %d:  median aout %6.1f  loop max %4d", step, medAout, stepLoopMax)
+					if debugLog {
+						dbg[step] = []slog.Attr{slog.String("mode", "speed"), slog.Float64("median", medAout), slog.Int("loop_max", stepLoopMax)}
+					}
+					if *autoEffect != autoRainbow {
+						inputs[step] = channelInput{direct: true} // off
+						continue
+					}
+				}
+
+				if *autoEffect == autoRainbow {
+					// uncolored LEDs are left dark
+					if debugLog && step != autoLoopStep {
+						dbg[step] = []slog.Attr{slog.String("mode", "rainbow"), slog.Float64("hue", rainbow.hue)}
+					}
+					inputs[step] = channelInput{duty: rainbowDuties[step], direct: true}
+					continue
+				}
+
+				if *autoEffect == autoChase {
+					// each pot sets its own LED's brightness when lit
+					lit := chase.lit(step, autoLoopStep, ledCount)
+					if debugLog {
+						dbg[step] = []slog.Attr{slog.String("mode", "chase"), slog.Float64("pos", chase.pos), slog.Bool("lit", lit)}
+					}
+					inputs[step] = channelInput{direct: true}
+					if lit {
+						inputs[step] = channelInput{aout: medAout}
 					}
 					continue
 				}
 
-				// Color intensity of other three LEDs is ranging up and down
-				if medAout > aoutOff {
+				// Color intensity of the other LEDs is ranging up and down
+				if medAout > float64(conf.AoutOff) {
 					led.autoAdjust(int(medAout), stepLoopMax)
 					autoAout = medAout + float64(led.autoOffset)
 					// avoid getting stuck in negative values
@@ -458,19 +1467,141 @@ func main() {
 				} else {
 					autoAout = 0
 				}
-				if *debug {
-					msgs[step] = fmt.Sprintf("STEP %d:  loop max %4d   median aout %6.1f   auto aout %6.1f", step, led.autoLoopMax, medAout, autoAout)
+				if debugLog {
+					dbg[step] = []slog.Attr{slog.String("mode", "auto"), slog.Int("loop_max", led.autoLoopMax), slog.Float64("median", medAout), slog.Float64("auto_aout", autoAout)}
+				}
+				inputs[step] = channelInput{aout: autoAout}
+			} else if led.breathe {
+				// wall clock time, so the breath is smooth at any loop rate
+				level := breatheLevel(time.Since(breatheStart), conf.BreathePeriod.Duration, conf.Channels[step].BreathePhase)
+				if debugLog {
+					dbg[step] = []slog.Attr{slog.String("mode", "breathe"), slog.Int("aout", aout), slog.Float64("median", medAout), slog.Float64("level", level)}
+				}
+				inputs[step] = channelInput{aout: medAout * level}
+			} else if ch := conf.Channels[step]; ch.LFO != "" {
+				level := osc.level(ch.LFO, ch.LFODepth, ch.LFOPhase)
+				if debugLog {
+					dbg[step] = []slog.Attr{slog.String("mode", "lfo"), slog.Int("aout", aout), slog.Float64("median", medAout), slog.Float64("level", level)}
 				}
-				setDuty(led.pwm, autoAout, step, &duties, &msgs)
+				inputs[step] = channelInput{aout: medAout * level}
 			} else {
-				if *debug {
-					msgs[step] = fmt.Sprintf("STEP %d:  aout %4d   median aout %6.1f", step, aout, medAout)
+				if debugLog {
+					dbg[step] = []slog.Attr{slog.String("mode", "pot"), slog.Int("aout", aout), slog.Float64("median", medAout)}
 				}
-				setDuty(led.pwm, medAout, step, &duties, &msgs)
+				inputs[step] = channelInput{aout: medAout}
 			}
 		}
-		if *debug {
-			fmt.Println(strings.Join(msgs, "     "))
+
+		pipe := dutyInputs{
+			overrides: overridden,
+			disabled:  disabled,
+			ambient:   1,
+			fade:      1,
+			recorded:  replayed,
+			minDuties: minDuties,
+			maxDuties: maxDuties,
+			limit:     conf.maxTotalDuty(),
+		}
+		if sensor != nil && !replayed {
+			snap.Ambient = sensor.scale()
+			pipe.ambient = snap.Ambient
+		}
+		if fadeIn > 0 && !replayed {
+			if progress := float64(time.Since(fadeStart)) / float64(fadeIn); progress < 1 {
+				pipe.fade = fadeEase(progress)
+			} else {
+				fadeIn = 0 // done
+			}
+		}
+		snap.Master = aux.master()
+		pipe.master = snap.Master
+		snap.OutputMin, snap.OutputMax = conf.outputRange()
+		for step, led := range LEDMap {
+			disabled[step] = led.disabled
+		}
+		if thermal != nil {
+			snap.Temperature, snap.Throttle = thermal.scale()
+			pipe.limit = time.Duration(float64(pipe.limit) * snap.Throttle)
+		}
+		// all raw duties are known; normalize them together and apply
+		conf.pipelineDuties(brightness, inputs, &pipe, func(duties []time.Duration) {
+			if frozenDuties = freezeDuties(snap.Frozen, frozenDuties, applied); frozenDuties != nil {
+				copy(duties, frozenDuties)
+			}
+			if emergencyOn {
+				// straight to the limits, past everything above
+				emergencyDuties(duties, maxDuties, emergencyAll)
+			}
+			for step, led := range LEDMap {
+				if led.disabled {
+					// off whatever set it above, emergency lights included
+					led.slewed = 0
+					continue
+				}
+				if emergencyOn {
+					led.slewed = duties[step] // and from there once it ends
+					continue
+				}
+				duties[step] = led.slewTo(duties[step])
+			}
+		}, duties, applied)
+		if saver.after == 0 || saver.update(time.Now(), LEDMap, applied, written) {
+			setDuties(LEDMap, applied, written)
+		}
+		for step := range snap.Channels {
+			snap.Channels[step].Duty = applied[step]
+			led := LEDMap[byte(step)]
+			snap.Channels[step].Polarity = conf.Channels[step].polarity()
+			snap.Channels[step].Invert = led.invert
+			snap.Channels[step].Trim = led.trim
+			snap.Channels[step].Name = led.name
+			snap.Channels[step].Disabled = led.disabled
+			snap.Channels[step].Clipped = led.clipped
+			snap.Channels[step].AutoOffset = led.autoOffset
+			snap.Channels[step].AutoOffsetMax = led.autoOffsetMax
+			snap.Channels[step].AutoLoopMax = led.autoLoopMax
+			if led.strobe != nil {
+				snap.Channels[step].StrobeHz = led.strobe.hz
+			}
+		}
+		snap.Aux = aux.levels()
+		snap.Auto = autoParams{
+			LoopMax:      conf.AutoLoopMax,
+			OffsetMax:    conf.AutoOffsetMax,
+			OffsetDelta:  conf.AutoOffsetDelta,
+			LoopAdjust:   conf.AutoLoopAdjust,
+			OffsetAdjust: conf.AutoOffsetAdjust,
+		}
+		if *autoEffect == autoDark {
+			snap.Auto.Skew = conf.AutoSkew
+		}
+		publishStatus(&snap)
+		heartbeat(time.Now())
+		recordHistory(snap.Channels)
+		if rec != nil {
+			rec.record(start, snap.Channels)
+		}
+		loopSeconds.Observe(time.Since(start).Seconds())
+		if *statePath != "" && time.Since(lastSave) >= stateInterval {
+			if err := saveState(*statePath, LEDMap, applied); err != nil {
+				slog.Warn("could not save state", "path", *statePath, "err", err)
+			}
+			lastSave = time.Now()
+		}
+		if debugLog {
+			// one record per loop, with a group of fields per channel
+			attrs := make([]slog.Attr, len(dbg))
+			for step := range dbg {
+				fields := append(dbg[step], slog.Duration("duty", applied[step]))
+				attrs[step] = slog.Attr{Key: LEDMap[byte(step)].name, Value: slog.GroupValue(fields...)}
+			}
+			slog.LogAttrs(context.Background(), slog.LevelDebug, "loop", attrs...)
+		}
+	}
+
+	if *statePath != "" {
+		if err := saveState(*statePath, LEDMap, applied); err != nil {
+			slog.Warn("could not save state", "path", *statePath, "err", err)
 		}
 	}
 }
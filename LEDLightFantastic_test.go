@@ -0,0 +1,433 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// useConfig makes c the config in use for the rest of the test.
+func useConfig(t testing.TB, c *Config) {
+	t.Helper()
+	prev := conf
+	conf = c
+	t.Cleanup(func() { conf = prev })
+}
+
+// useAutoEffect sets -automode for the rest of the test.
+func useAutoEffect(t *testing.T, effect string) {
+	t.Helper()
+	prev := *autoEffect
+	*autoEffect = effect
+	t.Cleanup(func() { *autoEffect = prev })
+}
+
+// TestAutoAdjustBounds walks seeded LEDs through auto mode and checks the
+// offset never strays more than one step past the bounds of the walk and
+// turns back at both of them. The offset max is not re-drawn, so the
+// bounds hold still.
+func TestAutoAdjustBounds(t *testing.T) {
+	for _, effect := range []string{autoRandom, autoDark} {
+		for _, aout := range []int{2048, 200, 3900} {
+			for seed := int64(1); seed <= 5; seed++ {
+				t.Run(fmt.Sprintf("%s/aout%d/seed%d", effect, aout, seed), func(t *testing.T) {
+					useConfig(t, defaultConfig())
+					useAutoEffect(t, effect)
+					rnd := rand.New(rand.NewSource(seed))
+					led := &LED{
+						rnd:              rnd,
+						autoLoopMax:      1,
+						autoOffsetDelta:  randomAutoOffsetDelta(rnd),
+						autoOffsetMax:    randomAutoOffsetMax(rnd, conf.AutoOffsetMax),
+						lastLoopAdjust:   time.Now(),
+						lastOffsetAdjust: time.Now(),
+					}
+					lo, hi := led.autoBounds()
+					// the pot's thresholds turn the walk back first
+					if off := conf.AoutOff - aout; off > lo {
+						lo = off
+					}
+					if on := conf.AoutOn - aout; on < hi {
+						hi = on
+					}
+					delta := conf.AutoOffsetDelta
+					var turnedUp, turnedDown int
+					for i := 0; i < 20000; i++ {
+						before := led.autoOffsetDelta
+						led.autoAdjust(aout, conf.AutoLoopMax)
+						if led.autoOffset < lo-delta || led.autoOffset > hi+delta {
+							t.Fatalf("loop %d: offset %d outside %d to %d", i, led.autoOffset, lo, hi)
+						}
+						switch {
+						case before < 0 && led.autoOffsetDelta > 0:
+							if led.autoOffset > lo {
+								t.Fatalf("loop %d: turned up at %d, above the bound %d", i, led.autoOffset, lo)
+							}
+							turnedUp++
+						case before > 0 && led.autoOffsetDelta < 0:
+							if led.autoOffset < hi {
+								t.Fatalf("loop %d: turned down at %d, below the bound %d", i, led.autoOffset, hi)
+							}
+							turnedDown++
+						}
+					}
+					if turnedUp < 2 || turnedDown < 2 {
+						t.Fatalf("turned up %d and down %d times; want both limits reached", turnedUp, turnedDown)
+					}
+				})
+			}
+		}
+	}
+}
+
+// TestAutoAdjustRedraw re-draws the offset max at every turn and checks
+// that an LED left outside the new bounds heads back inside them.
+func TestAutoAdjustRedraw(t *testing.T) {
+	for _, effect := range []string{autoRandom, autoDark} {
+		for seed := int64(1); seed <= 5; seed++ {
+			t.Run(fmt.Sprintf("%s/seed%d", effect, seed), func(t *testing.T) {
+				c := defaultConfig()
+				c.AutoOffsetAdjust = duration{0}
+				useConfig(t, c)
+				useAutoEffect(t, effect)
+				rnd := rand.New(rand.NewSource(seed))
+				led := &LED{
+					rnd:             rnd,
+					autoLoopMax:     1,
+					autoOffsetDelta: randomAutoOffsetDelta(rnd),
+					autoOffsetMax:   randomAutoOffsetMax(rnd, conf.AutoOffsetMax),
+					lastLoopAdjust:  time.Now(),
+				}
+				delta := conf.AutoOffsetDelta
+				for i := 0; i < 20000; i++ {
+					led.autoAdjust(2048, conf.AutoLoopMax)
+					lo, hi := led.autoBounds()
+					if (led.autoOffset > hi+delta && led.autoOffsetDelta > 0) || (led.autoOffset < lo-delta && led.autoOffsetDelta < 0) {
+						t.Fatalf("loop %d: offset %d heads %+d, away from %d to %d", i, led.autoOffset, led.autoOffsetDelta, lo, hi)
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestNormalizeExtreme gives normalize duties so long their sum overflows
+// an int64, and checks the total still comes out within the limit with no
+// duty negative. The limits go up to the 2^53ns a float64 holds exactly.
+// It also sits channels at their floors under limits too tight for them,
+// and checks the floors hold whenever they fit and the total stays within
+// the limit once rounded as setDuties does.
+func TestNormalizeExtreme(t *testing.T) {
+	useConfig(t, defaultConfig())
+	for _, n := range []int{2, 16, 128} {
+		for _, limit := range []time.Duration{pwmPeriod, time.Second, 1 << 53} {
+			for _, knee := range []float64{1, 0.8} {
+				raw := make([]time.Duration, n)
+				minDuties := make([]time.Duration, n)
+				maxDuties := make([]time.Duration, n)
+				applied := make([]time.Duration, n)
+				for i := range raw {
+					raw[i], maxDuties[i] = math.MaxInt64/2, math.MaxInt64
+				}
+				if !normalize(raw, minDuties, maxDuties, applied, limit, knee) {
+					t.Errorf("%d channels, limit %v, knee %v: not scaled", n, limit, knee)
+				}
+				var sum time.Duration
+				for i, d := range applied {
+					if d < 0 {
+						t.Fatalf("%d channels, limit %v, knee %v: step %d duty %v", n, limit, knee, i, d)
+					}
+					sum += d
+					if sum < 0 || sum > limit {
+						t.Fatalf("%d channels, limit %v, knee %v: total above the limit by step %d", n, limit, knee, i)
+					}
+				}
+			}
+		}
+	}
+
+	const floor = pwmPeriod / 50
+	floors := []struct {
+		name  string
+		raw   []time.Duration
+		limit time.Duration
+	}{
+		// a lit duty under its floor counts as the floor
+		{"at floors", []time.Duration{floor, floor, 1, floor}, 2 * floor},
+		{"just fit", []time.Duration{floor, 1, pwmPeriod, pwmPeriod}, 3*floor + floor/7},
+		{"exact fit", []time.Duration{floor, floor, pwmPeriod, 0}, 3 * floor},
+		{"one off", []time.Duration{floor, 0, floor, floor}, 2*floor + 3},
+	}
+	for _, tt := range floors {
+		for _, knee := range []float64{1, 0.8} {
+			n := len(tt.raw)
+			minDuties := make([]time.Duration, n)
+			maxDuties := make([]time.Duration, n)
+			applied := make([]time.Duration, n)
+			var lit time.Duration
+			for i, d := range tt.raw {
+				minDuties[i], maxDuties[i] = floor, pwmPeriod
+				if d > 0 {
+					lit += floor
+				}
+			}
+			if !normalize(tt.raw, minDuties, maxDuties, applied, tt.limit, knee) {
+				t.Errorf("%s, knee %v: not scaled", tt.name, knee)
+			}
+			var sum time.Duration
+			for i, d := range applied {
+				if d < 0 {
+					t.Fatalf("%s, knee %v: step %d duty %v", tt.name, knee, i, d)
+				}
+				if lit <= tt.limit && tt.raw[i] > 0 && d < floor {
+					t.Errorf("%s, knee %v: step %d duty %v below its floor %v", tt.name, knee, i, d, floor)
+				}
+				sum += roundDuty(d)
+			}
+			if sum > tt.limit {
+				t.Errorf("%s, knee %v: total %v above the limit %v", tt.name, knee, sum, tt.limit)
+			}
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	tests := []struct {
+		sum, limit, knee, want float64
+	}{
+		// proportional: a hard cut at the limit
+		{500, 1000, 1, 500},
+		{1000, 1000, 1, 1000},
+		{1500, 1000, 1, 1000},
+		// below and at the knee, untouched
+		{0, 1000, 0.8, 0},
+		{500, 1000, 0.8, 500},
+		{800, 1000, 0.8, 800},
+		// above it, squeezed toward the limit
+		{801, 1000, 0.8, 800.9975},
+		{900, 1000, 0.8, 878.6939},
+		{1000, 1000, 0.8, 926.4241},
+		{2000, 1000, 0.8, 999.5042},
+		{1600, 1000, 0.5, 944.5984},
+	}
+	for _, tt := range tests {
+		if got := compress(tt.sum, tt.limit, tt.knee); math.Abs(got-tt.want) > 1e-3 {
+			t.Errorf("compress(%v, %v, %v) = %v, want %v", tt.sum, tt.limit, tt.knee, got, tt.want)
+		}
+	}
+}
+
+// TestCompressCurve sweeps compress across the knee and checks it is
+// continuous there, with a slope of 1 on both sides, and never falls as
+// the sum rises, nor goes past the limit.
+func TestCompressCurve(t *testing.T) {
+	const limit = 1000.0
+	for _, knee := range []float64{0.5, 0.8, 0.95} {
+		threshold := knee * limit
+		const h = 1e-3
+		below := compress(threshold-h, limit, knee)
+		above := compress(threshold+h, limit, knee)
+		if math.Abs(above-below-2*h) > 1e-6 {
+			t.Errorf("knee %v: %v at -h, %v at +h, not continuous with slope 1", knee, below, above)
+		}
+		prev := compress(0, limit, knee)
+		for sum := 1.0; sum <= 5*limit; sum++ {
+			got := compress(sum, limit, knee)
+			if got < prev {
+				t.Fatalf("knee %v: compress(%v) = %v, below compress(%v) = %v", knee, sum, got, sum-1, prev)
+			}
+			if got > limit || got > sum {
+				t.Fatalf("knee %v: compress(%v) = %v, above the sum or the limit", knee, sum, got)
+			}
+			prev = got
+		}
+	}
+}
+
+// TestCalcStepLoopMax checks the speed pot's readings either side of
+// each max_aout, a boundary belonging to the faster speed above it, and
+// past both ends of the scale.
+func TestCalcStepLoopMax(t *testing.T) {
+	useConfig(t, defaultConfig())
+	tests := []struct {
+		aout float64
+		want int
+	}{
+		{-1, 1024},
+		{0, 1024},
+		{19.999, 1024},
+		{20, 512},
+		{59.5, 512},
+		{60, 256},
+		{129.99, 256},
+		{130, 128},
+		{1999.5, 8},
+		{2000, 4},
+		{4089.999, 2},
+		{4090, 1},
+		{ainLevels - 1, 1},
+		{ainLevels, 1},
+		{1e6, 1},
+	}
+	for _, tt := range tests {
+		if got := calcStepLoopMax(tt.aout); got != tt.want {
+			t.Errorf("calcStepLoopMax(%v) = %d, want %d", tt.aout, got, tt.want)
+		}
+	}
+
+	// turning the pot up never slows auto mode down
+	prev := calcStepLoopMax(0)
+	for aout := 0.0; aout < ainLevels; aout += 0.25 {
+		got := calcStepLoopMax(aout)
+		if got > prev {
+			t.Fatalf("loop max %d at %v, up from %d", got, aout, prev)
+		}
+		prev = got
+	}
+}
+
+func TestCalcStepLoopMaxOneSpeed(t *testing.T) {
+	c := defaultConfig()
+	c.LoopSpeeds = []loopSpeed{{1000, 50}}
+	useConfig(t, c)
+	for _, aout := range []float64{0, 999.9, 1000, ainLevels - 1} {
+		if got := calcStepLoopMax(aout); got != 50 {
+			t.Errorf("calcStepLoopMax(%v) = %d, want 50", aout, got)
+		}
+	}
+}
+
+// TestAutoGesture walks the pots through the auto mode gesture with
+// aout_exit above aout_off, and checks auto mode only switches once a
+// reading has held for gesture_loops loops, and that pots between
+// aout_exit and aout_on, or flickering across aout_exit, leave it be.
+func TestAutoGesture(t *testing.T) {
+	c := defaultConfig()
+	c.AoutOff, c.AoutOn, c.AoutExit = 10, 4000, 200
+	c.GestureLoops = 3
+	useConfig(t, c)
+
+	pots := func(aouts ...int) map[byte]int {
+		m := make(map[byte]int, len(aouts))
+		for step, aout := range aouts {
+			m[byte(step)] = aout
+		}
+		return m
+	}
+	steps := []struct {
+		name   string
+		aouts  map[byte]int
+		loops  int
+		wantOn bool
+	}{
+		{"all mid", pots(2000, 2000, 2000, 2000), 5, false},
+		{"gesture, not yet held", pots(4050, 4050, 5, 4050), 2, false},
+		{"gesture held", pots(4050, 4050, 5, 4050), 1, true},
+		{"below aout_exit, not yet held", pots(150, 150, 150, 150), 2, true},
+		{"back up", pots(2000, 2000, 2000, 2000), 5, true},
+		{"between aout_exit and aout_on", pots(250, 250, 250, 250), 5, true},
+		{"flicker down", pots(190, 190, 190, 190), 2, true},
+		{"flicker up", pots(210, 190, 190, 190), 1, true},
+		{"flicker down again", pots(190, 190, 190, 190), 2, true},
+		// exits with every pot still above aout_off
+		{"below aout_exit held", pots(190, 190, 190, 190), 1, false},
+		// the off pot alone is not the gesture
+		{"one pot off", pots(2000, 2000, 5, 2000), 5, false},
+	}
+	var g autoGesture
+	for _, s := range steps {
+		var on bool
+		var step byte
+		for i := 0; i < s.loops; i++ {
+			on, step = g.update(s.aouts)
+		}
+		if on != s.wantOn {
+			t.Fatalf("%s: auto mode %v, want %v", s.name, on, s.wantOn)
+		}
+		if on && step != 2 {
+			t.Errorf("%s: speed pot %d, want 2", s.name, step)
+		}
+	}
+}
+
+// TestSlewTo yanks the duty from off to full and back and checks each
+// loop moves it by no more than the slew limit, and that it lands on the
+// target and stays there.
+func TestSlewTo(t *testing.T) {
+	for _, slew := range []time.Duration{pwmPeriod / 10, pwmPeriod / 7, 1, pwmPeriod} {
+		led := &LED{slew: slew}
+		prev := led.slewTo(0)
+		for _, target := range []time.Duration{pwmPeriod, 0, pwmPeriod / 3} {
+			distance := target - prev
+			if distance < 0 {
+				distance = -distance
+			}
+			loops := int((distance + slew - 1) / slew)
+			for i := 1; i <= loops+2; i++ {
+				got := led.slewTo(target)
+				change := got - prev
+				if change < 0 {
+					change = -change
+				}
+				if change > slew {
+					t.Fatalf("slew %v: moved %v in a loop toward %v", slew, change, target)
+				}
+				if i >= loops && got != target {
+					t.Fatalf("slew %v: at %v after %d loops, want %v", slew, got, i, target)
+				}
+				prev = got
+			}
+		}
+	}
+
+	// no limit jumps straight there
+	led := &LED{}
+	if got := led.slewTo(pwmPeriod); got != pwmPeriod {
+		t.Errorf("without a slew limit moved to %v, want %v", got, pwmPeriod)
+	}
+}
+
+// blockingPWM stands in for a sysfs PWM line whose writes block.
+type blockingPWM struct{ write time.Duration }
+
+func (p blockingPWM) SetPWM(period, duty time.Duration) { time.Sleep(p.write) }
+func (p blockingPWM) SetPolarity(polarity bool)         {}
+func (p blockingPWM) DisablePWM()                       {}
+
+// benchmarkWrites writes a new duty to all seven lines each iteration.
+func benchmarkWrites(b *testing.B, write func(LEDMap map[byte]*LED, applied, written []time.Duration)) {
+	useConfig(b, defaultConfig())
+	const lines = 7
+	LEDMap := make(map[byte]*LED, lines)
+	for step := byte(0); step < lines; step++ {
+		LEDMap[step] = &LED{pwm: blockingPWM{50 * time.Microsecond}}
+	}
+	applied := make([]time.Duration, lines)
+	written := make([]time.Duration, lines)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for step := range applied {
+			applied[step] = time.Duration(i%2+1) * pwmPeriod / 4
+		}
+		write(LEDMap, applied, written)
+	}
+}
+
+func BenchmarkSetDuties(b *testing.B) {
+	benchmarkWrites(b, setDuties)
+}
+
+// BenchmarkSetDutiesSequential writes the lines one after another, for
+// comparison with setDuties' goroutine per line.
+func BenchmarkSetDutiesSequential(b *testing.B) {
+	benchmarkWrites(b, func(LEDMap map[byte]*LED, applied, written []time.Duration) {
+		for step, led := range LEDMap {
+			if applied[step] != written[step] {
+				led.setPWM(applied[step])
+				written[step] = applied[step]
+			}
+		}
+	})
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"os"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
@@ -14,7 +18,8 @@ import (
 // AM335x Memory Addresses
 const (
 	MMAP_OFFSET = 0x44C00000
-	MMAP_SIZE   = 0x481AEFFF - MMAP_OFFSET // 0x35AEFFF or 56,291,327
+	MMAP_END    = 0x481AF000             // first address past the mapped region
+	MMAP_SIZE   = MMAP_END - MMAP_OFFSET // 0x35AF000 or 56,291,328
 	// Clock Module Memory Registers
 	CM_WKUP                    = 0x44E00400
 	CM_WKUP_ADC_TSC_CLKCTRL    = CM_WKUP + 0xBC
@@ -24,6 +29,12 @@ const (
 
 	// Analog Digital Converter Memory Registers
 	ADC_TSC = 0x44E0D000
+	// Interrupt status. The raw register shows events whether or not the
+	// interrupt is enabled; writing a 1 to a bit of IRQSTATUS clears it.
+	ADC_IRQSTATUS_RAW   = ADC_TSC + 0x24
+	ADC_IRQSTATUS       = ADC_TSC + 0x28
+	IRQ_FIFO0_THRESHOLD = 0x01 << 2
+
 	// CTRL operator code; by default no hardware interrupts enabled
 	ADC_CTRL                         = ADC_TSC + 0x40
 	CTRL_ENABLE                      = 0x01
@@ -56,6 +67,11 @@ const (
 	ADCSTEPDELAY7  = ADC_TSC + 0x98
 	ADCSTEPCONFIG8 = ADC_TSC + 0x9C
 	ADCSTEPDELAY8  = ADC_TSC + 0xA0
+	ADC_STEP_SIZE  = ADCSTEPCONFIG2 - ADCSTEPCONFIG1 // config and delay registers per step
+
+	// ADCSTEPCONFIG mode bits 0-1
+	STEPCONFIG_MODE_SW_ONESHOT    = 0x00
+	STEPCONFIG_MODE_SW_CONTINUOUS = 0x01
 
 	// ADC built-in sample averaging
 	ADC_AVG_1       = 0x00 // no averaging
@@ -66,6 +82,15 @@ const (
 	ADC_OPENDELAY   = 0x00 // taken from Vegetable Avenger
 	ADC_SAMPLEDELAY = 0x01 // taken from Vegetable Avenger
 
+	// Each sample takes the sample delay plus one clock to sample, then 13
+	// clocks to convert, of the 24MHz ADC clock after CLKDIV. A step adds
+	// its open delay once, however many samples it averages.
+	ADC_CLOCK_HZ       = 24000000
+	ADC_CONVERT_CLOCKS = 13
+	// the settling delay found to work at the default divider and
+	// averaging; a computed delay is never shorter
+	ADC_SETTLE_MIN = 500 * time.Microsecond
+
 	// Each FIFO holds up to 128 analog output values in a circular array.
 	// The act of reading the FIFO data register moves the FIFO to the next
 	// entry. We cannot use the Go slice of bytes to read the FIFO
@@ -74,25 +99,134 @@ const (
 	ADC_FIFO0THRESHOLD  = ADC_TSC + 0xE8
 	ADC_FIFO0DATA       = ADC_TSC + 0x100
 	ADC_FIFO_COUNT_MASK = 0x7F
+	ADC_FIFO_DEPTH      = 128
+	ADC_THRESHOLD_WAIT  = 10 * time.Millisecond  // give up waiting on the threshold
+	ADC_UNDERREAD_WAIT  = 2 * time.Millisecond   // extra time allowed for slow steps
+	ADC_READ_TIMEOUT    = 100 * time.Millisecond // default limit on emptying the FIFO
+	ADC_CLOCK_WAIT      = 100 * time.Millisecond // give up waiting on the ADC clock
 	ADC_FIFO_STEP_MASK  = 0xF0000
 	ADC_FIFO_MASK       = 0xFFF
 )
 
+var (
+	ErrNotMapped     = errors.New("must initialize memory mapping")
+	ErrNotContinuous = errors.New("must initialize ADC in continuous mode")
+	ErrNoPins        = errors.New("must read at least one pin")
+	ErrADCTimeout    = errors.New("ADC read timed out; the converter may be stuck")
+	ErrADCClock      = errors.New("ADC clock did not come up; is the ADC overlay loaded?")
+)
+
+// UnderReadError reports ADC steps that produced no sample in time.
+// ReadAnalog still returns the values of the steps that did convert.
+type UnderReadError struct {
+	Missing []byte // step IDs
+}
+
+func (e *UnderReadError) Error() string {
+	return fmt.Sprintf("no ADC sample for steps %v", e.Missing)
+}
+
 type Pin struct {
 	name    string // readable name of pin
 	bank_id byte   // pin number within each bank, should be 0-31
 	eeprom  byte   // position in eeprom
 }
 
+// reg returns the index of a 32-bit register in the mapped region. An
+// address outside the region is a mistake in the register map, so it panics
+// naming the address rather than touching memory it should not.
+func reg(addr uint32) int {
+	if addr < MMAP_OFFSET || addr > MMAP_END-4 {
+		panic(fmt.Sprintf("register %#x is outside the mapped region %#x-%#x", addr, MMAP_OFFSET, MMAP_END))
+	}
+	return int(addr - MMAP_OFFSET)
+}
+
+// checkRegisters runs every register the ADC code uses through reg, so a bad
+// address stops the program at startup instead of in the middle of a read.
+func checkRegisters() {
+	for _, addr := range []uint32{
+		CM_WKUP_ADC_TSC_CLKCTRL, ADC_IRQSTATUS_RAW, ADC_IRQSTATUS, ADC_CTRL,
+		ADC_ADCRANGE, ADC_CLKDIV, ADC_STEPENABLE,
+		ADCSTEPCONFIG1, ADCSTEPDELAY1 + ADC_STEP_SIZE*uint32(len(ainPins)-1),
+		ADC_FIFO0COUNT, ADC_FIFO0THRESHOLD, ADC_FIFO0DATA,
+	} {
+		reg(addr)
+	}
+}
+
 type mappedRegisters struct {
 	file     *os.File
 	register []byte
 	fifo     *uint32
+	fifo0    fifoRegisters
+}
+
+// fifoRegisters are FIFO0's count and data registers, its threshold flag
+// and the step enables that fill it, which the converter changes under
+// the reader: reading the data register moves the FIFO on to the next
+// entry, and a one-shot step clears its own enable once it has run. On
+// the BeagleBone they are mappedFIFO; tests put a mockFIFO in their place.
+type fifoRegisters interface {
+	count() byte
+	pop() uint32
+	thresholdReached() bool
+	clearThreshold()
+	// bits are STEPENABLE's, step n at bit n+1
+	enableSteps(bits byte)
+	disableSteps(bits byte)
+}
+
+// mappedFIFO reads FIFO0 through the memory map.
+type mappedFIFO struct {
+	m *mappedRegisters
+}
+
+func (f mappedFIFO) count() byte {
+	return f.m.register[reg(ADC_FIFO0COUNT)] & ADC_FIFO_COUNT_MASK
+}
+
+// pop reads the 32-bit data register in one read. An atomic load cannot
+// be optimized away like an unused plain one.
+func (f mappedFIFO) pop() uint32 {
+	return atomic.LoadUint32(f.m.fifo)
+}
+
+func (f mappedFIFO) thresholdReached() bool {
+	return f.m.register[reg(ADC_IRQSTATUS_RAW)]&IRQ_FIFO0_THRESHOLD != 0
+}
+
+func (f mappedFIFO) clearThreshold() {
+	f.m.register[reg(ADC_IRQSTATUS)] = IRQ_FIFO0_THRESHOLD
+}
+
+func (f mappedFIFO) enableSteps(bits byte) {
+	f.m.register[reg(ADC_STEPENABLE)] |= bits
+	// enable the ADC
+	f.m.register[reg(ADC_CTRL)] |= CTRL_ENABLE
+}
+
+func (f mappedFIFO) disableSteps(bits byte) {
+	f.m.register[reg(ADC_STEPENABLE)] &^= bits
+	// disable the ADC
+	f.m.register[reg(ADC_CTRL)] &^= CTRL_ENABLE
 }
 
 var (
 	isMapped bool = false
 	mapped   *mappedRegisters
+	// number of FIFO samples ReadAnalog waits for; 0 polls the FIFO count
+	fifoThreshold int
+	// latest value of each step seen by DrainFIFO
+	continuousAout map[byte]int
+	// steps converting in continuous mode
+	continuousSteps stepSet
+	// how long ReadAnalog gives the steps to convert before reading the
+	// FIFO, and an in-flight conversion to land before discarding it
+	settleDelay = ADC_SETTLE_MIN
+	// how long emptying the FIFO may take, so a stuck converter that
+	// never lets it empty cannot wedge the caller
+	readTimeout = ADC_READ_TIMEOUT
 
 	P9_33 = Pin{"AIN4", 4, 71}
 	P9_35 = Pin{"AIN6", 6, 73}
@@ -101,18 +235,69 @@ var (
 	P9_38 = Pin{"AIN3", 3, 70}
 	P9_39 = Pin{"AIN0", 0, 67}
 	P9_40 = Pin{"AIN1", 1, 68}
+
+	// analog pins in AIN order; ADC step i reads ainPins[i]
+	ainPins = []Pin{P9_39, P9_40, P9_37, P9_38, P9_33, P9_36, P9_35}
 )
 
+// analogHeaderPins names the analog pins by header position, for -pins
+var analogHeaderPins = map[string]Pin{
+	"P9_33": P9_33,
+	"P9_35": P9_35,
+	"P9_36": P9_36,
+	"P9_37": P9_37,
+	"P9_38": P9_38,
+	"P9_39": P9_39,
+	"P9_40": P9_40,
+}
+
+// parsePins turns a comma separated list of header names like
+// "P9_39,P9_40" into pins, in the order given. A pin that is not one of the
+// seven analog inputs, or that is listed twice, is an error.
+func parsePins(list string) ([]Pin, error) {
+	var pins []Pin
+	seen := make(map[byte]string)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		pin, ok := analogHeaderPins[name]
+		if !ok {
+			return nil, fmt.Errorf("%q is not an analog input pin; use P9_33, P9_35, P9_36, P9_37, P9_38, P9_39 or P9_40", name)
+		}
+		if prev, ok := seen[pin.bank_id]; ok {
+			return nil, fmt.Errorf("pin %s is listed twice (%s)", name, prev)
+		}
+		seen[pin.bank_id] = name
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// stepCount is the number of ADC steps to program so every pin converts:
+// step i always reads AIN i, so it is one past the highest AIN in use.
+func stepCount(pins []Pin) int {
+	n := 0
+	for _, pin := range pins {
+		if int(pin.bank_id) >= n {
+			n = int(pin.bank_id) + 1
+		}
+	}
+	return n
+}
+
 func mmapInit() error {
 	var err error
 	if isMapped {
 		return nil
 	}
 
+	checkRegisters()
 	mapped = new(mappedRegisters)
 
 	//Now MemoryMap
 	mapped.file, err = os.OpenFile("/dev/mem", os.O_RDWR, 0666)
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("must run as root or with CAP_SYS_RAWIO to access /dev/mem: %w", err)
+	}
 	if err != nil {
 		return err
 	}
@@ -132,146 +317,574 @@ func mmapInit() error {
 	// b := *(*[]byte)(unsafe.Pointer(&sl))
 	mapped.register, err = syscall.Mmap(int(mapped.file.Fd()), MMAP_OFFSET, MMAP_SIZE, syscall.PROT_WRITE|syscall.PROT_READ, syscall.MAP_SHARED)
 	if err != nil {
+		mapped.file.Close()
+		// the file opened, so a refusal here comes from the kernel
+		// restricting /dev/mem rather than from our privileges
+		if errors.Is(err, syscall.EPERM) {
+			return fmt.Errorf("kernel refused to map the ADC registers through /dev/mem; it is restricted by CONFIG_STRICT_DEVMEM or lockdown, boot with iomem=relaxed to allow it: %w", err)
+		}
 		return err
 	}
 
 	// The downside to Go memory mapping is that we can access memory only one byte at a time.
 	// This is fatal to access the FIFO register. The FIFO register uses internal
 	// magic to detect a read and move to the next value so we must read all 32 bits at once.
-	mapped.fifo = (*uint32)(unsafe.Pointer(&mapped.register[ADC_FIFO0DATA-MMAP_OFFSET]))
+	mapped.fifo = (*uint32)(unsafe.Pointer(&mapped.register[reg(ADC_FIFO0DATA)]))
+	mapped.fifo0 = mappedFIFO{mapped}
 
 	isMapped = true
 	return nil
 }
 
-func ADCInit(clockDivider, sampleAvg byte) {
+// ADCInit configures one ADC step for each of the first steps analog pins.
+// Each call to ReadAnalog then runs the steps once.
+func ADCInit(clockDivider, sampleAvg byte, steps int) error {
+	return adcInit(clockDivider, sampleAvg, steps, STEPCONFIG_MODE_SW_ONESHOT)
+}
+
+// ADCInitContinuous configures the steps like ADCInit but in continuous
+// mode and starts the converter, which then cycles through the steps on its
+// own until ADCDisable. Read the results with DrainFIFO.
+//
+// This saves ReadAnalog's start, sleep and stop on every read, so the loop
+// can run faster, at the cost of keeping the converter running all the
+// time. The FIFO only holds 128 samples and stops taking new ones when
+// full, so a slow loop sees older readings than it would in one-shot mode.
+func ADCInitContinuous(clockDivider, sampleAvg byte, steps int) error {
+	if err := adcInit(clockDivider, sampleAvg, steps, STEPCONFIG_MODE_SW_CONTINUOUS); err != nil {
+		return err
+	}
+	continuousAout = make(map[byte]int, steps)
+	continuousSteps = pinSteps(ainPins[:steps])
+	enableStepSequencer(ainPins[:steps])
+	return nil
+}
+
+func adcInit(clockDivider, sampleAvg byte, steps int, mode byte) error {
+	if steps < 1 || steps > len(ainPins) {
+		return fmt.Errorf("illegal number of ADC steps %d: must be 1 to %d", steps, len(ainPins))
+	}
 	if err := mmapInit(); err != nil {
-		log.Fatalf("unable to initialize memory map: %s", err)
+		return fmt.Errorf("unable to initialize memory map: %s", err)
 	}
 
 	mr := mapped.register
 
 	// enable the ADC clock by setting bit 1 high
-	mr[CM_WKUP_ADC_TSC_CLKCTRL-MMAP_OFFSET] |= CM_WKUP_MODULEMODE_ENABLE
-	// wait for the enable to complete
-	for (mr[CM_WKUP_ADC_TSC_CLKCTRL-MMAP_OFFSET] & CM_WKUP_MODULEMODE_ENABLE) == 0 {
-		// waiting for adc clock module to initialize
+	mr[reg(CM_WKUP_ADC_TSC_CLKCTRL)] |= CM_WKUP_MODULEMODE_ENABLE
+	if err := waitADCClock(mr); err != nil {
+		return err
 	}
 
 	// CTRL (40h):
 	// pre-disable the ADC module; store Step ID in FIFO with data;
-	mr[ADC_CTRL-MMAP_OFFSET] = CTRL_DISABLE | CTRL_STEP_ID_TAG | ADC_STEPCONFIG_WRITE_PROTECT_OFF
+	mr[reg(ADC_CTRL)] = CTRL_DISABLE | CTRL_STEP_ID_TAG | ADC_STEPCONFIG_WRITE_PROTECT_OFF
 	// step down the ADC clock
-	mr[ADC_CLKDIV-MMAP_OFFSET] = clockDivider
+	mr[reg(ADC_CLKDIV)] = clockDivider
 
-	// default: SW enabled, one-shot; no averaging
+	// SW enabled, one-shot or continuous; default no averaging
 	// set averaging the same for all
 	// assign an ADCSTEPCONFIG for each ain pin
 	// set SEL_INP and SEL_INM for each STEPCONFIG per Vegetable Avenger
 	// painful because SEL_INM bits are split across bytes 1 & 2
-	mr[ADCSTEPCONFIG1-MMAP_OFFSET] = sampleAvg << 2
-	mr[ADCSTEPCONFIG1-MMAP_OFFSET+2] = 0x00 | (0x00 << 3) // SEL_INM (bits 16-18) | SEL_INP (bits 19-22)
-	mr[ADCSTEPCONFIG1-MMAP_OFFSET+1] = 0x00 << 7          // lowest bit of SEL_INM (bit 15)
-	mr[ADCSTEPCONFIG2-MMAP_OFFSET] = sampleAvg << 2
-	mr[ADCSTEPCONFIG2-MMAP_OFFSET+2] = 0x00 | (0x01 << 3)
-	mr[ADCSTEPCONFIG2-MMAP_OFFSET+1] = 0x01 << 7
-	mr[ADCSTEPCONFIG3-MMAP_OFFSET] = sampleAvg << 2
-	mr[ADCSTEPCONFIG3-MMAP_OFFSET+2] = 0x01 | (0x02 << 3)
-	mr[ADCSTEPCONFIG3-MMAP_OFFSET+1] = 0x00 << 7
-	mr[ADCSTEPCONFIG4-MMAP_OFFSET] = sampleAvg << 2
-	mr[ADCSTEPCONFIG4-MMAP_OFFSET+2] = 0x01 | (0x03 << 3)
-	mr[ADCSTEPCONFIG4-MMAP_OFFSET+1] = 0x01 << 7
-	//mr[ADCSTEPCONFIG5-MMAP_OFFSET] = sampleAvg << 2
-	//mr[ADCSTEPCONFIG5-MMAP_OFFSET+2] = 0x02 | (0x04 << 3)
-	//mr[ADCSTEPCONFIG5-MMAP_OFFSET+1] = 0x00 << 7
-	//mr[ADCSTEPCONFIG6-MMAP_OFFSET] = sampleAvg << 2
-	//mr[ADCSTEPCONFIG6-MMAP_OFFSET+2] = 0x02 | (0x05 << 3)
-	//mr[ADCSTEPCONFIG6-MMAP_OFFSET+1] = 0x01 << 7
-	//mr[ADCSTEPCONFIG7-MMAP_OFFSET] = sampleAvg << 2
-	//mr[ADCSTEPCONFIG7-MMAP_OFFSET+2] = 0x06 << 3
-	//mr[ADCSTEPCONFIG7-MMAP_OFFSET+2] = 0x03 | (0x06 << 3)
-	//mr[ADCSTEPCONFIG7-MMAP_OFFSET+1] = 0x00 << 7
 	// set sample delay as appropriate; veggie avenger uses 1
-	mr[ADCSTEPDELAY1-MMAP_OFFSET+3] = ADC_SAMPLEDELAY
-	mr[ADCSTEPDELAY2-MMAP_OFFSET+3] = ADC_SAMPLEDELAY
-	mr[ADCSTEPDELAY3-MMAP_OFFSET+3] = ADC_SAMPLEDELAY
-	mr[ADCSTEPDELAY4-MMAP_OFFSET+3] = ADC_SAMPLEDELAY
-	//mr[ADCSTEPDELAY5-MMAP_OFFSET+3] = ADC_SAMPLEDELAY
-	//mr[ADCSTEPDELAY6-MMAP_OFFSET+3] = ADC_SAMPLEDELAY
-	//mr[ADCSTEPDELAY7-MMAP_OFFSET+3] = ADC_SAMPLEDELAY
+	for i := 0; i < steps; i++ {
+		config := reg(ADCSTEPCONFIG1 + ADC_STEP_SIZE*uint32(i))
+		delay := reg(ADCSTEPDELAY1 + ADC_STEP_SIZE*uint32(i))
+		mr[config] = mode | sampleAvg<<2
+		mr[config+2] = byte(i>>1) | byte(i)<<3 // SEL_INM (bits 16-18) | SEL_INP (bits 19-22)
+		mr[config+1] = byte(i&1) << 7          // lowest bit of SEL_INM (bit 15)
+		mr[delay+3] = ADC_SAMPLEDELAY
+	}
 
 	// restore write protection
-	mr[ADC_CTRL-MMAP_OFFSET] &^= ADC_STEPCONFIG_WRITE_PROTECT_OFF
+	mr[reg(ADC_CTRL)] &^= ADC_STEPCONFIG_WRITE_PROTECT_OFF
+	settleDelay = ADCSettleTime(clockDivider, sampleAvg, steps)
+	return nil
+}
+
+// waitADCClock waits for the enable to complete: MODULEMODE reads back
+// enabled and IDLEST (bits 16-17) says the module is functional. A module
+// that never wakes up, as without the ADC overlay, gives ErrADCClock after
+// ADC_CLOCK_WAIT instead of hanging startup.
+func waitADCClock(mr []byte) error {
+	clkctrl := reg(CM_WKUP_ADC_TSC_CLKCTRL)
+	deadline := time.Now().Add(ADC_CLOCK_WAIT)
+	for mr[clkctrl]&CM_WKUP_MODULEMODE_ENABLE == 0 || mr[clkctrl+2]&CM_WKUP_IDLEST_DISABLED_GO != 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: MODULEMODE %#x, IDLEST %#x", ErrADCClock, mr[clkctrl]&0x03, mr[clkctrl+2]&CM_WKUP_IDLEST_DISABLED_GO)
+		}
+		time.Sleep(10 * time.Microsecond)
+	}
+	return nil
+}
+
+// ADCConversionTime is how long the ADC takes to convert steps steps once,
+// with clockDivider and sampleAvg as passed to ADCInit.
+func ADCConversionTime(clockDivider, sampleAvg byte, steps int) time.Duration {
+	perSample := ADC_SAMPLEDELAY + 1 + ADC_CONVERT_CLOCKS
+	clocks := steps * (ADC_OPENDELAY + perSample<<sampleAvg)
+	return time.Duration(clocks) * time.Duration(int(clockDivider)+1) * time.Second / ADC_CLOCK_HZ
+}
+
+// ADCSettleTime is the default settling delay for ReadAnalog: twice the
+// conversion time, so a slow divider or heavy averaging does not under-read,
+// but never less than ADC_SETTLE_MIN.
+func ADCSettleTime(clockDivider, sampleAvg byte, steps int) time.Duration {
+	if d := 2 * ADCConversionTime(clockDivider, sampleAvg, steps); d > ADC_SETTLE_MIN {
+		return d
+	}
+	return ADC_SETTLE_MIN
+}
+
+// ADCSetRange programs ADCRANGE with the readings, 0 to 4095, outside of
+// which a step with range checking raises the out-of-range interrupt. No
+// step checks it now; the readings are checked in software, per pot, but
+// -check shows the range the converter holds. Call after ADCInit.
+func ADCSetRange(low, high int) error {
+	if !isMapped {
+		return ErrNotMapped
+	}
+	if low < ADCRANGE_MIN_RANGE || high > ADCRANGE_MAX_RANGE || low >= high {
+		return fmt.Errorf("illegal ADC range %d to %d: must be within %d to %d", low, high, ADCRANGE_MIN_RANGE, ADCRANGE_MAX_RANGE)
+	}
+	mr := mapped.register
+	r := reg(ADC_ADCRANGE)
+	// low range in bits 0-11, high range in bits 16-27
+	mr[r] = byte(low)
+	mr[r+1] = byte(low >> 8)
+	mr[r+2] = byte(high)
+	mr[r+3] = byte(high >> 8)
+	return nil
+}
+
+// ADCGetRange reads back what ADCSetRange programmed.
+func ADCGetRange() (low, high int, err error) {
+	if !isMapped {
+		return 0, 0, ErrNotMapped
+	}
+	mr := mapped.register
+	r := reg(ADC_ADCRANGE)
+	low = int(mr[r]) | int(mr[r+1]&0x0F)<<8
+	high = int(mr[r+2]) | int(mr[r+3]&0x0F)<<8
+	return low, high, nil
+}
+
+// ADCSetReadTimeout replaces ADC_READ_TIMEOUT as the limit on emptying
+// the FIFO.
+func ADCSetReadTimeout(d time.Duration) {
+	readTimeout = d
+}
+
+// ADCSetSettle replaces the settling delay ADCInit computed. Call after
+// ADCInit.
+func ADCSetSettle(d time.Duration) {
+	settleDelay = d
+}
+
+// ADCInitThreshold programs FIFO0 to flag when it holds n samples. From then
+// on ReadAnalog waits for that flag instead of sleeping a fixed time, so it
+// returns as soon as the conversions are done. Call after ADCInit.
+func ADCInitThreshold(n int) error {
+	if !isMapped {
+		return ErrNotMapped
+	}
+	if n < 1 || n > ADC_FIFO_DEPTH {
+		return fmt.Errorf("illegal FIFO threshold %d: must be 1 to %d", n, ADC_FIFO_DEPTH)
+	}
+	// the level is programmed as the desired count minus 1
+	mapped.register[reg(ADC_FIFO0THRESHOLD)] = byte(n - 1)
+	clearFIFOThreshold()
+	fifoThreshold = n
+	return nil
 }
 
 // ADCDisable shuts down the ADC and closes the memory mapping.
 func ADCDisable() {
-	mapped.register[ADC_CTRL-MMAP_OFFSET] = CTRL_DISABLE
+	mapped.register[reg(ADC_CTRL)] = CTRL_DISABLE
 	mapped.file.Close()
 }
 
+// StepStatus is how one ADC step is programmed, as read back by ADCSteps.
+type StepStatus struct {
+	Step    byte
+	Enabled bool // set in STEPENABLE, i.e. converting or about to
+	Mode    byte // STEPCONFIG_MODE_SW_ONESHOT or STEPCONFIG_MODE_SW_CONTINUOUS
+	Average byte // ADC_AVG_1 to ADC_AVG_16
+	Input   byte // AIN selected by SEL_INP
+}
+
+// ADCSteps reads back the configuration of the first steps ADC steps
+// without changing anything. The ADC registers fault while its clock is
+// off, so if it is, ADCSteps returns nil and clockOn false.
+func ADCSteps(steps int) (status []StepStatus, clockOn bool, err error) {
+	if steps < 1 || steps > len(ainPins) {
+		return nil, false, fmt.Errorf("illegal number of ADC steps %d: must be 1 to %d", steps, len(ainPins))
+	}
+	if err := mmapInit(); err != nil {
+		return nil, false, fmt.Errorf("unable to initialize memory map: %s", err)
+	}
+	mr := mapped.register
+	if mr[reg(CM_WKUP_ADC_TSC_CLKCTRL)]&CM_WKUP_MODULEMODE_ENABLE == 0 {
+		return nil, false, nil
+	}
+	enabled := mr[reg(ADC_STEPENABLE)]
+	for i := 0; i < steps; i++ {
+		config := reg(ADCSTEPCONFIG1 + ADC_STEP_SIZE*uint32(i))
+		status = append(status, StepStatus{
+			Step:    byte(i),
+			Enabled: enabled&(0x01<<(i+1)) != 0,
+			Mode:    mr[config] & 0x03,
+			Average: mr[config] >> 2 & 0x07,
+			Input:   mr[config+2] >> 3 & 0x0F,
+		})
+	}
+	return status, true, nil
+}
+
 // ReadAnalog reads from one or more analog pins and returns
-// a map of ADC step IDs to analog output values from 0-4095
-func ReadAnalog(pins ...Pin) map[byte]int {
+// a map of ADC step IDs to analog output values from 0-4095.
+// If a pin fails to convert in time, the map lacks its step and the error
+// is an *UnderReadError naming the missing steps. If the FIFO does
+// not empty within the read timeout, the error is ErrADCTimeout, with
+// whatever was read.
+func ReadAnalog(pins ...Pin) (map[byte]int, error) {
+	return ReadAnalogSamples(1, pins...)
+}
+
+// ReadAnalogSamples is ReadAnalog taking samples conversions of each pin
+// and averaging them. The steps run samples times before the FIFO is read
+// once, so the samples of all the pins must fit in the FIFO together. A
+// step is only missing if none of its conversions landed.
+func ReadAnalogSamples(samples int, pins ...Pin) (map[byte]int, error) {
 	if !isMapped {
-		log.Fatalln("must initialize memory mapping")
+		return nil, ErrNotMapped
 	}
 
-	if pins == nil {
-		log.Fatalln("must read at least one pin")
+	if len(pins) == 0 {
+		return nil, ErrNoPins
 	}
 
-	var count byte
-	for count = getFIFOCount(); count != 0; count = getFIFOCount() {
-		log.Println("initial FIFO count should be zero: found", count)
-		readFIFO(1)
-		time.Sleep(850 * time.Microsecond)
+	// the FIFO should be empty; anything there is left over from a read
+	// that gave up, and a step of it may still be converting
+	stale, err := drainFIFO()
+	if err != nil {
+		return nil, err
+	}
+	if stale > 0 {
+		time.Sleep(settleDelay)
+		more, err := drainFIFO()
+		if err != nil {
+			return nil, err
+		}
+		slog.Warn("discarded stale FIFO entries", "count", stale+more)
+	}
+
+	if samples*len(pins) > ADC_FIFO_DEPTH {
+		return nil, fmt.Errorf("%d samples of %d pins do not fit in the FIFO of %d", samples, len(pins), ADC_FIFO_DEPTH)
 	}
 
 	// enable the step sequencer for this pin
 	// no guarantee on output order when multiple pins are enabled
-	enableStepSequencer(mapped.register, pins)
-	time.Sleep(500 * time.Microsecond)
+	for i := 0; i < samples; i++ {
+		// one-shot steps run once per enable
+		enableStepSequencer(pins)
+		if fifoThreshold > 0 {
+			// the flag stays met from the first pass on, so later
+			// passes wait for their own samples by the count
+			waitFIFOThreshold((i + 1) * fifoThreshold)
+		} else {
+			time.Sleep(settleDelay)
+		}
+	}
 
-	aoutMap := readFIFO(len(pins))
-	disableStepSequencer(mapped.register, pins)
-	return aoutMap
+	enabled := pinSteps(pins)
+	sums := make(map[byte]int, len(pins))
+	counts := make(map[byte]int, len(pins))
+	take := func(step byte, aout int) {
+		sums[step] += aout
+		counts[step]++
+	}
+	err = readFIFO(enabled, take)
+	// give steps that are still converting a little longer
+	missing := missingSteps(counts, pins)
+	for wait := time.Now().Add(ADC_UNDERREAD_WAIT); err == nil && len(missing) > 0 && time.Now().Before(wait); missing = missingSteps(counts, pins) {
+		time.Sleep(100 * time.Microsecond)
+		err = readFIFO(enabled, take)
+	}
+	disableStepSequencer(pins)
+	aoutMap := make(map[byte]int, len(sums))
+	for step, sum := range sums {
+		aoutMap[step] = (sum + counts[step]/2) / counts[step]
+	}
+	if err != nil {
+		return aoutMap, err
+	}
+	if len(missing) > 0 {
+		return aoutMap, &UnderReadError{Missing: missing}
+	}
+	return aoutMap, nil
 }
 
-func readFIFO(pinCt int) map[byte]int {
-	aoutMap := make(map[byte]int, pinCt)
-	var fifo uint32
-	var step byte
-	var aout int
-	for count := getFIFOCount(); count > 0; count = getFIFOCount() {
-		fifo = *mapped.fifo // read 32-bit FIFO register in one read
-		step = byte((fifo & ADC_FIFO_STEP_MASK) >> 16)
-		aout = int(fifo & ADC_FIFO_MASK)
+// ReadAnalogAveraged runs ReadAnalog passes times and averages the samples
+// of each step, for smoothing beyond the hardware's 16 sample averaging.
+// A step is only missing if it converted in none of the passes.
+func ReadAnalogAveraged(passes int, pins ...Pin) (map[byte]int, error) {
+	sums := make(map[byte]int, len(pins))
+	counts := make(map[byte]int, len(pins))
+	for i := 0; i < passes; i++ {
+		aoutMap, err := ReadAnalog(pins...)
+		var underRead *UnderReadError
+		if err != nil && !errors.As(err, &underRead) {
+			return nil, err
+		}
+		for step, aout := range aoutMap {
+			sums[step] += aout
+			counts[step]++
+		}
+	}
+	aoutMap := make(map[byte]int, len(sums))
+	for step, sum := range sums {
+		aoutMap[step] = (sum + counts[step]/2) / counts[step]
+	}
+	if missing := missingSteps(aoutMap, pins); len(missing) > 0 {
+		return aoutMap, &UnderReadError{Missing: missing}
+	}
+	return aoutMap, nil
+}
+
+// readPots reads pins and keys each value by the pin's position in pins,
+// which is its channel, instead of by its ADC step. The two are the same
+// unless -pins wires the pots to the analog inputs in another order. Steps
+// that were not asked for, as continuous mode returns, are dropped.
+func readPots(adc ADC, pins []Pin) (map[byte]int, error) {
+	aoutMap, err := adc.ReadAnalog(pins...)
+	if aoutMap == nil {
+		return nil, err
+	}
+	byChannel := make(map[byte]int, len(pins))
+	for i, pin := range pins {
+		if aout, ok := aoutMap[pin.bank_id]; ok {
+			byChannel[byte(i)] = aout
+		}
+	}
+	var underRead *UnderReadError
+	if errors.As(err, &underRead) {
+		missing := make([]byte, 0, len(underRead.Missing))
+		for i := range pins {
+			if _, ok := byChannel[byte(i)]; !ok {
+				missing = append(missing, byte(i))
+			}
+		}
+		err = &UnderReadError{Missing: missing}
+	}
+	return byChannel, err
+}
+
+// missingSteps lists the pins' steps that have no value in aoutMap.
+func missingSteps(aoutMap map[byte]int, pins []Pin) []byte {
+	var missing []byte
+	for _, pin := range pins {
+		if _, ok := aoutMap[pin.bank_id]; !ok {
+			missing = append(missing, pin.bank_id)
+		}
+	}
+	return missing
+}
+
+// DrainFIFO empties the FIFO filled by ADCInitContinuous and returns a map
+// of ADC step IDs to the latest analog output value of each step. A step
+// with no new sample since the last drain keeps its previous value.
+func DrainFIFO() (map[byte]int, error) {
+	if !isMapped {
+		return nil, ErrNotMapped
+	}
+	if continuousAout == nil {
+		return nil, ErrNotContinuous
+	}
+	take := func(step byte, aout int) {
+		continuousAout[step] = aout
+	}
+	if err := readFIFO(continuousSteps, take); err != nil {
+		return nil, err
+	}
+	aoutMap := make(map[byte]int, len(continuousAout))
+	for step, aout := range continuousAout {
 		aoutMap[step] = aout
 	}
-	return aoutMap
+	return aoutMap, nil
+}
+
+// stepSet has bit n set for each enabled ADC step n.
+type stepSet uint16
+
+func pinSteps(pins []Pin) stepSet {
+	var s stepSet
+	for _, pin := range pins {
+		s |= 1 << pin.bank_id
+	}
+	return s
+}
+
+// decodeFIFO splits a FIFO word into its step ID and sample. ok is false
+// for a step that is not in enabled, e.g. a stale entry from an earlier
+// configuration, so it cannot turn into a channel of its own.
+func decodeFIFO(word uint32, enabled stepSet) (step byte, aout int, ok bool) {
+	step = byte((word & ADC_FIFO_STEP_MASK) >> 16)
+	aout = int(word & ADC_FIFO_MASK)
+	return step, aout, enabled&(1<<step) != 0
+}
+
+// readFIFO empties the FIFO, handing each entry of an enabled step to
+// take, oldest first. It gives up with ErrADCTimeout if the FIFO is still
+// not empty after the read timeout.
+func readFIFO(enabled stepSet, take func(step byte, aout int)) error {
+	deadline := time.Now().Add(readTimeout)
+	for count := getFIFOCount(); count > 0; count = getFIFOCount() {
+		if time.Now().After(deadline) {
+			return ErrADCTimeout
+		}
+		fifo := mapped.fifo0.pop()
+		step, aout, ok := decodeFIFO(fifo, enabled)
+		if !ok {
+			slog.Debug("discarding FIFO entry for a step not enabled", "step", step, "word", fifo)
+			continue
+		}
+		take(step, aout)
+	}
+	return nil
+}
+
+// drainFIFO empties the FIFO without looking at the entries and returns how
+// many it discarded, or ErrADCTimeout if it is still not empty after the
+// read timeout.
+func drainFIFO() (int, error) {
+	deadline := time.Now().Add(readTimeout)
+	n := 0
+	for count := getFIFOCount(); count > 0; count = getFIFOCount() {
+		if time.Now().After(deadline) {
+			return n, ErrADCTimeout
+		}
+		for ; count > 0; count-- {
+			mapped.fifo0.pop() // each read moves the FIFO on
+			n++
+		}
+	}
+	return n, nil
+}
+
+// waitFIFOThreshold waits until FIFO0 reaches its threshold and holds at
+// least count entries, then clears the flag for the next read. It gives
+// up after ADC_THRESHOLD_WAIT so a stalled converter cannot hang the
+// caller; readFIFO takes whatever is there.
+func waitFIFOThreshold(count int) {
+	deadline := time.Now().Add(ADC_THRESHOLD_WAIT)
+	for !mapped.fifo0.thresholdReached() || int(getFIFOCount()) < count {
+		if time.Now().After(deadline) {
+			slog.Warn("timed out waiting for FIFO threshold", "count", getFIFOCount())
+			break
+		}
+		time.Sleep(50 * time.Microsecond)
+	}
+	clearFIFOThreshold()
+}
+
+func clearFIFOThreshold() {
+	mapped.fifo0.clearThreshold()
 }
 
 func getFIFOCount() byte {
-	return mapped.register[ADC_FIFO0COUNT-MMAP_OFFSET] & ADC_FIFO_COUNT_MASK
+	return mapped.fifo0.count()
 }
 
-func enableStepSequencer(mr []byte, pins []Pin) {
+func enableStepSequencer(pins []Pin) {
 	var bits byte = 0x00
 	for _, pin := range pins {
 		bits |= 0x01 << (pin.bank_id + 1)
 	}
-	mr[ADC_STEPENABLE-MMAP_OFFSET] |= bits
-	// enable the ADC
-	mr[ADC_CTRL-MMAP_OFFSET] |= CTRL_ENABLE
+	mapped.fifo0.enableSteps(bits)
 }
 
-func disableStepSequencer(mr []byte, pins []Pin) {
+func disableStepSequencer(pins []Pin) {
 	var bits byte = 0x00
 	for _, pin := range pins {
 		bits |= 0x01 << (pin.bank_id + 1)
 	}
-	mr[ADC_STEPENABLE-MMAP_OFFSET] &^= bits
-	// disable the ADC
-	mr[ADC_CTRL-MMAP_OFFSET] &^= CTRL_ENABLE
+	mapped.fifo0.disableSteps(bits)
+}
+
+// ADC reads the analog pins. mmapADC is the real converter; mockADC stands
+// in for it off the BeagleBone.
+type ADC interface {
+	Init(clockDivider, sampleAvg byte, steps int) error
+	ReadAnalog(pins ...Pin) (map[byte]int, error)
+	Disable()
+}
+
+// mmapADC drives the AM335x converter through /dev/mem using the functions
+// above.
+type mmapADC struct {
+	continuous bool // see ADCInitContinuous
+	threshold  bool // see ADCInitThreshold
+	passes     int  // conversions averaged per read; see ReadAnalogAveraged
+	samples    int  // conversions per step in one FIFO read; see ReadAnalogSamples
+	// settling delay for one-shot reads; 0 keeps ADCSettleTime
+	settle time.Duration
+	// limit on a whole read; 0 keeps ADC_READ_TIMEOUT
+	timeout time.Duration
+	// programmed into ADCRANGE; see ADCSetRange
+	rangeMin, rangeMax int
+	// pins read each time, the FIFO threshold. Fewer than the steps
+	// programmed when the pins skip an input, whose step never runs.
+	pins int
+}
+
+func (a *mmapADC) Init(clockDivider, sampleAvg byte, steps int) error {
+	var err error
+	if a.continuous {
+		err = ADCInitContinuous(clockDivider, sampleAvg, steps)
+	} else {
+		err = ADCInit(clockDivider, sampleAvg, steps)
+	}
+	if err != nil {
+		return err
+	}
+	if a.settle > 0 {
+		ADCSetSettle(a.settle)
+	}
+	if a.timeout > 0 {
+		ADCSetReadTimeout(a.timeout)
+	}
+	if err := ADCSetRange(a.rangeMin, a.rangeMax); err != nil {
+		return err
+	}
+	if !a.threshold {
+		return nil
+	}
+	return ADCInitThreshold(a.pins)
+}
+
+func (a *mmapADC) ReadAnalog(pins ...Pin) (map[byte]int, error) {
+	if !a.continuous {
+		if a.passes > 1 {
+			return ReadAnalogAveraged(a.passes, pins...)
+		}
+		if a.samples > 1 {
+			return ReadAnalogSamples(a.samples, pins...)
+		}
+		return ReadAnalog(pins...)
+	}
+	aoutMap, err := DrainFIFO()
+	if err != nil {
+		return nil, err
+	}
+	// the converter may not have been through every step yet
+	if missing := missingSteps(aoutMap, pins); len(missing) > 0 {
+		return aoutMap, &UnderReadError{Missing: missing}
+	}
+	return aoutMap, nil
+}
+
+func (a *mmapADC) Disable() {
+	ADCDisable()
 }
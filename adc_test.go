@@ -0,0 +1,396 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// useFakeRegisters maps a zeroed slice in place of /dev/mem for the rest
+// of the test, with a mockFIFO for FIFO0, so the register code runs off
+// the BeagleBone.
+func useFakeRegisters(t *testing.T) ([]byte, *mockFIFO) {
+	t.Helper()
+	prevMapped, prevIsMapped := mapped, isMapped
+	prevThreshold, prevSettle, prevTimeout := fifoThreshold, settleDelay, readTimeout
+	prevAout, prevSteps := continuousAout, continuousSteps
+	t.Cleanup(func() {
+		mapped, isMapped = prevMapped, prevIsMapped
+		fifoThreshold, settleDelay, readTimeout = prevThreshold, prevSettle, prevTimeout
+		continuousAout, continuousSteps = prevAout, prevSteps
+	})
+
+	mapped = &mappedRegisters{register: make([]byte, MMAP_SIZE)}
+	mapped.fifo = (*uint32)(unsafe.Pointer(&mapped.register[reg(ADC_FIFO0DATA)]))
+	fifo := &mockFIFO{}
+	mapped.fifo0 = fifo
+	isMapped = true
+	fifoThreshold = 0
+	return mapped.register, fifo
+}
+
+// TestThresholdSkippedInput reads pots on AIN0-3 and AIN5. Six steps are
+// programmed so AIN5 converts, but AIN4's never runs, so the FIFO only
+// ever fills to five per read and the threshold must be five, not six.
+func TestThresholdSkippedInput(t *testing.T) {
+	mr, _ := useFakeRegisters(t)
+	pins := []Pin{P9_39, P9_40, P9_37, P9_38, P9_36}
+	if got := stepCount(pins); got != 6 {
+		t.Fatalf("stepCount = %d, want 6", got)
+	}
+	a := &mmapADC{threshold: true, rangeMax: ADCRANGE_MAX_RANGE, pins: len(pins)}
+	if err := a.Init(0, ADC_AVG_1, stepCount(pins)); err != nil {
+		t.Fatal(err)
+	}
+	// programmed as the count minus 1
+	if got := mr[reg(ADC_FIFO0THRESHOLD)]; got != byte(len(pins)-1) {
+		t.Errorf("FIFO0THRESHOLD = %d, want %d", got, len(pins)-1)
+	}
+	if fifoThreshold != len(pins) {
+		t.Errorf("fifoThreshold = %d, want %d", fifoThreshold, len(pins))
+	}
+}
+
+func TestDecodeFIFO(t *testing.T) {
+	enabled := pinSteps([]Pin{P9_39, P9_37, P9_36}) // steps 0, 2 and 5
+	tests := []struct {
+		word     uint32
+		wantStep byte
+		wantAout int
+		wantOK   bool
+	}{
+		{0x00000000, 0, 0, true},
+		{0x00000FFF, 0, 4095, true},
+		{0x00020800, 2, 2048, true},
+		{0x00050001, 5, 1, true},
+		// bits above the sample and between it and the step ID are not
+		// part of either
+		{0x0002F123, 2, 0x123, true},
+		{0xFFF5F456, 5, 0x456, true},
+		// steps not enabled, e.g. stale entries
+		{0x00010400, 1, 1024, false},
+		{0x00040400, 4, 1024, false},
+		{0x000F0FFF, 15, 4095, false},
+	}
+	for _, tt := range tests {
+		step, aout, ok := decodeFIFO(tt.word, enabled)
+		if step != tt.wantStep || aout != tt.wantAout || ok != tt.wantOK {
+			t.Errorf("decodeFIFO(%#08x) = %d, %d, %v; want %d, %d, %v",
+				tt.word, step, aout, ok, tt.wantStep, tt.wantAout, tt.wantOK)
+		}
+	}
+}
+
+func TestPinSteps(t *testing.T) {
+	if got := pinSteps(nil); got != 0 {
+		t.Errorf("pinSteps(nil) = %#x, want 0", got)
+	}
+	if got := pinSteps(ainPins); got != 0x7F {
+		t.Errorf("pinSteps(all) = %#x, want 0x7f", got)
+	}
+	if got := pinSteps([]Pin{P9_35, P9_39}); got != 1<<6|1 {
+		t.Errorf("pinSteps(AIN6, AIN0) = %#x, want 0x41", got)
+	}
+}
+
+func TestDrainFIFO(t *testing.T) {
+	for _, n := range []int{0, 1, 7, 50, ADC_FIFO_DEPTH} {
+		_, fifo := useFakeRegisters(t)
+		for i := 0; i < n; i++ {
+			fifo.push(byte(i%7), i)
+		}
+		got, err := drainFIFO()
+		if err != nil {
+			t.Fatalf("%d entries: %v", n, err)
+		}
+		if got != n || fifo.count() != 0 {
+			t.Errorf("%d entries: drained %d, %d left", n, got, fifo.count())
+		}
+	}
+}
+
+func TestReadFIFO(t *testing.T) {
+	_, fifo := useFakeRegisters(t)
+	fifo.push(0, 100)
+	fifo.push(3, 200) // not enabled
+	fifo.push(2, 300)
+	fifo.push(0, 400)
+	var got []int
+	err := readFIFO(pinSteps([]Pin{P9_39, P9_37}), func(step byte, aout int) {
+		got = append(got, int(step)*10000+aout)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{100, 20300, 400}
+	if len(got) != len(want) {
+		t.Fatalf("took %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("took %v, want %v", got, want)
+		}
+	}
+	if fifo.count() != 0 {
+		t.Errorf("%d entries left", fifo.count())
+	}
+}
+
+// TestReadAnalogStale fills the FIFO as a read that gave up would leave
+// it, and checks ReadAnalog empties it before converting, so none of the
+// stale entries is taken for a reading.
+func TestReadAnalogStale(t *testing.T) {
+	_, fifo := useFakeRegisters(t)
+	settleDelay = 0
+	fifo.aouts = map[byte]int{0: 1000, 1: 2000}
+	for i := 0; i < ADC_FIFO_DEPTH; i++ {
+		fifo.push(byte(i%4), 4000)
+	}
+	aoutMap, err := ReadAnalog(P9_39, P9_40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aoutMap) != 2 || aoutMap[0] != 1000 || aoutMap[1] != 2000 {
+		t.Errorf("read %v, want map[0:1000 1:2000]", aoutMap)
+	}
+	if fifo.count() != 0 {
+		t.Errorf("%d entries left", fifo.count())
+	}
+}
+
+// TestThresholdTimeout waits on a FIFO that never fills and checks
+// waitFIFOThreshold gives up after ADC_THRESHOLD_WAIT instead of hanging,
+// and returns at once when the flag is up, clearing it either way.
+func TestThresholdTimeout(t *testing.T) {
+	_, fifo := useFakeRegisters(t)
+	fifo.level = 6
+	fifo.push(0, 100)
+
+	start := time.Now()
+	waitFIFOThreshold(0)
+	if waited := time.Since(start); waited < ADC_THRESHOLD_WAIT || waited > 10*ADC_THRESHOLD_WAIT {
+		t.Errorf("waited %v for a FIFO that never fills, want about %v", waited, ADC_THRESHOLD_WAIT)
+	}
+
+	for i := 1; i < fifo.level; i++ {
+		fifo.push(byte(i), 100)
+	}
+	start = time.Now()
+	waitFIFOThreshold(0)
+	if waited := time.Since(start); waited >= ADC_THRESHOLD_WAIT {
+		t.Errorf("waited %v with the threshold reached", waited)
+	}
+	if fifo.thresholdReached() {
+		t.Error("threshold flag not cleared")
+	}
+}
+
+// TestStuckFIFO reads a FIFO whose count never falls, and checks
+// readFIFO and drainFIFO give up with ErrADCTimeout.
+func TestStuckFIFO(t *testing.T) {
+	_, fifo := useFakeRegisters(t)
+	readTimeout = 5 * time.Millisecond
+	fifo.stuck = true
+	fifo.push(0, 100)
+
+	if _, err := drainFIFO(); err != ErrADCTimeout {
+		t.Errorf("drainFIFO: err = %v, want ErrADCTimeout", err)
+	}
+	err := readFIFO(pinSteps([]Pin{P9_39}), func(step byte, aout int) {})
+	if err != ErrADCTimeout {
+		t.Errorf("readFIFO: err = %v, want ErrADCTimeout", err)
+	}
+	if _, err := ReadAnalog(P9_39); !errors.Is(err, ErrADCTimeout) {
+		t.Errorf("ReadAnalog: err = %v, want ErrADCTimeout", err)
+	}
+}
+
+// TestSixSteps reads six pots, four colors and the speed and master pots,
+// one-shot, over several samples, and with the FIFO threshold, and checks
+// all six steps come back with their own readings.
+func TestSixSteps(t *testing.T) {
+	pins := ainPins[:6]
+	aouts := map[byte]int{0: 100, 1: 900, 2: 1700, 3: 2500, 4: 3300, 5: 4095, 6: 50}
+	tests := []struct {
+		name string
+		adc  *mmapADC
+	}{
+		{"one sample", &mmapADC{pins: len(pins)}},
+		{"samples", &mmapADC{samples: 4, pins: len(pins)}},
+		{"threshold", &mmapADC{threshold: true, pins: len(pins)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, fifo := useFakeRegisters(t)
+			fifo.aouts = aouts
+			fifo.convert = ADCConversionTime(0, ADC_AVG_1, 1)
+			tt.adc.rangeMax = ADCRANGE_MAX_RANGE
+			if err := tt.adc.Init(0, ADC_AVG_1, len(pins)); err != nil {
+				t.Fatal(err)
+			}
+			if tt.adc.threshold {
+				fifo.level = fifoThreshold
+			}
+			aoutMap, err := tt.adc.ReadAnalog(pins...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(aoutMap) != len(pins) {
+				t.Errorf("read %d steps, want %d: %v", len(aoutMap), len(pins), aoutMap)
+			}
+			for _, pin := range pins {
+				if aoutMap[pin.bank_id] != aouts[pin.bank_id] {
+					t.Errorf("step %d read %d, want %d", pin.bank_id, aoutMap[pin.bank_id], aouts[pin.bank_id])
+				}
+			}
+
+			// -pins wired the other way round: keyed by channel
+			reversed := make([]Pin, len(pins))
+			for i, pin := range pins {
+				reversed[len(pins)-1-i] = pin
+			}
+			byChannel, err := readPots(tt.adc, reversed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for channel, pin := range reversed {
+				if byChannel[byte(channel)] != aouts[pin.bank_id] {
+					t.Errorf("channel %d read %d, want %d", channel, byChannel[byte(channel)], aouts[pin.bank_id])
+				}
+			}
+		})
+	}
+}
+
+// TestSettleCount enables the steps and waits the settling delay ADCInit
+// worked out from the divider and averaging, and checks every step has
+// converted by then, but not by half the conversion time.
+func TestSettleCount(t *testing.T) {
+	tests := []struct {
+		clockDivider, sampleAvg byte
+		steps                   int
+	}{
+		{0, ADC_AVG_1, 1},
+		{0, ADC_AVG_1, 7},
+		{7, ADC_AVG_16, 4},
+		{39, ADC_AVG_16, 7}, // 400us a step
+	}
+	for _, tt := range tests {
+		name := fmt.Sprintf("divider %d, average %d, %d steps", tt.clockDivider, tt.sampleAvg, tt.steps)
+		t.Run(name, func(t *testing.T) {
+			_, fifo := useFakeRegisters(t)
+			fifo.convert = ADCConversionTime(tt.clockDivider, tt.sampleAvg, 1)
+			if err := ADCInit(tt.clockDivider, tt.sampleAvg, tt.steps); err != nil {
+				t.Fatal(err)
+			}
+			pins := ainPins[:tt.steps]
+
+			enableStepSequencer(pins)
+			time.Sleep(settleDelay)
+			if got := fifo.count(); int(got) != tt.steps {
+				t.Errorf("%d entries after %v, want %d", got, settleDelay, tt.steps)
+			}
+			disableStepSequencer(pins)
+			if _, err := drainFIFO(); err != nil {
+				t.Fatal(err)
+			}
+
+			if conversion := ADCConversionTime(tt.clockDivider, tt.sampleAvg, tt.steps); conversion > 2*time.Millisecond {
+				enableStepSequencer(pins)
+				time.Sleep(conversion / 2)
+				if got := fifo.count(); int(got) >= tt.steps {
+					t.Errorf("%d entries after half of %v", got, conversion)
+				}
+				disableStepSequencer(pins)
+			}
+		})
+	}
+}
+
+// TestContinuousOverrun leaves the converter running in continuous mode
+// until the FIFO overruns, and checks it kept the samples it held and
+// lost the rest, and that reading it empties it so nothing more is lost.
+func TestContinuousOverrun(t *testing.T) {
+	_, fifo := useFakeRegisters(t)
+	fifo.continuous = true
+	fifo.convert = 100 * time.Microsecond
+	fifo.aouts = map[byte]int{0: 1000, 1: 1000, 2: 1000, 3: 1000}
+	pins := ainPins[:4]
+	a := &mmapADC{continuous: true, rangeMax: ADCRANGE_MAX_RANGE, pins: len(pins)}
+	if err := a.Init(0, ADC_AVG_1, len(pins)); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * ADC_FIFO_DEPTH * fifo.convert)
+	if got := fifo.count(); got != ADC_FIFO_DEPTH || fifo.overruns == 0 {
+		t.Fatalf("%d entries and %d overruns, want a full FIFO overrun", got, fifo.overruns)
+	}
+	fifo.aouts = map[byte]int{0: 3000, 1: 3000, 2: 3000, 3: 3000}
+	// the oldest samples stay; the ones after are lost
+	if step, aout, _ := decodeFIFO(fifo.pop(), continuousSteps); step != 0 || aout != 1000 {
+		t.Errorf("oldest entry step %d, %d; want step 0, 1000", step, aout)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := a.ReadAnalog(pins...); err != nil {
+			t.Fatal(err)
+		}
+		if got := fifo.count(); got >= ADC_FIFO_DEPTH/2 {
+			t.Errorf("read %d: %d entries left", i, got)
+		}
+		overruns := fifo.overruns
+		time.Sleep(ADC_FIFO_DEPTH / 8 * fifo.convert)
+		if fifo.count(); fifo.overruns != overruns {
+			t.Errorf("read %d: %d more overruns", i, fifo.overruns-overruns)
+		}
+	}
+	aoutMap, err := a.ReadAnalog(pins...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pin := range pins {
+		if aoutMap[pin.bank_id] != 3000 {
+			t.Errorf("step %d read %d, want 3000", pin.bank_id, aoutMap[pin.bank_id])
+		}
+	}
+}
+
+// TestSamplesAveraged reads several samples of each step, each one apart
+// from the last, one-shot and with the FIFO threshold, on a divider slow
+// enough that a pass that did not wait would run into the next, and
+// checks the reading is the average of all of them.
+func TestSamplesAveraged(t *testing.T) {
+	const samples, ramp = 4, 100
+	pins := ainPins[:4]
+	aouts := map[byte]int{0: 500, 1: 1000, 2: 1500, 3: 2000}
+	for _, threshold := range []bool{false, true} {
+		t.Run(fmt.Sprintf("threshold %v", threshold), func(t *testing.T) {
+			_, fifo := useFakeRegisters(t)
+			fifo.aouts, fifo.ramp = aouts, ramp
+			fifo.convert = ADCConversionTime(39, ADC_AVG_16, 1)
+			a := &mmapADC{threshold: threshold, samples: samples, rangeMax: ADCRANGE_MAX_RANGE, pins: len(pins)}
+			if err := a.Init(39, ADC_AVG_16, len(pins)); err != nil {
+				t.Fatal(err)
+			}
+			fifo.level = fifoThreshold
+			aoutMap, err := a.ReadAnalog(pins...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, pin := range pins {
+				// 0, 1, 2 and 3 ramps up
+				want := aouts[pin.bank_id] + ramp*(samples-1)/2
+				if aoutMap[pin.bank_id] != want {
+					t.Errorf("step %d read %d, want %d", pin.bank_id, aoutMap[pin.bank_id], want)
+				}
+			}
+			for _, pin := range pins {
+				if fifo.converted[pin.bank_id] != samples {
+					t.Errorf("step %d converted %d times, want %d", pin.bank_id, fifo.converted[pin.bank_id], samples)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often the light sensor is read; the sysfs read is slow next to the
+// mmapped pots
+const ambientInterval = time.Second
+
+// ambientSensor reads the light sensor on ainPath in the background and
+// turns it into a brightness scale for all the LEDs: ambient_min in the dark
+// up to ambient_max in daylight.
+type ambientSensor struct {
+	path string
+	mu   sync.Mutex
+	s    float64
+}
+
+func newAmbientSensor(path string) *ambientSensor {
+	a := &ambientSensor{path: path, s: conf.AmbientMax}
+	go a.run()
+	return a
+}
+
+func (a *ambientSensor) run() {
+	defer failsafe()
+	failing := false
+	for {
+		raw, err := readAIN(a.path)
+		if err != nil {
+			// keep the last scale; say so once rather than every second
+			if !failing {
+				slog.Warn("could not read light sensor", "path", a.path, "err", err)
+			}
+		} else {
+			if failing {
+				slog.Info("reading light sensor again", "path", a.path)
+			}
+			c := currentConfig()
+			s := c.AmbientMin + (c.AmbientMax-c.AmbientMin)*float64(raw)/(ainLevels-1)
+			a.mu.Lock()
+			a.s = s
+			a.mu.Unlock()
+		}
+		failing = err != nil
+		time.Sleep(ambientInterval)
+	}
+}
+
+// scale is the factor for the duties from the latest reading.
+func (a *ambientSensor) scale() float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.s
+}
+
+// readAIN reads a raw value, 0 to 4095, from an IIO sysfs file.
+func readAIN(path string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 {
+		v = 0
+	} else if v > ainLevels-1 {
+		v = ainLevels - 1
+	}
+	return v, nil
+}
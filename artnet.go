@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+// Art-Net carries DMX512 universes over UDP, e.g. from QLC+.
+const (
+	artNetPort     = 6454
+	artNetOpDMX    = 0x5000
+	artNetHeader   = 18 // bytes before the DMX data of an ArtDMX packet
+	artNetUniverse = 0x7FFF
+)
+
+var artNetID = []byte("Art-Net\x00")
+
+type artNetSource struct {
+	conn     *net.UDPConn
+	universe int
+	address  int // first slot, 1-512
+	count    int // number of LEDs
+	out      chan map[byte]int
+}
+
+// newArtNetSource listens on addr for ArtDMX packets of the given universe
+// and sends the count slots starting at address as a frame per packet.
+func newArtNetSource(addr string, universe, address, count int) (*artNetSource, error) {
+	if universe < 0 || universe > artNetUniverse {
+		return nil, fmt.Errorf("illegal Art-Net universe %d: must be 0 to %d", universe, artNetUniverse)
+	}
+	if address < 1 || address+count-1 > dmxSlots {
+		return nil, fmt.Errorf("illegal DMX address %d: must be 1 to %d for %d channels", address, dmxSlots-count+1, count)
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	a := &artNetSource{conn: conn, universe: universe, address: address, count: count, out: make(chan map[byte]int, 1)}
+	go a.run()
+	return a, nil
+}
+
+func (a *artNetSource) name() string                { return "art-net" }
+func (a *artNetSource) frames() <-chan map[byte]int { return a.out }
+
+func (a *artNetSource) run() {
+	defer failsafe()
+	buf := make([]byte, artNetHeader+dmxSlots)
+	for {
+		n, _, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			slog.Error("Art-Net input stopped", "err", err)
+			return
+		}
+		if frame := a.parse(buf[:n]); frame != nil {
+			sendLatest(a.out, frame)
+		}
+	}
+}
+
+// parse returns the LED levels in an ArtDMX packet, or nil if the packet
+// is something else, for another universe or too short.
+func (a *artNetSource) parse(p []byte) map[byte]int {
+	if len(p) < artNetHeader || !bytes.Equal(p[:8], artNetID) {
+		return nil
+	}
+	if binary.LittleEndian.Uint16(p[8:10]) != artNetOpDMX {
+		return nil
+	}
+	// 15-bit port address: Net in byte 15, Sub-Net and Universe in byte 14
+	if int(binary.LittleEndian.Uint16(p[14:16])&artNetUniverse) != a.universe {
+		return nil
+	}
+	length := int(binary.BigEndian.Uint16(p[16:18]))
+	data := p[artNetHeader:]
+	if length < len(data) {
+		data = data[:length]
+	}
+	if len(data) < a.address+a.count-1 {
+		return nil
+	}
+	frame := make(map[byte]int, a.count)
+	for i := 0; i < a.count; i++ {
+		frame[byte(i)] = scaleLevel(int(data[a.address-1+i]), dmxMax)
+	}
+	return frame
+}
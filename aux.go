@@ -0,0 +1,117 @@
+package main
+
+import "fmt"
+
+// roles an aux pot can have
+const (
+	auxSpeed  = "speed"  // sets the auto mode speed instead of the gesture's off pot
+	auxMaster = "master" // dims all the LEDs together
+	auxLFO    = "lfo"    // sets the rate of the LFO
+)
+
+var auxRoles = map[string]bool{auxSpeed: true, auxMaster: true, auxLFO: true}
+
+// auxPots are pots wired after the channels' own, on the following analog
+// inputs, that set something other than one LED's brightness. They are
+// read and smoothed with the rest but kept out of the channels' readings.
+type auxPots struct {
+	first  byte // step of the first aux pot, i.e. the channel count
+	roles  []string
+	smooth []Smoother
+	aout   []int     // latest raw reading, held over an under-read
+	level  []float64 // smoothed reading
+}
+
+func newAuxPots(first byte, roles []string) (*auxPots, error) {
+	a := &auxPots{
+		first:  first,
+		roles:  roles,
+		smooth: make([]Smoother, len(roles)),
+		aout:   make([]int, len(roles)),
+		level:  make([]float64, len(roles)),
+	}
+	for i := range roles {
+		var err error
+		if a.smooth[i], err = newSmoother(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// take moves the aux pots' readings out of aoutMap, which is left with the
+// channels' alone, and smooths them. A pot that did not convert keeps its
+// last reading.
+func (a *auxPots) take(aoutMap map[byte]int) {
+	for i := range a.roles {
+		step := a.first + byte(i)
+		if aout, ok := aoutMap[step]; ok {
+			a.aout[i] = aout
+			delete(aoutMap, step)
+		}
+		a.level[i] = a.smooth[i].Smooth(a.aout[i])
+	}
+}
+
+// resize gives each aux pot's median window the new size.
+func (a *auxPots) resize(size int) {
+	for i := range a.smooth {
+		a.smooth[i] = resizeSmoother(a.smooth[i], size)
+	}
+}
+
+// value returns the smoothed reading of the aux pot with role, if there is
+// one.
+func (a *auxPots) value(role string) (float64, bool) {
+	for i, r := range a.roles {
+		if r == role {
+			return a.level[i], true
+		}
+	}
+	return 0, false
+}
+
+// master returns the master dimmer level, 0 to 1: off at or below aout_off,
+// full at or above aout_on, in proportion between. Without a master pot
+// it is 1.
+func (a *auxPots) master() float64 {
+	aout, ok := a.value(auxMaster)
+	switch {
+	case !ok || aout >= float64(conf.AoutOn):
+		return 1
+	case aout <= float64(conf.AoutOff):
+		return 0
+	}
+	return (aout - float64(conf.AoutOff)) / float64(conf.AoutOn-conf.AoutOff)
+}
+
+// levels returns the smoothed reading of each aux pot by role, for /status.
+func (a *auxPots) levels() map[string]float64 {
+	if len(a.roles) == 0 {
+		return nil
+	}
+	m := make(map[string]float64, len(a.roles))
+	for i, r := range a.roles {
+		m[r] = a.level[i]
+	}
+	return m
+}
+
+// validAuxPots checks the aux_pots roles and that they fit on the analog
+// inputs left after the channels.
+func validAuxPots(roles []string, channels int) error {
+	if channels+len(roles) > len(ainPins) {
+		return fmt.Errorf("%d channels and %d aux_pots need more than the %d analog inputs", channels, len(roles), len(ainPins))
+	}
+	seen := make(map[string]bool)
+	for i, r := range roles {
+		if !auxRoles[r] {
+			return fmt.Errorf("aux_pots[%d]: unknown role %q", i, r)
+		}
+		if seen[r] {
+			return fmt.Errorf("aux_pots[%d]: role %s used twice", i, r)
+		}
+		seen[r] = true
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// breatheLevel is how far up its breath an LED is, 0 to 1, at time t into
+// the effect. phase shifts the LED along the cycle, as a fraction of it.
+func breatheLevel(t, period time.Duration, phase float64) float64 {
+	cycles := float64(t)/float64(period) + phase
+	return 0.5 - 0.5*math.Cos(2*math.Pi*cycles)
+}
+
+// parseSteps reads a list of LED steps such as "0,2,3", or "all".
+func parseSteps(list string, ledCount int) (map[byte]bool, error) {
+	steps := make(map[byte]bool)
+	if list == "" {
+		return steps, nil
+	}
+	if list == "all" {
+		for step := 0; step < ledCount; step++ {
+			steps[byte(step)] = true
+		}
+		return steps, nil
+	}
+	for _, item := range strings.Split(list, ",") {
+		step, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil || step < 0 || step >= ledCount {
+			return nil, fmt.Errorf("step %q must be 0 to %d", item, ledCount-1)
+		}
+		steps[byte(step)] = true
+	}
+	return steps, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const (
+	calibrateWindow   = 9 // median of this many readings, to ignore spikes
+	calibrateMinSweep = ainLevels / 4
+	calibrateReport   = time.Second
+)
+
+// potRange is the travel measured for one pot.
+type potRange struct {
+	min, max int
+}
+
+// hasCalibration reports whether -calibrate, or the config, has set the
+// pot's travel.
+func (ch channelConfig) hasCalibration() bool {
+	return ch.AoutMin != 0 || ch.AoutMax != 0
+}
+
+// aoutRange is the pot's calibrated travel. An unset aout_max means the
+// full scale.
+func (ch channelConfig) aoutRange() (min, max int) {
+	max = ch.AoutMax
+	if max == 0 {
+		max = ainLevels - 1
+	}
+	return ch.AoutMin, max
+}
+
+// calibrated rescales a raw reading from the pot's measured travel onto the
+// full 0-4095, so a cheap pot still reaches off and full.
+func (ch channelConfig) calibrated(aout int) int {
+	min, max := ch.aoutRange()
+	if aout <= min {
+		return 0
+	}
+	if aout >= max {
+		return ainLevels - 1
+	}
+	return (aout - min) * (ainLevels - 1) / (max - min)
+}
+
+// calibrateReadings rescales fresh pot readings in place.
+func calibrateReadings(aoutMap map[byte]int) {
+	for step, aout := range aoutMap {
+		aoutMap[step] = conf.Channels[step].calibrated(aout)
+	}
+}
+
+// calibrate records the lowest and highest reading of each pot while the
+// user sweeps them, until stop.
+func calibrate(adc ADC, pins []Pin, stop <-chan os.Signal) ([]potRange, error) {
+	windows := make([]*medianWindow, len(pins))
+	ranges := make([]potRange, len(pins))
+	for i := range pins {
+		windows[i] = newMedianWindow(calibrateWindow)
+		ranges[i] = potRange{ainLevels, -1}
+	}
+	slog.Info("turn every pot from one end to the other, then press Ctrl-C")
+	readings := 0
+	report := time.NewTicker(calibrateReport)
+	defer report.Stop()
+	for {
+		select {
+		case <-stop:
+			return ranges, nil
+		case <-report.C:
+			for step, r := range ranges {
+				slog.Info("calibrating", "step", step, "name", conf.channelName(byte(step)), "min", r.min, "max", r.max)
+			}
+		case <-time.After(time.Millisecond):
+		}
+
+		aoutMap, err := readPots(adc, pins)
+		var underRead *UnderReadError
+		if err != nil && !errors.As(err, &underRead) {
+			return nil, err
+		}
+		readings++
+		for step, aout := range aoutMap {
+			if int(step) >= len(windows) {
+				continue // continuous mode returns every converting step
+			}
+			v := int(windows[step].Smooth(aout))
+			if readings < calibrateWindow {
+				continue // window still filling
+			}
+			if v < ranges[step].min {
+				ranges[step].min = v
+			}
+			if v > ranges[step].max {
+				ranges[step].max = v
+			}
+		}
+	}
+}
+
+// applyCalibration puts the measured ranges into the config. A pot that was
+// not swept far enough keeps its old range.
+func applyCalibration(c *Config, ranges []potRange) {
+	for step, r := range ranges {
+		if r.max-r.min < calibrateMinSweep {
+			slog.Warn("pot not swept far enough; keeping its old range", "step", step, "name", c.channelName(byte(step)), "min", r.min, "max", r.max)
+			continue
+		}
+		c.Channels[step].AoutMin, c.Channels[step].AoutMax = r.min, r.max
+		slog.Info("calibrated", "step", step, "name", c.channelName(byte(step)), "aout_min", r.min, "aout_max", r.max)
+	}
+}
+
+// saveCalibration writes the channels' aout_min and aout_max into the config
+// file at path, leaving its other settings as they are.
+func saveCalibration(path string, c *Config) error {
+	file := make(map[string]json.RawMessage)
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(b, &file); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var channels []map[string]interface{}
+	if raw, ok := file["channels"]; ok {
+		if err := json.Unmarshal(raw, &channels); err != nil {
+			return err
+		}
+	}
+	if len(channels) != len(c.Channels) {
+		// the file relies on the default channels; write them out
+		raw, err := json.Marshal(c.Channels)
+		if err != nil {
+			return err
+		}
+		channels = nil
+		if err := json.Unmarshal(raw, &channels); err != nil {
+			return err
+		}
+	}
+	for i, ch := range c.Channels {
+		// as set, so a pot left uncalibrated stays that way
+		channels[i]["aout_min"], channels[i]["aout_max"] = ch.AoutMin, ch.AoutMax
+	}
+	if file["channels"], err = json.Marshal(channels); err != nil {
+		return err
+	}
+	if b, err = json.MarshalIndent(file, "", "    "); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(b, '\n'))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestPotDutyFloor checks an uncalibrated pot keeps the ainMinPad floor
+// through its dead zone, up to the curve's ceiling, and a calibrated one
+// goes down to zero.
+func TestPotDutyFloor(t *testing.T) {
+	c := defaultConfig()
+	c.Channels[1].AoutMin, c.Channels[1].AoutMax = 300, 3800
+	curve, err := newCurve(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ceiling := c.PWMPeriod.Duration - c.PWMResolution.Duration
+	tests := []struct {
+		name    string
+		step    byte
+		minDuty time.Duration
+		aout    float64
+		want    time.Duration
+	}{
+		{"uncalibrated, off", 0, 0, 0, ainMinPad},
+		{"uncalibrated, noise", 0, 0, 20, curve.Duty(20) + ainMinPad},
+		{"uncalibrated, full", 0, 0, ainLevels - 1, ceiling},
+		// a floor still lets the pot switch the LED off
+		{"uncalibrated, min_duty", 0, time.Microsecond, 5, 0},
+		{"calibrated, off", 1, 0, 0, 0},
+		{"calibrated, full", 1, 0, ainLevels - 1, ceiling},
+	}
+	for _, tt := range tests {
+		if got := c.potDuty(curve, tt.step, tt.minDuty, tt.aout); got != tt.want {
+			t.Errorf("%s: duty %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestSaveCalibration saves a calibration in which one pot was not swept
+// and checks that pot is still uncalibrated once the file is loaded.
+func TestSaveCalibration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixture.json")
+	c := defaultConfig()
+	applyCalibration(c, []potRange{{120, 3900}, {2000, 2010}, {0, 4000}, {60, 4095}})
+	if err := saveCalibration(path, c); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]int{{120, 3900}, {0, 0}, {0, 4000}, {60, 4095}}
+	for step, ch := range loaded.Channels {
+		if ch.AoutMin != want[step][0] || ch.AoutMax != want[step][1] {
+			t.Errorf("step %d: aout_min %d, aout_max %d; want %v", step, ch.AoutMin, ch.AoutMax, want[step])
+		}
+	}
+	if loaded.Channels[1].hasCalibration() || !loaded.Channels[2].hasCalibration() {
+		t.Error("the pot not swept was calibrated, or the one swept to 0 was not")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// chaseEffect lights the LEDs one after another, wrapping around, for
+// -automode chase. Unlike the random walk, which each LED does on its own,
+// the LEDs share one position that moves at a rate set by the speed pot.
+// The LED on the speed pot stays dark and is skipped.
+type chaseEffect struct {
+	pos  float64   // in LEDs along the chase, 0 up to the number in it
+	last time.Time // zero until the first advance after entering auto mode
+}
+
+// advance moves the chase on by the time since the last call. Each LED
+// holds the chase for loopMax * chase_dwell however fast the loop runs.
+func (c *chaseEffect) advance(now time.Time, loopMax, members int) {
+	if !c.last.IsZero() && loopMax > 0 && members > 0 {
+		dwell := float64(time.Duration(loopMax) * conf.ChaseDwell.Duration)
+		c.pos = math.Mod(c.pos+float64(now.Sub(c.last))/dwell, float64(members))
+	}
+	c.last = now
+}
+
+// pause makes the next advance start afresh, so leaving auto mode for a
+// while does not make the chase jump.
+func (c *chaseEffect) pause() {
+	c.last = time.Time{}
+}
+
+// lit reports whether the LED on step is lit, of ledCount LEDs with the
+// one on speedStep left out. Each LED stays lit for chase_overlap of a
+// dwell into the next one's turn.
+func (c *chaseEffect) lit(step, speedStep byte, ledCount int) bool {
+	members := ledCount - 1
+	if members < 2 {
+		return true
+	}
+	i := int(step)
+	if step > speedStep {
+		i-- // close the gap left by the speed pot's LED
+	}
+	d := math.Mod(c.pos-float64(i)+float64(members), float64(members))
+	return d < 1+conf.ChaseOverlap
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// names of the ADC_AVG_* settings, by register value
+var sampleAvgNames = []string{"1", "2", "4", "8", "16"}
+
+// listPins writes a table of the analog input pins for -list-pins, in AIN
+// order, which is the order the pots are read in without -pins: each
+// pin's name as -pins takes it, its header and position on the header,
+// the input and its bank_id, which is also the ADC step reading it, and
+// its index in the cape EEPROM's pin usage table.
+func listPins(w io.Writer) {
+	names := make([]string, 0, len(analogHeaderPins))
+	for name := range analogHeaderPins {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return analogHeaderPins[names[i]].bank_id < analogHeaderPins[names[j]].bank_id
+	})
+	fmt.Fprintf(w, "%-6s %-6s %3s  %-5s %7s %6s\n", "PIN", "HEADER", "POS", "INPUT", "BANK_ID", "EEPROM")
+	for _, name := range names {
+		pin := analogHeaderPins[name]
+		header, pos, _ := strings.Cut(name, "_")
+		fmt.Fprintf(w, "%-6s %-6s %3s  %-5s %7d %6d\n", name, header, pos, pin.name, pin.bank_id, pin.eeprom)
+	}
+	fmt.Fprintln(w, "ADC step i reads AINi. -pins takes PIN names in channel order, then aux pot order.")
+}
+
+// checkHardware writes a report of how the BeagleBone is set up for the
+// fixture: which of the overlays it needs are loaded, how the ADC steps
+// are programmed and what each PWM pin is putting out. Nothing is changed,
+// so it is safe to run next to a running fixture when the lights do not
+// respond. It returns an error only if the report could not be made; a
+// missing overlay is reported, not an error. With -skip-dto or the
+// /sys/class/pwm layout the overlays are taken as loaded, and there a PWM
+// channel not yet exported is exported to read it.
+func checkHardware(w io.Writer, pins []Pin) error {
+	var slots []byte
+	switch {
+	case pwmClass:
+		fmt.Fprintln(w, "overlays: not checked, applied at boot for /sys/class/pwm")
+	case *skipDTO:
+		fmt.Fprintln(w, "overlays: not checked, -skip-dto")
+	default:
+		var err error
+		if slots, err = readSlots(); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "overlays:")
+	}
+	loaded := func(dto string) bool {
+		if pwmClass || *skipDTO {
+			return true
+		}
+		ok := bytes.Contains(slots, []byte(dto))
+		state := "loaded"
+		if !ok {
+			state = "MISSING"
+		}
+		fmt.Fprintf(w, "  %-16s %s\n", dto, state)
+		return ok
+	}
+	pwmLoaded := loaded(pwmDTO)
+	pinLoaded := make([]bool, len(conf.Channels))
+	for i, ch := range conf.Channels {
+		pinLoaded[i] = loaded("bone_pwm_" + ch.PWM)
+	}
+
+	fmt.Fprintln(w, "ADC steps:")
+	steps, clockOn, err := ADCSteps(stepCount(pins))
+	if err != nil {
+		return err
+	}
+	if !clockOn {
+		fmt.Fprintln(w, "  ADC clock off; not configured since boot")
+	} else if low, high, err := ADCGetRange(); err == nil {
+		fmt.Fprintf(w, "  range %d to %d\n", low, high)
+	}
+	for _, s := range steps {
+		mode := "one-shot"
+		if s.Mode == STEPCONFIG_MODE_SW_CONTINUOUS {
+			mode = "continuous"
+		}
+		avg := "?"
+		if int(s.Average) < len(sampleAvgNames) {
+			avg = sampleAvgNames[s.Average]
+		}
+		state := "idle"
+		if s.Enabled {
+			state = "enabled"
+		}
+		fmt.Fprintf(w, "  step %d  AIN%d  %s  average %s  %s\n", s.Step, s.Input, mode, avg, state)
+		if s.Input != s.Step {
+			fmt.Fprintf(w, "    expected AIN%d\n", s.Step)
+		}
+	}
+
+	fmt.Fprintln(w, "PWM:")
+	for i, ch := range conf.Channels {
+		if !pwmLoaded || !pinLoaded[i] {
+			fmt.Fprintf(w, "  step %d  %s  no overlay\n", i, ch.PWM)
+			continue
+		}
+		line, err := openPWM(ch.PWM)
+		if err != nil {
+			fmt.Fprintf(w, "  step %d  %s  could not open: %s\n", i, ch.PWM, err)
+			continue
+		}
+		period, duty := line.GetPWM()
+		fmt.Fprintf(w, "  step %d  %s  period %v  duty %v\n", i, ch.PWM, period, duty)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kernels after 3.8 have no cape manager and no pwm_test devices. The
+// overlays are applied at boot and each PWM module is a chip under
+// /sys/class/pwm, numbered in probe order, with a directory per exported
+// channel.
+const (
+	pwmClassDir = "/sys/class/pwm"
+	// pin muxing by the cape-universal overlay of current images
+	pinmuxStatePath = "/sys/devices/platform/ocp/ocp:%s_pinmux/state"
+	// the light sensor input, through the IIO ADC driver
+	ainClassPath = "/sys/bus/iio/devices/iio:device0/in_voltage4_raw"
+	// how long udev gets to create an exported channel's files
+	pwmExportWait = time.Second
+)
+
+// classChannel locates a header pin's PWM: the base address of its
+// module, which names the chip's device, and the channel on the chip.
+type classChannel struct {
+	addr    string
+	channel int
+}
+
+var classChannels = map[string]classChannel{
+	// EHRPWM0
+	"P9_22": {"48300200", 0}, "P9_31": {"48300200", 0},
+	"P9_21": {"48300200", 1}, "P9_29": {"48300200", 1},
+	// EHRPWM1
+	"P9_14": {"48302200", 0}, "P8_36": {"48302200", 0},
+	"P9_16": {"48302200", 1}, "P8_34": {"48302200", 1},
+	// EHRPWM2
+	"P8_19": {"48304200", 0}, "P8_45": {"48304200", 0},
+	"P8_13": {"48304200", 1}, "P8_46": {"48304200", 1},
+	// eCAP0 and eCAP2
+	"P9_42": {"48300100", 0},
+	"P9_28": {"48304100", 0},
+}
+
+// pwmClass selects classPWM over the 3.8 kernel's overlays and
+// bbhw.PWMLine. Set from -pwm-sysfs before the lines are opened.
+var pwmClass bool
+
+// detectPWMClass reports whether the running kernel has the PWM class
+// layout: no cape manager, and PWM chips under /sys/class/pwm.
+func detectPWMClass() bool {
+	if found, _ := filepath.Glob(slotsGlob); len(found) > 0 {
+		return false
+	}
+	chips, _ := filepath.Glob(filepath.Join(pwmClassDir, "pwmchip*"))
+	return len(chips) > 0
+}
+
+// classPWM drives a PWM channel through /sys/class/pwm. Like
+// bbhw.PWMLine it has no errors to return; the first failed write is
+// logged and later ones are not.
+type classPWM struct {
+	pin     string
+	dir     string        // the exported channel, e.g. /sys/class/pwm/pwmchip3/pwm0
+	period  time.Duration // as last written, to order the writes
+	enabled bool
+	failed  bool
+}
+
+// newClassPWM muxes pin to its PWM, if the image muxes pins through
+// sysfs, finds its chip and exports the channel.
+func newClassPWM(pin string) (*classPWM, error) {
+	ch, ok := classChannels[pin]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a PWM pin", pin)
+	}
+	state := fmt.Sprintf(pinmuxStatePath, pin)
+	if _, err := os.Stat(state); err == nil {
+		if err := ioutil.WriteFile(state, []byte("pwm"), 0); err != nil {
+			return nil, fmt.Errorf("could not mux %s to PWM: %w", pin, err)
+		}
+	}
+	chip, err := findPWMChip(ch.addr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", pin, err)
+	}
+	dir := filepath.Join(chip, "pwm"+strconv.Itoa(ch.channel))
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(filepath.Join(chip, "export"), []byte(strconv.Itoa(ch.channel)), 0); err != nil {
+			return nil, fmt.Errorf("could not export %s: %w", dir, err)
+		}
+	}
+	// the files appear at once but are only writable once udev has run
+	for deadline := time.Now().Add(pwmExportWait); ; time.Sleep(10 * time.Millisecond) {
+		f, err := os.OpenFile(filepath.Join(dir, "period"), os.O_WRONLY, 0)
+		if err == nil {
+			f.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+	}
+	p := &classPWM{pin: pin, dir: dir}
+	p.period, _ = p.read("period")
+	enable, _ := p.read("enable")
+	p.enabled = enable != 0
+	return p, nil
+}
+
+// findPWMChip returns the chip directory whose device is the PWM module
+// at addr.
+func findPWMChip(addr string) (string, error) {
+	chips, err := filepath.Glob(filepath.Join(pwmClassDir, "pwmchip*"))
+	if err != nil {
+		return "", err
+	}
+	for _, chip := range chips {
+		dev, err := filepath.EvalSymlinks(chip)
+		if err != nil {
+			continue
+		}
+		// e.g. .../48302000.epwmss/48302200.pwm/pwm/pwmchip3
+		for _, elem := range strings.Split(dev, "/") {
+			if strings.HasPrefix(elem, addr+".") {
+				return chip, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no PWM chip for the module at %s in %s; is its overlay applied?", addr, pwmClassDir)
+}
+
+func (p *classPWM) SetPWM(period, duty time.Duration) {
+	if duty > period {
+		duty = period
+	}
+	if period != p.period {
+		// the kernel refuses a duty longer than the period, so clear it
+		// before a shorter period
+		p.write("duty_cycle", 0)
+		p.write("period", int64(period))
+		p.period = period
+	}
+	p.write("duty_cycle", int64(duty))
+	if !p.enabled {
+		p.write("enable", 1)
+		p.enabled = true
+	}
+}
+
+func (p *classPWM) GetPWM() (period, duty time.Duration) {
+	period, _ = p.read("period")
+	if enable, _ := p.read("enable"); enable == 0 {
+		return period, 0
+	}
+	duty, _ = p.read("duty_cycle")
+	return period, duty
+}
+
+// SetPolarity leaves the line disabled, since the kernel only changes
+// polarity then; the next SetPWM enables it.
+func (p *classPWM) SetPolarity(polarity bool) {
+	p.DisablePWM()
+	value := "normal"
+	if !polarity {
+		value = "inversed"
+	}
+	if err := ioutil.WriteFile(filepath.Join(p.dir, "polarity"), []byte(value), 0); err != nil {
+		p.fail(err)
+	}
+}
+
+func (p *classPWM) DisablePWM() {
+	p.write("enable", 0)
+	p.enabled = false
+}
+
+func (p *classPWM) write(name string, value int64) {
+	if err := ioutil.WriteFile(filepath.Join(p.dir, name), []byte(strconv.FormatInt(value, 10)), 0); err != nil {
+		p.fail(err)
+	}
+}
+
+func (p *classPWM) read(name string) (time.Duration, error) {
+	b, err := ioutil.ReadFile(filepath.Join(p.dir, name))
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	return time.Duration(v), err
+}
+
+func (p *classPWM) fail(err error) {
+	if !p.failed {
+		slog.Warn("could not write PWM", "pin", p.pin, "err", err)
+		p.failed = true
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// LED colors a channel may be given in the config
+const (
+	colorRed   = "red"
+	colorGreen = "green"
+	colorBlue  = "blue"
+	colorWhite = "white"
+)
+
+// rgbw holds the intensity of each LED color, 0 to 1.
+type rgbw struct {
+	r, g, b, w float64
+}
+
+// hsvToRGBW converts hue (degrees), saturation and value (0 to 1) plus a
+// white level into LED intensities. The grey part of the color is moved
+// from the red, green and blue LEDs onto the white one, which gives the same
+// light for less current.
+func hsvToRGBW(h, s, v, w float64) rgbw {
+	h = math.Mod(h, 360)
+	if h < 0 {
+		h += 360
+	}
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := v - c
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return rgbw{r + m, g + m, b + m, w}
+}
+
+// Range of the color temperature input. Warmer or cooler requests are
+// clamped.
+const (
+	cctMin = 2000
+	cctMax = 6500
+	// cctRange tries temperatures this far apart, and counts a color
+	// dimmer than cctTolerance as not needed
+	cctStep      = 100
+	cctTolerance = 0.01
+)
+
+// kelvinToRGBW approximates the color of a black body at the given
+// temperature (Tanner Helland's curve fit) at brightness v, 0 to 1. Zero
+// Kelvin turns the LEDs off.
+func kelvinToRGBW(kelvin, v float64) rgbw {
+	if kelvin <= 0 {
+		return rgbw{}
+	}
+	kelvin = math.Max(cctMin, math.Min(cctMax, kelvin))
+	t := kelvin / 100
+
+	var r, g, b float64
+	if t <= 66 {
+		r = 255
+		g = 99.4708025861*math.Log(t) - 161.1195681661
+	} else {
+		r = 329.698727446 * math.Pow(t-60, -0.1332047592)
+		g = 288.1221695283 * math.Pow(t-60, -0.0755148492)
+	}
+	switch {
+	case t >= 66:
+		b = 255
+	case t <= 19:
+		b = 0
+	default:
+		b = 138.5177312231*math.Log(t-10) - 305.0447927307
+	}
+	unit := func(c float64) float64 {
+		return v * math.Max(0, math.Min(255, c)) / 255
+	}
+	return rgbw{unit(r), unit(g), unit(b), 0}
+}
+
+// extractWhite moves the part common to red, green and blue onto white, as
+// far as the white LED has room.
+func (c rgbw) extractWhite() rgbw {
+	grey := math.Min(c.r, math.Min(c.g, c.b))
+	if room := 1 - c.w; grey > room {
+		grey = room
+	}
+	return rgbw{c.r - grey, c.g - grey, c.b - grey, c.w + grey}
+}
+
+// mix shares col out among the LED colors the fixture has: the grey part
+// onto white if there is a white LED, white onto red, green and blue if
+// there is not.
+func (c *Config) mix(col rgbw) rgbw {
+	if !c.hasColor(colorWhite) {
+		// nowhere to move the grey; mix white from RGB instead
+		col.r = math.Min(1, col.r+col.w)
+		col.g = math.Min(1, col.g+col.w)
+		col.b = math.Min(1, col.b+col.w)
+		return col
+	}
+	return col.extractWhite()
+}
+
+// canMix reports whether the fixture has an LED for every color col needs.
+func (c *Config) canMix(col rgbw) bool {
+	col = c.mix(col)
+	for color, f := range map[string]float64{colorRed: col.r, colorGreen: col.g, colorBlue: col.b, colorWhite: col.w} {
+		if f > cctTolerance && !c.hasColor(color) {
+			return false
+		}
+	}
+	return true
+}
+
+// cctRange is the span of color temperatures, within cctMin to cctMax,
+// that the LEDs present can mix: without a blue LED, say, only those warm
+// enough for the white LED to stand in for the blue. ok is false if none
+// can be.
+func (c *Config) cctRange() (lo, hi float64, ok bool) {
+	for k := float64(cctMin); k <= cctMax; k += cctStep {
+		if !c.canMix(kelvinToRGBW(k, 1)) {
+			continue
+		}
+		if !ok {
+			lo, ok = k, true
+		}
+		hi = k
+	}
+	return lo, hi, ok
+}
+
+// colorDuties returns a duty for every channel with a color. Each color's
+// intensity goes through the gamma curve and is scaled to the channel's
+// max_duty, so full red is as bright as the red LED may be.
+func (c *Config) colorDuties(col rgbw) map[byte]time.Duration {
+	col = c.mix(col)
+	duties := make(map[byte]time.Duration)
+	for i, ch := range c.Channels {
+		var f float64
+		switch ch.Color {
+		case colorRed:
+			f = col.r
+		case colorGreen:
+			f = col.g
+		case colorBlue:
+			f = col.b
+		case colorWhite:
+			f = col.w
+		default:
+			continue
+		}
+		duties[byte(i)] = fractionDuty(math.Pow(f, c.Gamma) * ch.MaxDuty)
+	}
+	return duties
+}
+
+func (c *Config) hasColor(color string) bool {
+	for _, ch := range c.Channels {
+		if ch.Color == color {
+			return true
+		}
+	}
+	return false
+}
+
+func validColor(color string) error {
+	switch color {
+	case "", colorRed, colorGreen, colorBlue, colorWhite:
+		return nil
+	}
+	return fmt.Errorf("color must be red, green, blue or white: %s", color)
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config holds the tuning values that installers may want to change in the
+// field without a toolchain. Anything missing from the config file keeps
+// the compiled-in default.
+type Config struct {
+	PWMPeriod duration `json:"pwm_period"` // e.g. "500us"
+	// smallest duty step the PWM hardware can put out; duties are rounded
+	// to it
+	PWMResolution duration `json:"pwm_resolution"`
+	Gamma         float64  `json:"gamma"`    // exponent of the gamma curve
+	AoutOff       int      `json:"aout_off"` // auto mode threshold for OFF
+	AoutOn        int      `json:"aout_on"`  // auto mode threshold for ON
+	// auto mode ends once every pot is below aout_exit, which may be set
+	// below aout_off for hysteresis
+	AoutExit int `json:"aout_exit"`
+	// loops the auto mode gesture must hold before it counts
+	GestureLoops int `json:"gesture_loops"`
+	// smoothed pot readings must move more than this many counts before
+	// the LED follows; 0 follows every change
+	Deadband      float64 `json:"deadband"`
+	AutoLoopMax   int     `json:"auto_loop_max"`
+	AutoOffsetMax int     `json:"auto_offset_max"`
+	// Auto mode random walk: each LED's offset moves auto_offset_delta
+	// counts per step, and its loop and offset bounds are re-drawn every
+	// auto_loop_adjust and auto_offset_adjust.
+	AutoOffsetDelta  int         `json:"auto_offset_delta"`
+	AutoLoopAdjust   duration    `json:"auto_loop_adjust"`
+	AutoOffsetAdjust duration    `json:"auto_offset_adjust"`
+	LoopSpeeds       []loopSpeed `json:"loop_speeds"`
+	// -automode dark: how far down the walk's bounds are shifted, as a
+	// fraction of the offset max, 0 for the symmetric walk to 1 for one
+	// that never rises above the pot
+	AutoSkew float64 `json:"auto_skew"`
+	// One entry per LED color, in ADC step order: channel i is
+	// controlled by the pot on ainPins[i].
+	Channels []channelConfig `json:"channels"`
+	// roles of the pots on the analog inputs after the channels', e.g.
+	// ["speed"]
+	AuxPots []string `json:"aux_pots"`
+	Scenes  []Scene  `json:"scenes"`
+	// brightness curve: gamma, linear, quadratic or table, the last read
+	// from the CSV file curve_table
+	Curve      string `json:"curve"`
+	CurveTable string `json:"curve_table"`
+	// How the total current limit holds the sum of the duties down:
+	// proportional scales them all by the same factor once the sum is over
+	// the limit, compressor from limiter_knee of the limit up, softly.
+	Limiter     string  `json:"limiter"`
+	LimiterKnee float64 `json:"limiter_knee"`
+	// length of one -breathe cycle
+	BreathePeriod duration `json:"breathe_period"`
+	// rate of the LFO in hz, or with an lfo aux pot the range it sweeps
+	LFOHz    float64 `json:"lfo_hz"`
+	LFOMinHz float64 `json:"lfo_min_hz"`
+	LFOMaxHz float64 `json:"lfo_max_hz"`
+	// Operating range of the brightness curve's output, as fractions of the
+	// period: never brighter than output_max, never darker than
+	// output_min. Trim and the other scales apply after.
+	OutputMin float64 `json:"output_min"`
+	OutputMax float64 `json:"output_max"`
+	// ADC range, 0 to 4095, programmed into ADCRANGE. A raw reading at or
+	// beyond either end counts as clipped in /status and the metrics.
+	ADCRangeMin int `json:"adc_range_min"`
+	ADCRangeMax int `json:"adc_range_max"`
+	// -ambient scales all duties between these, dark to daylight
+	AmbientMin float64 `json:"ambient_min"`
+	AmbientMax float64 `json:"ambient_max"`
+	// -thermal throttling: the total current limit falls from full at
+	// thermal_start to thermal_min_scale of it at thermal_max, in Celsius
+	ThermalStart    float64 `json:"thermal_start"`
+	ThermalMax      float64 `json:"thermal_max"`
+	ThermalMinScale float64 `json:"thermal_min_scale"`
+	// -automode chase: how long each LED holds the chase per unit of the
+	// speed pot's loop max, and how far into the next LED's turn it stays
+	// lit, as a fraction of that
+	ChaseDwell   duration `json:"chase_dwell"`
+	ChaseOverlap float64  `json:"chase_overlap"`
+	// crossfade time for scenes triggered without their own
+	SceneFade duration `json:"scene_fade"`
+	// how scene crossfades move: linear, ease-in, ease-out, ease-in-out or
+	// log, for scenes without their own
+	SceneEasing string `json:"scene_easing"`
+	// scene_easing looked up by validate, so nothing fails on it once the
+	// LEDs are lit
+	sceneEase Easing
+}
+
+// channelConfig describes the LED on one ADC step.
+type channelConfig struct {
+	PWM string `json:"pwm"` // PWM header pin, e.g. "P9_14"
+	// Duty ceiling as a fraction of the period, for fixtures that mix high
+	// and low power LEDs.
+	MaxDuty float64 `json:"max_duty"`
+	// Least duty, as a fraction of the period, that a lit LED is given.
+	// Dimmer requests snap up to it; pot positions at or below aout_off
+	// turn the LED fully off.
+	MinDuty float64 `json:"min_duty"`
+	// Pot travel measured by -calibrate. Readings are rescaled from
+	// aout_min-aout_max onto the full scale; aout_max 0 means 4095.
+	AoutMin int `json:"aout_min"`
+	AoutMax int `json:"aout_max"`
+	// LED color, for POST /color: red, green, blue, white or empty
+	Color string `json:"color"`
+	// what logs and the APIs call the channel; defaults to its color
+	Name string `json:"name,omitempty"`
+	// Wiring. invert_polarity flips the PWM hardware polarity; invert
+	// writes period - duty instead, e.g. for common anode LEDs.
+	InvertPolarity bool `json:"invert_polarity"`
+	Invert         bool `json:"invert"`
+	// where this LED is in its -breathe cycle, as a fraction of the cycle,
+	// so colors can breathe out of step
+	BreathePhase float64 `json:"breathe_phase"`
+	// Modulation by the LFO: sine, triangle, square or ramp, or empty for
+	// none. lfo_depth, 0 to 1, is how far below the pot's level the wave
+	// dips, and lfo_phase shifts the channel along the cycle, as a
+	// fraction of it.
+	LFO      string  `json:"lfo"`
+	LFODepth float64 `json:"lfo_depth"`
+	LFOPhase float64 `json:"lfo_phase"`
+	// Color balance: a fixed factor, 0 to 1, applied to every duty after
+	// the curve and before the current limit. Left out means 1.
+	Trim *float64 `json:"trim,omitempty"`
+	// Slew limit: the most the duty may change in one loop, as a fraction
+	// of the period, so a yanked pot ramps instead of jumping. 0 for none.
+	Slew float64 `json:"slew"`
+	// Out of service, e.g. unwired or broken: the pot is still read, but
+	// the LED stays off; POST /disable/{step} does the same at runtime.
+	Disabled bool `json:"disabled"`
+}
+
+// polarity is the value given to SetPolarity for the channel.
+func (ch channelConfig) polarity() bool {
+	return !ch.InvertPolarity
+}
+
+// loopSpeed is one step of the staircase translating the speed pot into an
+// auto loop max size. A speed pot reading below MaxAout selects LoopMax.
+type loopSpeed struct {
+	MaxAout float64 `json:"max_aout"`
+	LoopMax int     `json:"loop_max"`
+}
+
+// duration reads a time.Duration from a JSON string such as "500us".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"500us\": %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// the settings in use; replaced at startup when -config is given
+var conf = defaultConfig()
+
+// The main loop is the only goroutine that replaces conf, between loops on
+// a reload, so it reads conf directly. Every other goroutine takes it with
+// currentConfig.
+var confMu sync.RWMutex
+
+func currentConfig() *Config {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	return conf
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		PWMPeriod:        duration{pwmPeriod},
+		PWMResolution:    duration{pwmResolution},
+		Gamma:            gamma,
+		AoutOff:          aoutOff,
+		AoutOn:           aoutOn,
+		AoutExit:         aoutOff,
+		GestureLoops:     gestureLoops,
+		AutoLoopMax:      autoLoopMax,
+		AutoOffsetMax:    autoOffsetMax,
+		AutoOffsetDelta:  autoOffsetDelta,
+		AutoLoopAdjust:   duration{autoLoopAdjust},
+		AutoOffsetAdjust: duration{autoOffsetAdjust},
+		AutoSkew:         0.8,
+		LoopSpeeds: []loopSpeed{
+			{20, 1024}, // lowest speed
+			{60, 512},
+			{130, 256},
+			{200, 128},
+			{400, 64},
+			{800, 32},
+			{1200, 16},
+			{2000, 8},
+			{3500, 4},
+			{4090, 2},
+			{ainLevels, 1}, // highest speed
+		},
+		// adjusted LEDs to mirror RGBW on my potentiometer test board
+		Channels: []channelConfig{
+			{PWM: "P9_16", MaxDuty: 1, Color: colorWhite},
+			{PWM: "P9_14", MaxDuty: 1, Color: colorGreen},
+			{PWM: "P9_22", MaxDuty: 1, Color: colorBlue},
+			{PWM: "P9_21", MaxDuty: 1, Color: colorRed},
+		},
+		SceneFade:       duration{time.Second},
+		SceneEasing:     "linear",
+		sceneEase:       easings["linear"],
+		Curve:           curveGamma,
+		Limiter:         limiterProportional,
+		LimiterKnee:     0.8,
+		BreathePeriod:   duration{4 * time.Second},
+		LFOHz:           0.5,
+		LFOMinHz:        0.05,
+		LFOMaxHz:        10,
+		OutputMax:       1,
+		ADCRangeMax:     ADCRANGE_MAX_RANGE,
+		AmbientMin:      0.2,
+		AmbientMax:      1,
+		ThermalStart:    60,
+		ThermalMax:      80,
+		ThermalMinScale: 0.3,
+		ChaseDwell:      duration{10 * time.Millisecond},
+		ChaseOverlap:    0.2,
+	}
+}
+
+// loadConfig reads a JSON config file over the defaults and validates the result.
+func loadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := defaultConfig()
+	// a misspelt key would otherwise be ignored without a word
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// BeagleBone Black header pins with a bone_pwm overlay on the 3.8 kernel.
+// The P8 pins only drive an LED through /sys/class/pwm; see classChannels.
+var pwmPins = map[string]bool{
+	"P9_14": true, "P9_16": true, "P9_21": true, "P9_22": true, "P9_28": true, "P9_29": true,
+	"P9_31": true, "P9_42": true,
+}
+
+// isPWMPin reports whether pin can drive an LED in the PWM sysfs layout in
+// use.
+func isPWMPin(pin string) bool {
+	if pwmClass {
+		_, ok := classChannels[pin]
+		return ok
+	}
+	return pwmPins[pin]
+}
+
+// pwmPinList lists the pins isPWMPin accepts in order, for error messages.
+func pwmPinList() string {
+	var pins []string
+	for pin := range classChannels {
+		if isPWMPin(pin) {
+			pins = append(pins, pin)
+		}
+	}
+	sort.Strings(pins)
+	return strings.Join(pins, ", ")
+}
+
+// configErrors is every problem validate found, so a config with several
+// mistakes can be fixed in one go rather than one restart at a time.
+type configErrors []error
+
+func (e configErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	if len(e) == 1 {
+		return msgs[0]
+	}
+	return fmt.Sprintf("%d problems: %s", len(e), strings.Join(msgs, "; "))
+}
+
+func (c *Config) validate() error {
+	var errs configErrors
+	if c.PWMPeriod.Duration < pwmPeriodMin || c.PWMPeriod.Duration > pwmPeriodMax {
+		errs = append(errs, fmt.Errorf("pwm_period must be %s to %s: %s", pwmPeriodMin, pwmPeriodMax, c.PWMPeriod))
+	}
+	if c.PWMResolution.Duration < 1 || c.PWMResolution.Duration >= c.PWMPeriod.Duration {
+		errs = append(errs, fmt.Errorf("pwm_resolution must be at least 1ns and below pwm_period: %s", c.PWMResolution))
+	}
+	if c.ChaseDwell.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("chase_dwell must be positive: %s", c.ChaseDwell))
+	}
+	if c.ChaseOverlap < 0 || c.ChaseOverlap >= 1 {
+		errs = append(errs, fmt.Errorf("chase_overlap must be at least 0 and below 1: %v", c.ChaseOverlap))
+	}
+	if c.OutputMin < 0 || c.OutputMax > 1 || c.OutputMin >= c.OutputMax {
+		errs = append(errs, fmt.Errorf("need 0 <= output_min < output_max <= 1: output_min %v, output_max %v", c.OutputMin, c.OutputMax))
+	}
+	if c.ADCRangeMin < ADCRANGE_MIN_RANGE || c.ADCRangeMax > ADCRANGE_MAX_RANGE || c.ADCRangeMin >= c.ADCRangeMax {
+		errs = append(errs, fmt.Errorf("need %d <= adc_range_min < adc_range_max <= %d: adc_range_min %d, adc_range_max %d", ADCRANGE_MIN_RANGE, ADCRANGE_MAX_RANGE, c.ADCRangeMin, c.ADCRangeMax))
+	}
+	if c.Gamma <= 0 {
+		errs = append(errs, fmt.Errorf("gamma must be positive: %v", c.Gamma))
+	}
+	if c.AoutOff < 0 || c.AoutOn >= ainLevels || c.AoutOff >= c.AoutOn {
+		errs = append(errs, fmt.Errorf("need 0 <= aout_off < aout_on < %d: aout_off %d, aout_on %d", ainLevels, c.AoutOff, c.AoutOn))
+	}
+	if c.AoutExit < 0 || c.AoutExit >= c.AoutOn {
+		errs = append(errs, fmt.Errorf("need 0 <= aout_exit < aout_on: aout_exit %d, aout_on %d", c.AoutExit, c.AoutOn))
+	}
+	if c.GestureLoops < 1 {
+		errs = append(errs, fmt.Errorf("gesture_loops must be at least 1: %d", c.GestureLoops))
+	}
+	if c.Deadband < 0 || c.Deadband >= ainLevels/2 {
+		errs = append(errs, fmt.Errorf("deadband must be 0 to %d: %v", ainLevels/2-1, c.Deadband))
+	}
+	if c.AutoLoopMax < 1 {
+		errs = append(errs, fmt.Errorf("auto_loop_max must be at least 1: %d", c.AutoLoopMax))
+	}
+	if c.AutoOffsetMax < 1 {
+		errs = append(errs, fmt.Errorf("auto_offset_max must be at least 1: %d", c.AutoOffsetMax))
+	}
+	if c.AutoOffsetDelta < 1 || c.AutoOffsetDelta >= c.AutoOffsetMax {
+		errs = append(errs, fmt.Errorf("auto_offset_delta must be at least 1 and below auto_offset_max %d: %d", c.AutoOffsetMax, c.AutoOffsetDelta))
+	}
+	if c.AutoLoopAdjust.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("auto_loop_adjust must be positive: %s", c.AutoLoopAdjust))
+	}
+	if c.AutoOffsetAdjust.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("auto_offset_adjust must be positive: %s", c.AutoOffsetAdjust))
+	}
+	if c.AutoSkew < 0 || c.AutoSkew > 1 {
+		errs = append(errs, fmt.Errorf("auto_skew must be 0 to 1: %v", c.AutoSkew))
+	}
+	if len(c.LoopSpeeds) == 0 {
+		errs = append(errs, fmt.Errorf("loop_speeds must not be empty"))
+	}
+	for i, s := range c.LoopSpeeds {
+		if s.LoopMax < 1 {
+			errs = append(errs, fmt.Errorf("loop_speeds[%d]: loop_max must be at least 1: %d", i, s.LoopMax))
+		}
+		if i > 0 && s.MaxAout <= c.LoopSpeeds[i-1].MaxAout {
+			errs = append(errs, fmt.Errorf("loop_speeds[%d]: max_aout must increase: %v after %v", i, s.MaxAout, c.LoopSpeeds[i-1].MaxAout))
+		}
+		// turning the speed pot up must never slow auto mode down
+		if i > 0 && s.LoopMax > c.LoopSpeeds[i-1].LoopMax {
+			errs = append(errs, fmt.Errorf("loop_speeds[%d]: loop_max must not increase: %d after %d", i, s.LoopMax, c.LoopSpeeds[i-1].LoopMax))
+		}
+	}
+	if len(c.Channels) < 1 || len(c.Channels) > len(ainPins) {
+		errs = append(errs, fmt.Errorf("need 1 to %d channels: %d", len(ainPins), len(c.Channels)))
+	}
+	if err := validAuxPots(c.AuxPots, len(c.Channels)); err != nil {
+		errs = append(errs, err)
+	}
+	pwms := make(map[string]bool)
+	colors := make(map[string]bool)
+	channelNames := make(map[string]bool)
+	for i, ch := range c.Channels {
+		name := c.channelName(byte(i))
+		if channelNames[name] {
+			errs = append(errs, fmt.Errorf("channels[%d]: name %s used twice", i, name))
+		}
+		channelNames[name] = true
+		if ch.PWM == "" {
+			errs = append(errs, fmt.Errorf("channels[%d]: pwm pin missing", i))
+		} else if _, ok := classChannels[ch.PWM]; ok && !isPWMPin(ch.PWM) {
+			errs = append(errs, fmt.Errorf("channels[%d]: %s needs the /sys/class/pwm layout, or -pwm-sysfs class; use one of %s", i, ch.PWM, pwmPinList()))
+		} else if !ok {
+			errs = append(errs, fmt.Errorf("channels[%d]: %s is not a PWM pin; use one of %s", i, ch.PWM, pwmPinList()))
+		}
+		if pwms[ch.PWM] {
+			errs = append(errs, fmt.Errorf("channels[%d]: pwm pin %s used twice", i, ch.PWM))
+		}
+		pwms[ch.PWM] = true
+		if ch.MaxDuty <= 0 || ch.MaxDuty > 1 {
+			errs = append(errs, fmt.Errorf("channels[%d]: max_duty must be above 0 and at most 1: %v", i, ch.MaxDuty))
+		}
+		if ch.MinDuty < 0 || ch.MinDuty >= ch.MaxDuty {
+			errs = append(errs, fmt.Errorf("channels[%d]: min_duty must be at least 0 and below max_duty: %v", i, ch.MinDuty))
+		}
+		if min, max := ch.aoutRange(); min < 0 || max > ainLevels-1 || min >= max {
+			errs = append(errs, fmt.Errorf("channels[%d]: need 0 <= aout_min < aout_max < %d: aout_min %d, aout_max %d", i, ainLevels, min, max))
+		}
+		if ch.Slew < 0 || ch.Slew > 1 {
+			errs = append(errs, fmt.Errorf("channels[%d]: slew must be 0 to 1: %v", i, ch.Slew))
+		}
+		if ch.Trim != nil && (*ch.Trim < 0 || *ch.Trim > 1) {
+			errs = append(errs, fmt.Errorf("channels[%d]: trim must be 0 to 1: %v", i, *ch.Trim))
+		}
+		if ch.BreathePhase < 0 || ch.BreathePhase >= 1 {
+			errs = append(errs, fmt.Errorf("channels[%d]: breathe_phase must be at least 0 and below 1: %v", i, ch.BreathePhase))
+		}
+		if err := validLFO(ch.LFO); err != nil {
+			errs = append(errs, fmt.Errorf("channels[%d]: %s", i, err))
+		}
+		if ch.LFO != "" && (ch.LFODepth <= 0 || ch.LFODepth > 1) {
+			errs = append(errs, fmt.Errorf("channels[%d]: lfo_depth must be above 0 and at most 1: %v", i, ch.LFODepth))
+		}
+		if ch.LFOPhase < 0 || ch.LFOPhase >= 1 {
+			errs = append(errs, fmt.Errorf("channels[%d]: lfo_phase must be at least 0 and below 1: %v", i, ch.LFOPhase))
+		}
+		if err := validColor(ch.Color); err != nil {
+			errs = append(errs, fmt.Errorf("channels[%d]: %s", i, err))
+		}
+		if ch.Color != "" && colors[ch.Color] {
+			errs = append(errs, fmt.Errorf("channels[%d]: color %s used twice", i, ch.Color))
+		}
+		colors[ch.Color] = true
+	}
+	if c.Curve == curveTable && c.CurveTable == "" {
+		errs = append(errs, fmt.Errorf("curve table needs curve_table"))
+	}
+	if c.Limiter != limiterProportional && c.Limiter != limiterCompressor {
+		errs = append(errs, fmt.Errorf("limiter must be %s or %s: %q", limiterProportional, limiterCompressor, c.Limiter))
+	}
+	if c.LimiterKnee <= 0 || c.LimiterKnee >= 1 {
+		errs = append(errs, fmt.Errorf("limiter_knee must be above 0 and below 1: %v", c.LimiterKnee))
+	}
+	if c.BreathePeriod.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("breathe_period must be positive: %s", c.BreathePeriod))
+	}
+	if c.LFOHz <= 0 || c.LFOMinHz <= 0 || c.LFOMinHz >= c.LFOMaxHz {
+		errs = append(errs, fmt.Errorf("need 0 < lfo_hz and 0 < lfo_min_hz < lfo_max_hz: lfo_hz %v, lfo_min_hz %v, lfo_max_hz %v", c.LFOHz, c.LFOMinHz, c.LFOMaxHz))
+	}
+	if c.AmbientMin < 0 || c.AmbientMax > 1 || c.AmbientMin > c.AmbientMax {
+		errs = append(errs, fmt.Errorf("need 0 <= ambient_min <= ambient_max <= 1: ambient_min %v, ambient_max %v", c.AmbientMin, c.AmbientMax))
+	}
+	if ease, err := findEasing(c.SceneEasing); err != nil {
+		errs = append(errs, fmt.Errorf("scene_easing: %s", err))
+	} else {
+		c.sceneEase = ease
+	}
+	if c.ThermalStart >= c.ThermalMax {
+		errs = append(errs, fmt.Errorf("thermal_start must be below thermal_max: %v, %v", c.ThermalStart, c.ThermalMax))
+	}
+	if c.ThermalMinScale < 0 || c.ThermalMinScale > 1 {
+		errs = append(errs, fmt.Errorf("thermal_min_scale must be 0 to 1: %v", c.ThermalMinScale))
+	}
+	if c.SceneFade.Duration < 0 {
+		errs = append(errs, fmt.Errorf("scene_fade must not be negative: %s", c.SceneFade))
+	}
+	names := make(map[string]bool)
+	for i, s := range c.Scenes {
+		if err := s.validate(len(c.Channels)); err != nil {
+			errs = append(errs, fmt.Errorf("scenes[%d]: %s", i, err))
+		}
+		if names[s.Name] {
+			errs = append(errs, fmt.Errorf("scenes[%d]: name %s used twice", i, s.Name))
+		}
+		names[s.Name] = true
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// maxDuty is the most duty the LED on step may be given.
+func (c *Config) maxDuty(step byte) time.Duration {
+	return time.Duration(c.Channels[step].MaxDuty * float64(c.PWMPeriod.Duration))
+}
+
+// potCount is how many analog inputs are read: the channels' pots and then
+// the aux pots.
+func (c *Config) potCount() int {
+	return len(c.Channels) + len(c.AuxPots)
+}
+
+// channelName is what the channel on step is called: its name, else its
+// color, else its step.
+func (c *Config) channelName(step byte) string {
+	ch := c.Channels[step]
+	switch {
+	case ch.Name != "":
+		return ch.Name
+	case ch.Color != "":
+		return ch.Color
+	}
+	return fmt.Sprint("step", step)
+}
+
+// trim is the color balance factor for step, 1 unless set.
+func (c *Config) trim(step byte) float64 {
+	if t := c.Channels[step].Trim; t != nil {
+		return *t
+	}
+	return 1
+}
+
+// minDuty is the floor for a lit LED on step.
+func (c *Config) minDuty(step byte) time.Duration {
+	return time.Duration(c.Channels[step].MinDuty * float64(c.PWMPeriod.Duration))
+}
+
+// clipped reports whether a raw reading is at or beyond the ADC range.
+func (c *Config) clipped(aout int) bool {
+	return aout <= c.ADCRangeMin || aout >= c.ADCRangeMax
+}
+
+// outputRange is output_min and output_max as duties.
+func (c *Config) outputRange() (min, max time.Duration) {
+	period := float64(c.PWMPeriod.Duration)
+	return time.Duration(c.OutputMin * period), time.Duration(c.OutputMax * period)
+}
+
+// clampOutput keeps a duty from the brightness curve within the output
+// range.
+func (c *Config) clampOutput(duty time.Duration) time.Duration {
+	min, max := c.outputRange()
+	if duty < min {
+		return min
+	}
+	if duty > max {
+		return max
+	}
+	return duty
+}
+
+// slew is the most the duty on step may change in one loop; 0 for no limit.
+func (c *Config) slew(step byte) time.Duration {
+	return time.Duration(c.Channels[step].Slew * float64(c.PWMPeriod.Duration))
+}
+
+// maxTotalDuty limits the summed duty of all LEDs so the fixture stays
+// within maxTotalCurrent.
+func (c *Config) maxTotalDuty() time.Duration {
+	return c.PWMPeriod.Duration * maxTotalCurrent / maxLEDCurrent
+}
+
+// the limiter modes
+const (
+	limiterProportional = "proportional"
+	limiterCompressor   = "compressor"
+)
+
+// limiterKnee is the knee normalize is given: limiter_knee for the
+// compressor, 1 for a hard proportional cut.
+func (c *Config) limiterKnee() float64 {
+	if c.Limiter == limiterCompressor {
+		return c.LimiterKnee
+	}
+	return 1
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// usePWMClass sets the PWM sysfs layout for the rest of the test.
+func usePWMClass(t *testing.T, class bool) {
+	t.Helper()
+	prev := pwmClass
+	pwmClass = class
+	t.Cleanup(func() { pwmClass = prev })
+}
+
+// TestLoadConfigErrors loads malformed configs and checks each is turned
+// down with every one of its problems named. The P8 pins need the
+// /sys/class/pwm layout, which TestPWMPinLayout covers.
+func TestLoadConfigErrors(t *testing.T) {
+	usePWMClass(t, true)
+	tests := []struct {
+		name     string
+		json     string
+		problems int // in the configErrors; 0 for a decoding error
+		want     []string
+	}{
+		{"zero gamma", `{"gamma": 0}`, 1, []string{"gamma must be positive: 0"}},
+		{"negative gamma", `{"gamma": -2.2}`, 1, []string{"gamma must be positive: -2.2"}},
+		{"no channels", `{"channels": []}`, 1, []string{"need 1 to 7 channels: 0"}},
+		{"too many channels", `{"channels": [
+			{"pwm": "P8_13", "max_duty": 1}, {"pwm": "P8_19", "max_duty": 1},
+			{"pwm": "P8_34", "max_duty": 1}, {"pwm": "P8_36", "max_duty": 1},
+			{"pwm": "P8_45", "max_duty": 1}, {"pwm": "P8_46", "max_duty": 1},
+			{"pwm": "P9_14", "max_duty": 1}, {"pwm": "P9_16", "max_duty": 1}]}`,
+			2, []string{
+				"need 1 to 7 channels: 8",
+				"8 channels and 0 aux_pots need more than the 7 analog inputs",
+			}},
+		{"channel out of range", `{"channels": [
+			{"pwm": "P9_16", "max_duty": 1.5, "aout_min": 100, "aout_max": 5000}]}`,
+			2, []string{
+				"channels[0]: max_duty must be above 0 and at most 1: 1.5",
+				"channels[0]: need 0 <= aout_min < aout_max < 4096: aout_min 100, aout_max 5000",
+			}},
+		{"channel not a PWM pin", `{"channels": [{"pwm": "P9_12", "max_duty": 1}]}`,
+			1, []string{"channels[0]: P9_12 is not a PWM pin"}},
+		{"trim out of range", `{"channels": [
+			{"pwm": "P9_16", "max_duty": 1, "trim": 1.2}, {"pwm": "P9_14", "max_duty": 1, "trim": -0.1}]}`,
+			2, []string{"channels[0]: trim must be 0 to 1: 1.2", "channels[1]: trim must be 0 to 1: -0.1"}},
+		{"several", `{"gamma": 0, "pwm_period": "5ms", "limiter": "soft", "channels": [
+			{"pwm": "P9_16", "max_duty": 1, "slew": 2}]}`,
+			4, []string{
+				"4 problems: ",
+				"pwm_period must be 50µs to 1ms: 5ms",
+				"gamma must be positive: 0",
+				"channels[0]: slew must be 0 to 1: 2",
+				`limiter must be proportional or compressor: "soft"`,
+			}},
+		{"misspelt key", `{"gama": 2.2}`, 0, []string{`unknown field "gama"`}},
+		{"not JSON", `{"gamma": }`, 0, []string{"invalid character"}},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "config.json")
+			if err := ioutil.WriteFile(path, []byte(tt.json), 0644); err != nil {
+				t.Fatal(err)
+			}
+			c, err := loadConfig(path)
+			if err == nil {
+				t.Fatalf("loaded %+v", c)
+			}
+			var errs configErrors
+			if errors.As(err, &errs) != (tt.problems > 0) || len(errs) != tt.problems {
+				t.Errorf("%d problems, want %d: %v", len(errs), tt.problems, err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not say %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"gamma": 1.8, "limiter": "compressor", "scene_easing": "ease-in"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Gamma != 1.8 || c.Limiter != limiterCompressor {
+		t.Errorf("gamma %v, limiter %q", c.Gamma, c.Limiter)
+	}
+	// looked up while loading, not once the LEDs are lit
+	if c.sceneEase == nil || c.sceneEase(0.5) != easings["ease-in"](0.5) {
+		t.Error("scene_easing ease-in not looked up")
+	}
+	// the rest are the defaults
+	if len(c.Channels) != len(defaultConfig().Channels) {
+		t.Errorf("%d channels, want the default %d", len(c.Channels), len(defaultConfig().Channels))
+	}
+}
+
+// TestPWMPinLayout checks the P8 pins are only taken with the
+// /sys/class/pwm layout, the only one that can drive them.
+func TestPWMPinLayout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"channels": [{"pwm": "P8_13", "max_duty": 1}, {"pwm": "P9_14", "max_duty": 1}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	usePWMClass(t, false)
+	_, err := loadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "channels[0]: P8_13 needs the /sys/class/pwm layout") {
+		t.Errorf("P8_13 with the cape manager: %v", err)
+	} else if strings.Count(err.Error(), "P8_") != 1 {
+		t.Errorf("P8 pins offered with the cape manager: %v", err)
+	}
+	usePWMClass(t, true)
+	if _, err := loadConfig(path); err != nil {
+		t.Errorf("P8_13 with /sys/class/pwm: %v", err)
+	}
+}
+
+// TestReloadFlags checks a reload checks the config again once -gamma
+// overrides the file's.
+func TestReloadFlags(t *testing.T) {
+	useConfig(t, defaultConfig())
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"gamma": 1.8}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	prevPath, prevGamma := *configPath, *gammaFlag
+	t.Cleanup(func() { *configPath, *gammaFlag = prevPath, prevGamma })
+	*configPath, *gammaFlag = path, -1
+	if err := requestReload(); err == nil || !strings.Contains(err.Error(), "gamma must be positive: -1") {
+		t.Errorf("reload with -gamma -1: %v", err)
+	}
+	if c, _ := pendingReload(); c != nil {
+		t.Error("bad reload queued")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// brightness curves, chosen with curve in the config
+const (
+	curveGamma     = "gamma"     // aout^gamma, the default
+	curveLinear    = "linear"    // aout
+	curveQuadratic = "quadratic" // aout^2
+	curveTable     = "table"     // breakpoints from curve_table
+)
+
+// A Curve maps a pot reading, 0 to 4095, onto a PWM duty.
+type Curve interface {
+	Duty(aout float64) time.Duration
+}
+
+// the curve in use; set at startup from the config and replaced with it
+// on a reload, under confMu. Goroutines other than the main loop take it
+// with currentCurve.
+var brightness Curve
+
+func currentCurve() Curve {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	return brightness
+}
+
+// curveScale turns a fraction of the period into a duty, short of the full
+// period, for the config a curve was built from, so a curve does not
+// depend on the config in use when it is asked.
+type curveScale struct {
+	period, ceiling float64
+}
+
+func newCurveScale(c *Config) curveScale {
+	return curveScale{float64(c.PWMPeriod.Duration), float64(c.PWMPeriod.Duration - c.PWMResolution.Duration)}
+}
+
+func (s curveScale) duty(f float64) time.Duration {
+	return time.Duration(math.Min(f*s.period, s.ceiling))
+}
+
+// powerCurve raises the pot level to a power, so that equal turns of the
+// pot look like equal changes in brightness.
+type powerCurve struct {
+	exp float64
+	curveScale
+}
+
+func (c powerCurve) Duty(aout float64) time.Duration {
+	level := math.Max(aout, 0) / (ainLevels - 1)
+	return c.duty(math.Pow(level, c.exp))
+}
+
+// curvePoint is one breakpoint of a table curve: a pot reading and the duty
+// for it as a fraction of the period.
+type curvePoint struct {
+	aout, duty float64
+}
+
+// tableCurve interpolates linearly between measured breakpoints. Readings
+// outside the table get the duty of the nearest end.
+type tableCurve struct {
+	points []curvePoint // by increasing aout
+	curveScale
+}
+
+func (c tableCurve) Duty(aout float64) time.Duration {
+	p := c.points
+	i := sort.Search(len(p), func(i int) bool { return p[i].aout >= aout })
+	var f float64
+	switch {
+	case i == 0:
+		f = p[0].duty
+	case i == len(p):
+		f = p[len(p)-1].duty
+	default:
+		lo, hi := p[i-1], p[i]
+		f = lo.duty + (hi.duty-lo.duty)*(aout-lo.aout)/(hi.aout-lo.aout)
+	}
+	return c.duty(f)
+}
+
+// capDuty keeps a duty in nanoseconds short of the full period.
+func capDuty(duty float64) time.Duration {
+	// theoretical max is the full period but avoid hitting
+	// type Duration int64 as number of nanoseconds
+	return time.Duration(math.Min(duty, float64(conf.PWMPeriod.Duration-conf.PWMResolution.Duration)))
+}
+
+// newCurve builds the curve the config asks for.
+func newCurve(c *Config) (Curve, error) {
+	scale := newCurveScale(c)
+	switch c.Curve {
+	case curveGamma:
+		return powerCurve{c.Gamma, scale}, nil
+	case curveLinear:
+		return powerCurve{1, scale}, nil
+	case curveQuadratic:
+		return powerCurve{2, scale}, nil
+	case curveTable:
+		points, err := loadCurveTable(c.CurveTable)
+		if err != nil {
+			return nil, fmt.Errorf("curve table %s: %s", c.CurveTable, err)
+		}
+		return tableCurve{points, scale}, nil
+	}
+	return nil, fmt.Errorf("unknown curve %q: must be gamma, linear, quadratic or table", c.Curve)
+}
+
+// loadCurveTable reads "aout,duty" rows, duty as a fraction of the period.
+// Lines starting with # are comments, and a header row is skipped.
+func loadCurveTable(path string) ([]curvePoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var points []curvePoint
+	for i, row := range rows {
+		aout, aerr := strconv.ParseFloat(strings.TrimSpace(row[0]), 64)
+		duty, derr := strconv.ParseFloat(strings.TrimSpace(row[1]), 64)
+		if i == 0 && (aerr != nil || derr != nil) {
+			continue // header
+		}
+		if aerr != nil || derr != nil {
+			return nil, fmt.Errorf("row %d: want aout,duty numbers: %s", i+1, strings.Join(row, ","))
+		}
+		if duty < 0 || duty > 1 {
+			return nil, fmt.Errorf("row %d: duty must be 0 to 1: %v", i+1, duty)
+		}
+		if len(points) > 0 && aout <= points[len(points)-1].aout {
+			return nil, fmt.Errorf("row %d: aout must increase: %v", i+1, aout)
+		}
+		points = append(points, curvePoint{aout, duty})
+	}
+	if len(points) < 2 {
+		return nil, fmt.Errorf("need at least 2 breakpoints: %d", len(points))
+	}
+	return points, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Channels taken out of service, e.g. unwired or with a broken LED, by
+// "disabled" in the config or POST /disable/{step}. A disabled channel's
+// pot is still read and shown in /status, but its LED stays off and counts
+// nothing toward the total current limit. The main loop copies the set into
+// the LEDs once per iteration.
+var disabledSteps struct {
+	sync.Mutex
+	steps map[byte]bool
+}
+
+// setDisabled takes a channel out of service or puts it back.
+func setDisabled(step byte, off bool) {
+	disabledSteps.Lock()
+	if disabledSteps.steps == nil {
+		disabledSteps.steps = make(map[byte]bool)
+	}
+	if off {
+		disabledSteps.steps[step] = true
+	} else {
+		delete(disabledSteps.steps, step)
+	}
+	disabledSteps.Unlock()
+}
+
+// disableFromConfig replaces the set with the channels c disables, at
+// startup and on reload.
+func disableFromConfig(c *Config) {
+	disabledSteps.Lock()
+	disabledSteps.steps = make(map[byte]bool)
+	for i, ch := range c.Channels {
+		if ch.Disabled {
+			disabledSteps.steps[byte(i)] = true
+		}
+	}
+	disabledSteps.Unlock()
+}
+
+// applyDisabled copies the set into the LEDs. A channel's line is powered
+// down as it is disabled, unless the LED is inverted and an idle pin would
+// light it, and set up again in full, as after -idle, once it is enabled.
+// A strobe is stopped first, so it cannot light the line again; once the
+// channel is enabled applyStrobes starts it anew.
+func applyDisabled(LEDMap map[byte]*LED, written []time.Duration) {
+	disabledSteps.Lock()
+	defer disabledSteps.Unlock()
+	for step, led := range LEDMap {
+		off := disabledSteps.steps[step]
+		if off == led.disabled {
+			continue
+		}
+		led.disabled = off
+		if off {
+			if led.strobe != nil {
+				led.strobe.halt()
+				led.strobe = nil
+			}
+			if !led.invert {
+				led.pwm.DisablePWM()
+			}
+			slog.Info("channel disabled", "step", step, "name", led.name)
+			continue
+		}
+		led.pwm.SetPolarity(conf.Channels[step].polarity())
+		written[step] = -1
+		slog.Info("channel enabled", "step", step, "name", led.name)
+	}
+}
+
+// POST /disable/{step} takes a channel out of service and DELETE
+// /disable/{step} puts it back. A reload resets them to the config.
+func handleDisable(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/disable/"), 10, 8)
+	if err != nil || n >= uint64(len(currentConfig().Channels)) {
+		writeError(w, "unknown LED step", http.StatusNotFound)
+		return
+	}
+	step := byte(n)
+
+	switch r.Method {
+	case http.MethodPost:
+		setDisabled(step, true)
+		writeJSON(w, map[string]interface{}{"step": step, "disabled": true})
+	case http.MethodDelete:
+		setDisabled(step, false)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
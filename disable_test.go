@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingPWM counts the duties written to it since it was last disabled.
+type recordingPWM struct {
+	mu       sync.Mutex
+	writes   int
+	disabled bool
+}
+
+func (p *recordingPWM) SetPWM(period, duty time.Duration) {
+	p.mu.Lock()
+	p.writes++
+	p.disabled = false
+	p.mu.Unlock()
+}
+
+func (p *recordingPWM) SetPolarity(polarity bool) {}
+
+func (p *recordingPWM) DisablePWM() {
+	p.mu.Lock()
+	p.writes = 0
+	p.disabled = true
+	p.mu.Unlock()
+}
+
+func (p *recordingPWM) state() (writes int, disabled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.writes, p.disabled
+}
+
+// TestDisableStrobing disables a strobing channel and checks the strobe
+// is gone before the line is powered down, so nothing lights it again, and
+// that it starts again once the channel is enabled.
+func TestDisableStrobing(t *testing.T) {
+	useConfig(t, defaultConfig())
+	t.Cleanup(func() {
+		disableFromConfig(conf)
+		setStrobe(0, 0)
+	})
+	disableFromConfig(conf)
+
+	pwm := &recordingPWM{}
+	LEDMap := map[byte]*LED{0: {pwm: pwm}}
+	written := make([]time.Duration, 1)
+	setStrobe(0, 1000)
+	applyStrobes(LEDMap, false)
+	LEDMap[0].strobe.setDuty(pwmPeriod / 2)
+	time.Sleep(5 * time.Millisecond)
+	if writes, _ := pwm.state(); writes == 0 {
+		t.Fatal("strobe wrote nothing")
+	}
+
+	setDisabled(0, true)
+	applyDisabled(LEDMap, written)
+	if LEDMap[0].strobe != nil {
+		t.Error("strobe still set on a disabled channel")
+	}
+	applyStrobes(LEDMap, false)
+	if LEDMap[0].strobe != nil {
+		t.Error("applyStrobes started a strobe on a disabled channel")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if writes, disabled := pwm.state(); writes > 0 || !disabled {
+		t.Errorf("line written %d times after it was disabled", writes)
+	}
+
+	setDisabled(0, false)
+	applyDisabled(LEDMap, written)
+	applyStrobes(LEDMap, false)
+	if LEDMap[0].strobe == nil {
+		t.Fatal("strobe did not start again once the channel was enabled")
+	}
+	LEDMap[0].strobe.halt()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// DMX512 as sent by a lighting desk through an Enttec Open DMX style USB
+// serial dongle: 250k baud, 8N2. Each packet starts with a break, then a
+// start code, then up to 512 one-byte slots.
+const (
+	dmxBaud      = 250000
+	dmxSlots     = 512
+	dmxStartCode = 0x00 // dimmer data; other start codes are ignored
+	dmxMax       = 255
+
+	// termios2 lets us set a baud rate that has no Bxxx constant
+	tcgets2 = 0x802C542A
+	tcsets2 = 0x402C542B
+	cbaud   = 0010017
+	bother  = 0010000
+)
+
+// matches struct termios2 in asm-generic/termbits.h
+type termios2 struct {
+	Iflag, Oflag, Cflag, Lflag uint32
+	Line                       uint8
+	Cc                         [19]uint8
+	Ispeed, Ospeed             uint32
+}
+
+type dmxSource struct {
+	file    *os.File
+	address int // first slot, 1-512
+	count   int // number of LEDs
+	out     chan map[byte]int
+}
+
+// newDMXSource listens on the serial device for DMX packets and sends the
+// count slots starting at address as a frame after each packet.
+func newDMXSource(device string, address, count int) (*dmxSource, error) {
+	if address < 1 || address+count-1 > dmxSlots {
+		return nil, fmt.Errorf("illegal DMX address %d: must be 1 to %d for %d channels", address, dmxSlots-count+1, count)
+	}
+	f, err := os.OpenFile(device, os.O_RDONLY|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := setDMXTermios(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not configure %s: %s", device, err)
+	}
+	d := &dmxSource{file: f, address: address, count: count, out: make(chan map[byte]int, 1)}
+	go func() {
+		defer failsafe()
+		err := d.run(bufio.NewReader(f))
+		slog.Error("DMX input stopped", "err", err)
+	}()
+	return d, nil
+}
+
+func (d *dmxSource) name() string                { return "dmx" }
+func (d *dmxSource) frames() <-chan map[byte]int { return d.out }
+
+// setDMXTermios puts the serial line in raw 250k 8N2 mode. PARMRK makes
+// the kernel report a break as the bytes 0xFF 0x00 0x00 so run can find
+// the start of each packet; a real 0xFF arrives doubled.
+func setDMXTermios(f *os.File) error {
+	var t termios2
+	if err := ioctl(f.Fd(), tcgets2, unsafe.Pointer(&t)); err != nil {
+		return err
+	}
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.IGNPAR | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON | syscall.IXOFF
+	t.Iflag |= syscall.PARMRK | syscall.INPCK
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB | cbaud
+	t.Cflag |= syscall.CS8 | syscall.CSTOPB | syscall.CREAD | syscall.CLOCAL | bother
+	t.Ispeed = dmxBaud
+	t.Ospeed = dmxBaud
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	return ioctl(f.Fd(), tcsets2, unsafe.Pointer(&t))
+}
+
+func ioctl(fd uintptr, req uint, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(req), uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// run parses the serial stream until it fails.
+func (d *dmxSource) run(r *bufio.Reader) error {
+	var slots [dmxSlots]byte
+	last := d.address + d.count - 1 // last slot we need
+	slot := -1                      // -1 waits for a break, 0 for the start code
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b == 0xFF {
+			if b, err = r.ReadByte(); err != nil {
+				return err
+			}
+			if b == 0x00 {
+				// 0xFF 0x00 x marks a framing error on x; a break is x == 0
+				if b, err = r.ReadByte(); err != nil {
+					return err
+				}
+				if b == 0x00 {
+					slot = 0
+				} else {
+					slot = -1
+				}
+				continue
+			}
+			// otherwise 0xFF 0xFF is a 0xFF slot value
+		}
+
+		switch {
+		case slot == 0:
+			if b == dmxStartCode {
+				slot = 1
+			} else {
+				slot = -1
+			}
+		case slot > 0:
+			slots[slot-1] = b
+			if slot == last {
+				frame := make(map[byte]int, d.count)
+				for i := 0; i < d.count; i++ {
+					frame[byte(i)] = scaleLevel(int(slots[d.address-1+i]), dmxMax)
+				}
+				sendLatest(d.out, frame)
+				slot = -1 // skip the rest of the packet
+			} else {
+				slot++
+			}
+		}
+	}
+}
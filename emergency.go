@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/btittelbach/go-bbhw"
+)
+
+// how often a switch input such as -emergency-gpio is read
+const switchPoll = 20 * time.Millisecond
+
+// The emergency lights: "house lights up" for events. While on, the white
+// LEDs, or all of them, go to their max_duty within the current limit,
+// whatever the pots, sources, scenes, overrides and strobes say, and with
+// no smoothing or fading. Turning them off hands back to whatever was in
+// charge. They are on while set over HTTP or while the -emergency-gpio
+// input is held low.
+var emergency struct {
+	sync.Mutex
+	http bool // POST /emergency
+	gpio bool // -emergency-gpio pulled low
+	all  bool // POST /emergency asked for every LED, not just the white ones
+}
+
+// emergencyLights reports whether the emergency lights are on and whether
+// every LED is lit, rather than just the white ones.
+func emergencyLights() (on, all bool) {
+	emergency.Lock()
+	defer emergency.Unlock()
+	return emergency.http || emergency.gpio, emergency.http && emergency.all
+}
+
+// emergencyDuties puts the emergency lights into duties: max_duty for the
+// white LEDs, or for all of them if all is set or the fixture has no white,
+// short of the full period as for the pots, and off for the rest.
+func emergencyDuties(duties, maxDuties []time.Duration, all bool) {
+	all = all || !conf.hasColor(colorWhite)
+	for step := range duties {
+		duties[step] = 0
+		if all || conf.Channels[step].Color == colorWhite {
+			duties[step] = capDuty(float64(maxDuties[step]))
+		}
+	}
+}
+
+// watchEmergencyGPIO follows a switch from the kernel GPIO number to
+// ground. The input needs a pull-up, so a cut wire does not light the
+// fixture.
+func watchEmergencyGPIO(number uint) error {
+	return watchSwitch(number, "emergency", func(closed bool) {
+		emergency.Lock()
+		if emergency.gpio != closed {
+			slog.Warn("emergency input changed", "gpio", number, "on", closed)
+		}
+		emergency.gpio = closed
+		emergency.Unlock()
+	})
+}
+
+// watchSwitch polls a switch from the kernel GPIO number to ground and
+// passes set whether it is closed, i.e. the input is low. A read error
+// keeps the last state and is logged once, as what.
+func watchSwitch(number uint, what string, set func(closed bool)) error {
+	pin, err := bbhw.NewSysfsGPIO(number, bbhw.IN)
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer failsafe()
+		failing := false
+		for {
+			high, err := pin.GetState()
+			if err != nil {
+				// keep the last state; say so once rather than every poll
+				if !failing {
+					slog.Warn("could not read "+what+" input", "gpio", number, "err", err)
+				}
+			} else {
+				set(!high)
+			}
+			failing = err != nil
+			time.Sleep(switchPoll)
+		}
+	}()
+	return nil
+}
+
+type emergencyStatus struct {
+	On   bool `json:"on"`
+	All  bool `json:"all"`
+	HTTP bool `json:"http"`
+	GPIO bool `json:"gpio"`
+}
+
+// GET /emergency reports the emergency lights, POST /emergency turns them on
+// with an optional body of {"all": true} to light every LED, and DELETE
+// /emergency turns off the HTTP request; a held -emergency-gpio switch keeps
+// them on.
+func handleEmergency(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			All bool `json:"all"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			writeError(w, `body must be empty or {"all": bool}`, http.StatusBadRequest)
+			return
+		}
+		emergency.Lock()
+		emergency.http, emergency.all = true, req.All
+		emergency.Unlock()
+		slog.Warn("emergency lights on over HTTP", "all", req.All, "remote", r.RemoteAddr)
+	case http.MethodDelete:
+		emergency.Lock()
+		emergency.http = false
+		emergency.Unlock()
+		slog.Warn("emergency lights off over HTTP", "remote", r.RemoteAddr)
+	default:
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	emergency.Lock()
+	st := emergencyStatus{HTTP: emergency.http, GPIO: emergency.gpio}
+	emergency.Unlock()
+	st.On, st.All = emergencyLights()
+	writeJSON(w, st)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Freezing holds the LEDs at what they showed when it began, for fiddling
+// with wiring or pots during setup. The pots, auto mode, sources, scenes
+// and overrides are all ignored until unfrozen; the emergency lights,
+// disabled channels, slew, the current limit and -thermal still apply.
+// The lights are frozen while set over HTTP or while the -freeze-gpio
+// input is held low.
+var freeze struct {
+	sync.Mutex
+	http bool // POST /freeze
+	gpio bool // -freeze-gpio pulled low
+}
+
+func frozen() bool {
+	freeze.Lock()
+	defer freeze.Unlock()
+	return freeze.http || freeze.gpio
+}
+
+// freezeDuties latches the duties last applied as the freeze begins and
+// holds them. Called by the main loop each iteration with on, the frozen
+// state; it returns the latched duties, nil once unfrozen.
+func freezeDuties(on bool, latched, applied []time.Duration) []time.Duration {
+	switch {
+	case !on:
+		if latched != nil {
+			slog.Info("unfrozen")
+		}
+		return nil
+	case latched == nil:
+		slog.Info("frozen", "duties", applied)
+		return append([]time.Duration(nil), applied...)
+	}
+	return latched
+}
+
+// watchFreezeGPIO freezes the lights while a switch from the kernel GPIO
+// number to ground is closed.
+func watchFreezeGPIO(number uint) error {
+	return watchSwitch(number, "freeze", func(closed bool) {
+		freeze.Lock()
+		freeze.gpio = closed
+		freeze.Unlock()
+	})
+}
+
+// POST /freeze holds the lights as they are and POST /unfreeze lets them
+// go; GET /freeze reports the state. A held -freeze-gpio switch keeps them
+// frozen.
+func handleFreeze(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/freeze":
+	case r.Method == http.MethodPost:
+		freeze.Lock()
+		freeze.http = r.URL.Path == "/freeze"
+		freeze.Unlock()
+		slog.Info("freeze set over HTTP", "frozen", r.URL.Path == "/freeze", "remote", r.RemoteAddr)
+	default:
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	freeze.Lock()
+	st := map[string]bool{"frozen": freeze.http || freeze.gpio, "http": freeze.http, "gpio": freeze.gpio}
+	freeze.Unlock()
+	writeJSON(w, st)
+}
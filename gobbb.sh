@@ -4,5 +4,9 @@ gopath=/Users/doug
 #host=beaglebone.local
 host=10.0.0.26
 
-GOPATH=${gopath} GOARM=7 GOARCH=arm GOOS=linux go build LEDLightFantastic.go adc.go
+commit=$(git rev-parse --short HEAD 2>/dev/null || echo unknown)
+built=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+ldflags="-X main.commit=${commit} -X main.buildDate=${built}"
+
+GOPATH=${gopath} GOARM=7 GOARCH=arm GOOS=linux go build -ldflags "${ldflags}" LEDLightFantastic.go adc.go config.go http.go source.go dmx.go artnet.go mqtt.go mockadc.go median.go smooth.go strobe.go scene.go color.go state.go metrics.go logging.go pwm.go ambient.go ws.go osc.go rainbow.go breathe.go curve.go calibrate.go check.go selftest.go history.go aux.go thermal.go record.go replay.go emergency.go reload.go chase.go classpwm.go disable.go freeze.go health.go lfo.go preview.go pipeline.go
 scp LEDLightFantastic root@${host}:/root/
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// least time without a loop that counts as stalled, whatever the loop rate
+const healthStallMin = time.Second
+
+// The main loop's heartbeat, for GET /healthz: when it last finished an
+// iteration and whether the ADC is set up. The loop is stalled once stall
+// passes without one.
+var health struct {
+	sync.Mutex
+	lastLoop time.Time
+	adcReady bool
+	stall    time.Duration
+}
+
+// healthStall is the default -healthz-stall: three loop periods of -sleep
+// or -maxrate, whichever is slower, but at least healthStallMin.
+func healthStall(sleep time.Duration, maxRate float64) time.Duration {
+	period := sleep
+	if maxRate > 0 {
+		if p := time.Duration(float64(time.Second) / maxRate); p > period {
+			period = p
+		}
+	}
+	if 3*period > healthStallMin {
+		return 3 * period
+	}
+	return healthStallMin
+}
+
+func setADCReady(ready bool) {
+	health.Lock()
+	health.adcReady = ready
+	health.Unlock()
+}
+
+// heartbeat records a finished iteration of the main loop.
+func heartbeat(now time.Time) {
+	health.Lock()
+	health.lastLoop = now
+	health.Unlock()
+}
+
+// GET /healthz answers 200 while the main loop is running and the ADC is
+// set up, and 503 otherwise, for a supervisor to restart a wedged process.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	health.Lock()
+	since := time.Since(health.lastLoop)
+	ready, stall, looped := health.adcReady, health.stall, !health.lastLoop.IsZero()
+	health.Unlock()
+	switch {
+	case !ready:
+		writeError(w, "ADC not initialized", http.StatusServiceUnavailable)
+	case !looped:
+		writeError(w, "main loop not started", http.StatusServiceUnavailable)
+	case since > stall:
+		writeError(w, "main loop stalled for "+since.Round(time.Millisecond).String(), http.StatusServiceUnavailable)
+	default:
+		writeJSON(w, map[string]interface{}{"ok": true, "last_loop": duration{since.Round(time.Millisecond)}})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"container/ring"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// how many raw readings per channel /history can return
+const historySize = 1000
+
+// The last historySize raw readings of each channel, for looking into pot
+// noise. It is kept apart from the smoothing window, which may be smaller
+// and is owned by the main loop.
+var history struct {
+	sync.Mutex
+	rings []*ring.Ring // per step; each points at the slot for the next reading
+}
+
+// recordHistory adds the latest raw reading of each channel.
+func recordHistory(channels []channelStatus) {
+	history.Lock()
+	defer history.Unlock()
+	if len(history.rings) != len(channels) {
+		history.rings = make([]*ring.Ring, len(channels))
+		for i := range history.rings {
+			history.rings[i] = ring.New(historySize)
+		}
+	}
+	for i, ch := range channels {
+		history.rings[i].Value = ch.Aout
+		history.rings[i] = history.rings[i].Next()
+	}
+}
+
+// recentReadings returns up to n of step's latest readings, oldest first.
+func recentReadings(step byte, n int) []int {
+	history.Lock()
+	defer history.Unlock()
+	aouts := make([]int, 0, n)
+	if int(step) >= len(history.rings) {
+		return aouts
+	}
+	// the slot for the next reading holds the oldest, if the ring is full
+	history.rings[step].Do(func(v interface{}) {
+		if aout, ok := v.(int); ok {
+			aouts = append(aouts, aout)
+		}
+	})
+	if len(aouts) > n {
+		aouts = aouts[len(aouts)-n:]
+	}
+	return aouts
+}
+
+// GET /history?step=0&n=200 returns a channel's last n raw readings, oldest
+// first. n defaults to 100 and is at most 1000.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	step, err := strconv.ParseUint(q.Get("step"), 10, 8)
+	if err != nil || step >= uint64(len(currentConfig().Channels)) {
+		writeError(w, "unknown LED step", http.StatusNotFound)
+		return
+	}
+	n := 100
+	if s := q.Get("n"); s != "" {
+		if n, err = strconv.Atoi(s); err != nil || n < 1 || n > historySize {
+			writeError(w, "n must be 1 to 1000", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, map[string]interface{}{"step": step, "aouts": recentReadings(byte(step), n)})
+}
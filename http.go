@@ -0,0 +1,656 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// channelStatus is the most recent reading and output of one LED.
+type channelStatus struct {
+	Step   byte          `json:"step"`
+	Name   string        `json:"name"`
+	Aout   int           `json:"aout"`   // raw analog reading
+	Median float64       `json:"median"` // smoothed reading; a median unless -smooth ema
+	Duty   time.Duration `json:"duty"`   // normalized duty in nanoseconds
+	// raw readings at or beyond adc_range_min or adc_range_max so far
+	Clipped uint64 `json:"clipped"`
+	// the auto mode random walk: offset from the pot and its current
+	// bounds, and loops between steps
+	AutoOffset    int `json:"auto_offset"`
+	AutoOffsetMax int `json:"auto_offset_max"`
+	AutoLoopMax   int `json:"auto_loop_max"`
+
+	StrobeHz float64 `json:"strobe_hz,omitempty"`
+	Disabled bool    `json:"disabled,omitempty"` // out of service; see disabledSteps
+	Polarity bool    `json:"polarity"`           // as given to SetPolarity
+	Invert   bool    `json:"invert"`             // duty written as period - duty
+	Trim     float64 `json:"trim"`               // color balance factor
+}
+
+// autoParams is the auto mode tuning in effect, from the config.
+type autoParams struct {
+	LoopMax      int      `json:"loop_max"`
+	OffsetMax    int      `json:"offset_max"`
+	OffsetDelta  int      `json:"offset_delta"`
+	LoopAdjust   duration `json:"loop_adjust"`
+	OffsetAdjust duration `json:"offset_adjust"`
+	Skew         float64  `json:"skew"` // -automode dark only
+}
+
+type fixtureStatus struct {
+	AutoMode bool       `json:"auto_mode"`
+	Auto     autoParams `json:"auto"`
+	Scene    string     `json:"scene,omitempty"` // playing scene, if any
+	// what sets the LEDs: scene, a control source's name, auto or pots
+	Source  string             `json:"source"`
+	Ambient float64            `json:"ambient,omitempty"` // -ambient brightness scale
+	Aux     map[string]float64 `json:"aux,omitempty"`     // smoothed aux pot readings by role
+	Master  float64            `json:"master"`            // master dimmer level, 1 without a master pot
+	LFOHz   float64            `json:"lfo_hz,omitempty"`  // LFO rate, if a channel has an lfo
+	// output_min and output_max as duties in nanoseconds
+	OutputMin time.Duration `json:"output_min"`
+	OutputMax time.Duration `json:"output_max"`
+	// emergency lights on; see handleEmergency
+	Emergency bool `json:"emergency,omitempty"`
+	// output held by a freeze; see freeze
+	Frozen bool `json:"frozen,omitempty"`
+	// -thermal readings: degrees Celsius and the factor on the current limit
+	Temperature float64 `json:"temperature,omitempty"`
+	Throttle    float64 `json:"throttle,omitempty"`
+	// loop iterations per second over the last second or so
+	LoopRate float64         `json:"loop_rate"`
+	Channels []channelStatus `json:"channels"`
+}
+
+// The main loop publishes a snapshot once per iteration and the HTTP
+// handlers only ever read that copy, never the loop's own variables.
+var status struct {
+	sync.Mutex
+	fixtureStatus
+}
+
+// publishStatus replaces the shared snapshot with a copy of s.
+func publishStatus(s *fixtureStatus) {
+	status.Lock()
+	status.AutoMode = s.AutoMode
+	status.Auto = s.Auto
+	status.Scene = s.Scene
+	status.Source = s.Source
+	status.Ambient = s.Ambient
+	status.Aux = s.Aux
+	status.Master = s.Master
+	status.LFOHz = s.LFOHz
+	status.Emergency = s.Emergency
+	status.Frozen = s.Frozen
+	status.OutputMin, status.OutputMax = s.OutputMin, s.OutputMax
+	status.Temperature = s.Temperature
+	status.Throttle = s.Throttle
+	status.LoopRate = s.LoopRate
+	if len(status.Channels) != len(s.Channels) {
+		status.Channels = make([]channelStatus, len(s.Channels))
+	}
+	copy(status.Channels, s.Channels)
+	status.Unlock()
+}
+
+// snapshotStatus returns a copy of the shared snapshot that is safe to use
+// without holding the lock.
+func snapshotStatus() fixtureStatus {
+	status.Lock()
+	defer status.Unlock()
+	s := status.fixtureStatus
+	s.Channels = append([]channelStatus(nil), status.Channels...)
+	return s
+}
+
+// Manual duties set over HTTP, keyed by step. The main loop takes a copy
+// once per iteration.
+var overrides struct {
+	sync.Mutex
+	duty map[byte]time.Duration
+}
+
+// currentOverrides returns a copy of the manual overrides, raw duties that
+// replace whatever else the LEDs would be given and are still normalized.
+func currentOverrides() map[byte]time.Duration {
+	overrides.Lock()
+	defer overrides.Unlock()
+	duties := make(map[byte]time.Duration, len(overrides.duty))
+	for step, duty := range overrides.duty {
+		duties[step] = duty
+	}
+	return duties
+}
+
+// setOverrides gives each LED in duties a manual override.
+func setOverrides(duties map[byte]time.Duration) {
+	overrides.Lock()
+	if overrides.duty == nil {
+		overrides.duty = make(map[byte]time.Duration)
+	}
+	for step, duty := range duties {
+		overrides.duty[step] = duty
+	}
+	overrides.Unlock()
+}
+
+// clearColorOverrides hands every colored LED back to its pot.
+func clearColorOverrides() {
+	overrides.Lock()
+	for i, ch := range currentConfig().Channels {
+		if ch.Color != "" {
+			delete(overrides.duty, byte(i))
+		}
+	}
+	overrides.Unlock()
+}
+
+// The color temperature last set with -cct or /cct and the duties it gave.
+// It is in effect while the overrides still hold those duties, so /color,
+// /led or DELETE /cct replacing any of them ends it.
+var cctSet struct {
+	sync.Mutex
+	kelvin, v float64
+	duties    map[byte]time.Duration
+}
+
+// setCCT overrides the colored LEDs with kelvin at brightness v. A
+// temperature the LEDs cannot mix is clamped to the nearest one they can;
+// 0 turns them off.
+func setCCT(c *Config, kelvin, v float64) (map[byte]time.Duration, error) {
+	lo, hi, ok := c.cctRange()
+	if !ok {
+		return nil, errors.New("no color temperature can be mixed from the channels' colors")
+	}
+	if kelvin != 0 {
+		kelvin = math.Max(lo, math.Min(hi, kelvin))
+	}
+	duties := c.colorDuties(kelvinToRGBW(kelvin, v))
+	cctSet.Lock()
+	cctSet.kelvin, cctSet.v, cctSet.duties = kelvin, v, duties
+	cctSet.Unlock()
+	setOverrides(duties)
+	return duties, nil
+}
+
+// cctNow returns the color temperature in effect and its brightness.
+func cctNow() (kelvin, v float64, active bool) {
+	cctSet.Lock()
+	defer cctSet.Unlock()
+	if cctSet.duties == nil {
+		return 0, 0, false
+	}
+	overrides.Lock()
+	defer overrides.Unlock()
+	for step, duty := range cctSet.duties {
+		if d, ok := overrides.duty[step]; !ok || d != duty {
+			return 0, 0, false
+		}
+	}
+	return cctSet.kelvin, cctSet.v, true
+}
+
+// Auto mode forced on or off over HTTP. While forced the pot gesture is
+// ignored; once released auto mode follows the gesture again.
+var autoForce struct {
+	sync.Mutex
+	forced    bool
+	enabled   bool
+	speedStep byte // pot that sets the auto mode speed
+}
+
+// forcedAutoMode reports whether auto mode is forced and, if so, whether it
+// is on and which pot sets its speed.
+func forcedAutoMode() (forced, enabled bool, speedStep byte) {
+	autoForce.Lock()
+	defer autoForce.Unlock()
+	return autoForce.forced, autoForce.enabled, autoForce.speedStep
+}
+
+// serveHTTP runs the monitoring API until the process exits.
+func serveHTTP(addr string) {
+	go hub.run()
+	slog.Info("serving HTTP", "addr", addr)
+	if err := http.ListenAndServe(addr, apiHandler()); err != nil {
+		// keep the lights running; the API is optional
+		slog.Error("HTTP server stopped", "err", err)
+	}
+}
+
+// apiHandler routes the API's paths to their handlers.
+func apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", handleStatus)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/led/", handleLED)
+	mux.HandleFunc("/strobe/", handleStrobe)
+	mux.HandleFunc("/disable/", handleDisable)
+	mux.HandleFunc("/scenes", handleScenes)
+	mux.HandleFunc("/scenes/", handleSceneActivate)
+	mux.HandleFunc("/color", handleColor)
+	mux.HandleFunc("/cct", handleCCT)
+	mux.HandleFunc("/preview", handlePreview)
+	mux.HandleFunc("/automode", handleAutoMode)
+	mux.HandleFunc("/history", handleHistory)
+	mux.HandleFunc("/window", handleWindow)
+	mux.HandleFunc("/emergency", handleEmergency)
+	mux.HandleFunc("/freeze", handleFreeze)
+	mux.HandleFunc("/unfreeze", handleFreeze)
+	mux.HandleFunc("/reload", handleReload)
+	mux.HandleFunc("/ws", handleWS)
+	if *metrics {
+		mux.Handle("/metrics", promhttp.Handler())
+	}
+	mux.HandleFunc("/scene", handleScene)
+	mux.HandleFunc("/", handleNotFound)
+	return recoverJSON(mux)
+}
+
+// GET /status
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, snapshotStatus())
+}
+
+// POST /led/{step} {"duty": 0.5} overrides the pot with a fraction of the
+// PWM period. DELETE /led/{step} returns control to the pot.
+func handleLED(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/led/"), 10, 8)
+	if err != nil || n >= uint64(len(currentConfig().Channels)) {
+		writeError(w, "unknown LED step", http.StatusNotFound)
+		return
+	}
+	step := byte(n)
+
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			Duty *float64 `json:"duty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Duty == nil {
+			writeError(w, `body must be {"duty": fraction}`, http.StatusBadRequest)
+			return
+		}
+		if *req.Duty < 0 || *req.Duty > 1 {
+			writeError(w, "duty must be 0 to 1", http.StatusBadRequest)
+			return
+		}
+		duty := fractionDuty(*req.Duty)
+		setOverrides(map[byte]time.Duration{step: duty})
+		writeJSON(w, map[string]interface{}{"step": step, "duty": duty})
+	case http.MethodDelete:
+		overrides.Lock()
+		delete(overrides.duty, step)
+		overrides.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// POST /strobe/{step} {"hz": 10} strobes an LED at the pot's brightness.
+// DELETE /strobe/{step} stops it.
+func handleStrobe(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/strobe/"), 10, 8)
+	if err != nil || n >= uint64(len(currentConfig().Channels)) {
+		writeError(w, "unknown LED step", http.StatusNotFound)
+		return
+	}
+	step := byte(n)
+
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			Hz float64 `json:"hz"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, `body must be {"hz": rate}`, http.StatusBadRequest)
+			return
+		}
+		if req.Hz <= 0 || req.Hz > maxStrobeHz {
+			writeError(w, fmt.Sprintf("hz must be above 0 and at most %d", maxStrobeHz), http.StatusBadRequest)
+			return
+		}
+		setStrobe(step, req.Hz)
+		writeJSON(w, map[string]interface{}{"step": step, "hz": req.Hz})
+	case http.MethodDelete:
+		setStrobe(step, 0)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// GET /scenes lists the configured scenes.
+func handleScenes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	scenes := currentConfig().Scenes
+	if scenes == nil {
+		scenes = []Scene{}
+	}
+	writeJSON(w, scenes)
+}
+
+// POST /scenes/{name}/activate?duration=5s crossfades to a configured
+// scene like POST /scene, over duration if given. DELETE /scene releases
+// it.
+func handleSceneActivate(w http.ResponseWriter, r *http.Request) {
+	name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/scenes/"), "/activate")
+	if !ok || name == "" {
+		writeError(w, "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var fade *time.Duration
+	if q := r.URL.Query().Get("duration"); q != "" {
+		d, err := time.ParseDuration(q)
+		if err != nil {
+			writeError(w, "duration must be a duration such as 5s", http.StatusBadRequest)
+			return
+		}
+		fade = &d
+	}
+	startScene(w, name, fade, "")
+}
+
+// startScene crossfades to the scene called name from whatever the LEDs
+// show now and writes the response. A nil fade and an empty easing default
+// to the scene's or the config's.
+func startScene(w http.ResponseWriter, name string, fade *time.Duration, easing string) {
+	c := currentConfig()
+	s, ok := c.findScene(name)
+	if !ok {
+		writeError(w, "unknown scene", http.StatusNotFound)
+		return
+	}
+	d := c.SceneFade.Duration
+	if fade != nil {
+		if *fade < 0 {
+			writeError(w, "fade must not be negative", http.StatusBadRequest)
+			return
+		}
+		d = *fade
+	}
+	if easing == "" {
+		easing = s.Easing
+	}
+	if easing == "" {
+		easing = c.SceneEasing
+	}
+	ease, err := findEasing(easing)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cur := snapshotStatus()
+	from := make([]time.Duration, len(cur.Channels))
+	for i, ch := range cur.Channels {
+		from[i] = ch.Duty
+	}
+	playScene(s, from, d, ease)
+	writeJSON(w, map[string]interface{}{"scene": s.Name, "fade": duration{d}, "easing": easing})
+}
+
+// POST /scene {"name": "sunset", "fade": "5s", "easing": "log"} crossfades
+// to a configured scene, from whatever the LEDs show now. "fade" and
+// "easing" are optional and default to the scene's or the config's.
+// DELETE /scene returns control to the pots.
+func handleScene(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			Name   string    `json:"name"`
+			Fade   *duration `json:"fade"`
+			Easing string    `json:"easing"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, `body must be {"name": scene, "fade": duration, "easing": name}`, http.StatusBadRequest)
+			return
+		}
+		var fade *time.Duration
+		if req.Fade != nil {
+			fade = &req.Fade.Duration
+		}
+		startScene(w, req.Name, fade, req.Easing)
+	case http.MethodDelete:
+		stopScene()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// POST /color {"h": 30, "s": 0.8, "v": 1, "w": 0} sets the colored LEDs from
+// hue in degrees and saturation, value and white from 0 to 1, as manual
+// overrides. DELETE /color returns them to the pots.
+func handleColor(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			H float64 `json:"h"`
+			S float64 `json:"s"`
+			V float64 `json:"v"`
+			W float64 `json:"w"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, `body must be {"h": degrees, "s": 0-1, "v": 0-1, "w": 0-1}`, http.StatusBadRequest)
+			return
+		}
+		if req.S < 0 || req.S > 1 || req.V < 0 || req.V > 1 || req.W < 0 || req.W > 1 {
+			writeError(w, "s, v and w must be 0 to 1", http.StatusBadRequest)
+			return
+		}
+		duties := currentConfig().colorDuties(hsvToRGBW(req.H, req.S, req.V, req.W))
+		if len(duties) == 0 {
+			writeError(w, "no channel has a color", http.StatusConflict)
+			return
+		}
+		setOverrides(duties)
+		writeJSON(w, duties)
+	case http.MethodDelete:
+		clearColorOverrides()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// POST or PUT /cct {"kelvin": 3000, "v": 1} sets the colored LEDs to a
+// white of that color temperature at brightness v, 0 to 1, as manual
+// overrides. GET /cct shows it and the range the LEDs can mix, and DELETE
+// /cct returns them to the pots.
+func handleCCT(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var s struct {
+			Active    bool    `json:"active"`
+			Kelvin    float64 `json:"kelvin,omitempty"`
+			V         float64 `json:"v,omitempty"`
+			MinKelvin float64 `json:"min_kelvin,omitempty"`
+			MaxKelvin float64 `json:"max_kelvin,omitempty"`
+		}
+		s.Kelvin, s.V, s.Active = cctNow()
+		s.MinKelvin, s.MaxKelvin, _ = currentConfig().cctRange()
+		writeJSON(w, s)
+	case http.MethodPost, http.MethodPut:
+		req := struct {
+			Kelvin float64 `json:"kelvin"`
+			V      float64 `json:"v"`
+		}{V: 1}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, `body must be {"kelvin": temperature, "v": 0-1}`, http.StatusBadRequest)
+			return
+		}
+		if req.Kelvin < 0 || req.V < 0 || req.V > 1 {
+			writeError(w, "kelvin must not be negative and v must be 0 to 1", http.StatusBadRequest)
+			return
+		}
+		duties, err := setCCT(currentConfig(), req.Kelvin, req.V)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, duties)
+	case http.MethodDelete:
+		clearColorOverrides()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// POST /window {"size": 50} changes the smoothing window of every
+// pot, keeping as many recent readings as fit. GET /window shows the size.
+func handleWindow(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, map[string]interface{}{"smooth": *smoothing, "aggregate": *aggregate, "size": windowSizeNow()})
+	case http.MethodPost:
+		if *smoothing != "median" {
+			writeError(w, "only -smooth median has a window", http.StatusConflict)
+			return
+		}
+		var req struct {
+			Size int `json:"size"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, `body must be {"size": samples}`, http.StatusBadRequest)
+			return
+		}
+		if req.Size < windowSizeMin || req.Size > windowSizeMax {
+			writeError(w, fmt.Sprintf("size must be %d to %d", windowSizeMin, windowSizeMax), http.StatusBadRequest)
+			return
+		}
+		requestWindow(req.Size)
+		writeJSON(w, map[string]interface{}{"smooth": *smoothing, "aggregate": *aggregate, "size": req.Size})
+	default:
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type autoModeStatus struct {
+	Forced    bool `json:"forced"`
+	Enabled   bool `json:"enabled"`
+	SpeedStep byte `json:"speed_step"`
+}
+
+// POST /automode {"enabled": true, "speed_step": 0} forces auto mode on or
+// off, ignoring the pot gesture. "speed_step" picks the pot that sets the
+// speed and defaults to the lowest one. GET /automode shows the setting and
+// DELETE /automode hands auto mode back to the gesture.
+func handleAutoMode(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		forced, enabled, step := forcedAutoMode()
+		writeJSON(w, autoModeStatus{Forced: forced, Enabled: enabled, SpeedStep: step})
+	case http.MethodPost:
+		var req struct {
+			Enabled   *bool `json:"enabled"`
+			SpeedStep *byte `json:"speed_step"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+			writeError(w, `body must be {"enabled": bool, "speed_step": step}`, http.StatusBadRequest)
+			return
+		}
+		var step byte
+		if req.SpeedStep != nil {
+			if int(*req.SpeedStep) >= len(currentConfig().Channels) {
+				writeError(w, "unknown LED step", http.StatusNotFound)
+				return
+			}
+			step = *req.SpeedStep
+		} else {
+			// no readings to pick from before the first loop or during -selftest
+			channels := snapshotStatus().Channels
+			if len(channels) == 0 {
+				writeError(w, "main loop not started", http.StatusConflict)
+				return
+			}
+			step = lowestPot(channels)
+		}
+		autoForce.Lock()
+		autoForce.forced, autoForce.enabled, autoForce.speedStep = true, *req.Enabled, step
+		autoForce.Unlock()
+		writeJSON(w, autoModeStatus{Forced: true, Enabled: *req.Enabled, SpeedStep: step})
+	case http.MethodDelete:
+		autoForce.Lock()
+		autoForce.forced = false
+		autoForce.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// lowestPot returns the step of the pot turned furthest down, the one the
+// gesture would pick as the speed control. channels must not be empty.
+func lowestPot(channels []channelStatus) byte {
+	var step byte
+	for i, ch := range channels {
+		if ch.Median < channels[step].Median {
+			step = byte(i)
+		}
+	}
+	return step
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("could not write response", "err", err)
+	}
+}
+
+// writeError answers with code and {"error": msg}, the shape of every
+// error the API returns, so a client can show msg whatever went wrong.
+func writeError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(map[string]string{"error": msg}); err != nil {
+		slog.Warn("could not write response", "err", err)
+	}
+}
+
+// handleNotFound answers paths no handler takes, in place of ServeMux's
+// plain text 404.
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, "not found", http.StatusNotFound)
+}
+
+// recoverJSON turns a panic in a handler into a 500 with the usual error
+// body, and a log record, instead of a dropped connection. The lights are
+// not affected either way.
+func recoverJSON(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				slog.Error("HTTP handler panicked", "path", r.URL.Path, "err", err)
+				writeError(w, "internal error", http.StatusInternalServerError)
+			}
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
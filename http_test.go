@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestHTTPErrors checks every kind of failure answers with its status
+// code and the API's {"error": msg} body.
+func TestHTTPErrors(t *testing.T) {
+	useConfig(t, defaultConfig())
+	tests := []struct {
+		method, path, body string
+		code               int
+	}{
+		{"GET", "/nowhere", "", http.StatusNotFound},
+		{"PUT", "/status", "", http.StatusMethodNotAllowed},
+		{"POST", "/led/9", `{"duty": 0.5}`, http.StatusNotFound},
+		{"POST", "/led/x", `{"duty": 0.5}`, http.StatusNotFound},
+		{"POST", "/disable/9", "", http.StatusNotFound},
+		{"PUT", "/disable/0", "", http.StatusMethodNotAllowed},
+		{"POST", "/scenes/evening", "", http.StatusNotFound},
+		{"POST", "/scenes/nowhere/activate", "", http.StatusNotFound},
+		{"GET", "/scenes/evening/activate", "", http.StatusMethodNotAllowed},
+		{"POST", "/scenes/evening/activate?duration=soon", "", http.StatusBadRequest},
+		{"GET", "/preview", "", http.StatusMethodNotAllowed},
+		{"POST", "/preview", `not json`, http.StatusBadRequest},
+		{"POST", "/preview", `{"aout": [0]}`, http.StatusBadRequest},
+		{"POST", "/preview", `{"aout": [0, 0, 0, 5000]}`, http.StatusBadRequest},
+		{"POST", "/preview", `{"master": 2}`, http.StatusBadRequest},
+		// no pot readings yet to pick the speed pot from
+		{"POST", "/automode", `{"enabled": true}`, http.StatusConflict},
+	}
+	h := apiHandler()
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			checkErrorResponse(t, w, tt.code)
+		})
+	}
+}
+
+// TestHTTPPanic checks a handler that panics answers 500 in the same
+// shape.
+func TestHTTPPanic(t *testing.T) {
+	h := recoverJSON(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("broken")
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	checkErrorResponse(t, w, http.StatusInternalServerError)
+}
+
+func checkErrorResponse(t *testing.T, w *httptest.ResponseRecorder, code int) {
+	t.Helper()
+	if w.Code != code {
+		t.Errorf("status %d, want %d", w.Code, code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q is not JSON: %v", w.Body.String(), err)
+	}
+	if len(body) != 1 || body["error"] == "" {
+		t.Errorf("body %q, want only a non-empty error", w.Body.String())
+	}
+}
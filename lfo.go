@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// LFO waveforms a channel can be modulated with
+const (
+	lfoSine     = "sine"
+	lfoTriangle = "triangle"
+	lfoSquare   = "square"
+	lfoRamp     = "ramp"
+)
+
+// lfoWaves give each waveform's level, 0 to 1, at x, a fraction of the
+// cycle from 0 up to 1. All start a cycle at the bottom.
+var lfoWaves = map[string]func(x float64) float64{
+	lfoSine:     func(x float64) float64 { return 0.5 - 0.5*math.Cos(2*math.Pi*x) },
+	lfoTriangle: func(x float64) float64 { return 1 - math.Abs(2*x-1) },
+	lfoSquare: func(x float64) float64 {
+		if x < 0.5 {
+			return 0
+		}
+		return 1
+	},
+	lfoRamp: func(x float64) float64 { return x },
+}
+
+func validLFO(wave string) error {
+	if wave != "" && lfoWaves[wave] == nil {
+		return fmt.Errorf("unknown lfo %q: use sine, triangle, square or ramp", wave)
+	}
+	return nil
+}
+
+// lfo is the low frequency oscillator that modulates the channels with an
+// "lfo" in the config. Its rate comes from an lfo aux pot, or lfo_hz
+// without one. The channels share its cycle, each at its own waveform,
+// depth and phase, much as -breathe shares one breath.
+type lfo struct {
+	cycles float64   // where it is in its cycle, 0 up to 1
+	last   time.Time // zero until the first advance
+}
+
+// advance moves the oscillator on by the time since the last call at hz,
+// so a cycle takes 1/hz however fast the loop runs, and a change of rate
+// carries on from where the cycle is instead of jumping.
+func (o *lfo) advance(now time.Time, hz float64) {
+	if !o.last.IsZero() {
+		o.cycles = math.Mod(o.cycles+hz*now.Sub(o.last).Seconds(), 1)
+	}
+	o.last = now
+}
+
+// level is the factor, 1-depth to 1, on the pot's reading of a channel
+// modulated by wave, shifted along the cycle by phase.
+func (o *lfo) level(wave string, depth, phase float64) float64 {
+	x := math.Mod(o.cycles+phase, 1)
+	return 1 - depth*(1-lfoWaves[wave](x))
+}
+
+// lfoRate is the oscillator's rate in hz. An lfo aux pot sweeps it from
+// lfo_min_hz at or below aout_off to lfo_max_hz at or above aout_on,
+// evenly in octaves, so the slow end is not crowded into the pot's first
+// few degrees.
+func lfoRate(a *auxPots) float64 {
+	aout, ok := a.value(auxLFO)
+	if !ok {
+		return conf.LFOHz
+	}
+	f := (aout - float64(conf.AoutOff)) / float64(conf.AoutOn-conf.AoutOff)
+	if f < 0 {
+		f = 0
+	} else if f > 1 {
+		f = 1
+	}
+	return conf.LFOMinHz * math.Pow(conf.LFOMaxHz/conf.LFOMinHz, f)
+}
+
+// usesLFO reports whether any channel is modulated.
+func (c *Config) usesLFO() bool {
+	for _, ch := range c.Channels {
+		if ch.LFO != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// debugLog is set when debug records will be written, so the main loop can
+// skip building them otherwise.
+var debugLog bool
+
+// setupLogging installs the default slog logger at the -loglevel level,
+// in the -debug-format format. -debug is kept as a shorthand for -loglevel
+// debug.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("illegal log level %q: must be debug, info, warn or error", *logLevel)
+	}
+	if *debug {
+		level = slog.LevelDebug
+	}
+	debugLog = level <= slog.LevelDebug
+	opts := &slog.HandlerOptions{Level: level}
+	switch *logFormat {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	default:
+		return fmt.Errorf("illegal debug format %q: must be text or json", *logFormat)
+	}
+	return nil
+}
+
+// fatal logs an error record and exits. Like log.Fatal it skips deferred
+// calls, so it is only for startup, before the LEDs are lit.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"container/heap"
+	"container/ring"
+)
+
+// medianWindow keeps the median of the last window-size samples up to date
+// as samples come and go, rather than sorting the whole window on every
+// reading. The lower half of the samples sits in a max-heap and the upper
+// half in a min-heap, so the median is always at the top of one or both.
+// Until the window fills, only the samples added so far count.
+type medianWindow struct {
+	win    *ring.Ring // *sample, oldest first once full
+	lo, hi sampleHeap
+}
+
+// sample is one reading and its place in lo or hi.
+type sample struct {
+	v     float64
+	heap  *sampleHeap
+	index int
+}
+
+func newMedianWindow(size int) *medianWindow {
+	return &medianWindow{
+		win: ring.New(size),
+		lo:  sampleHeap{max: true},
+	}
+}
+
+// Smooth puts aout in the window, dropping the oldest sample if it is
+// full, and returns the median.
+func (m *medianWindow) Smooth(aout int) float64 {
+	s, _ := m.win.Value.(*sample)
+	if s != nil {
+		heap.Remove(s.heap, s.index)
+	} else {
+		s = new(sample)
+		m.win.Value = s
+	}
+	m.win = m.win.Next()
+
+	s.v = float64(aout)
+	if m.lo.Len() == 0 || s.v <= m.lo.top() {
+		heap.Push(&m.lo, s)
+	} else {
+		heap.Push(&m.hi, s)
+	}
+	// lo holds the extra sample when the count is odd
+	for m.lo.Len() > m.hi.Len()+1 {
+		heap.Push(&m.hi, heap.Pop(&m.lo))
+	}
+	for m.hi.Len() > m.lo.Len() {
+		heap.Push(&m.lo, heap.Pop(&m.hi))
+	}
+
+	if m.lo.Len() > m.hi.Len() {
+		return m.lo.top()
+	}
+	return (m.lo.top() + m.hi.top()) / 2
+}
+
+// resized returns a window of size holding as many of m's most recent
+// samples as fit, so the median carries on rather than starting over.
+func (m *medianWindow) resized(size int) *medianWindow {
+	var samples []int
+	// the current slot holds the oldest sample once the window is full
+	m.win.Do(func(v interface{}) {
+		if s, ok := v.(*sample); ok {
+			samples = append(samples, int(s.v))
+		}
+	})
+	if len(samples) > size {
+		samples = samples[len(samples)-size:]
+	}
+	n := newMedianWindow(size)
+	for _, aout := range samples {
+		n.Smooth(aout)
+	}
+	return n
+}
+
+// sampleHeap is a min-heap, or a max-heap if max is set, that tracks each
+// sample's index so the oldest can be removed from the middle.
+type sampleHeap struct {
+	items []*sample
+	max   bool
+}
+
+func (h *sampleHeap) top() float64 { return h.items[0].v }
+
+func (h *sampleHeap) Len() int { return len(h.items) }
+
+func (h *sampleHeap) Less(i, j int) bool {
+	if h.max {
+		return h.items[i].v > h.items[j].v
+	}
+	return h.items[i].v < h.items[j].v
+}
+
+func (h *sampleHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].index = i
+	h.items[j].index = j
+}
+
+func (h *sampleHeap) Push(x interface{}) {
+	s := x.(*sample)
+	s.heap = h
+	s.index = len(h.items)
+	h.items = append(h.items, s)
+}
+
+func (h *sampleHeap) Pop() interface{} {
+	n := len(h.items) - 1
+	s := h.items[n]
+	h.items[n] = nil
+	h.items = h.items[:n]
+	return s
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestMedianWindow(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		aouts []int
+		want  []float64
+	}{
+		{"one", 1, []int{5, 1, 9}, []float64{5, 1, 9}},
+		{"odd", 3, []int{5, 1, 9, 3, 3, 8}, []float64{5, 3, 5, 3, 3, 3}},
+		// the middle two averaged, also while filling
+		{"even", 4, []int{4, 2, 8, 6, 10, 0}, []float64{4, 3, 4, 5, 7, 7}},
+		{"single spike", 5, []int{2000, 2000, 4095, 2000, 2000, 2000}, []float64{2000, 2000, 2000, 2000, 2000, 2000}},
+		{"single dip", 5, []int{2000, 2010, 1990, 0, 2000, 2005, 1995},
+			[]float64{2000, 2005, 2000, 1995, 2000, 2000, 1995}},
+		{"step", 3, []int{0, 0, 0, 4095, 4095, 4095}, []float64{0, 0, 0, 0, 4095, 4095}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMedianWindow(tt.size)
+			for i, aout := range tt.aouts {
+				if got := m.Smooth(aout); got != tt.want[i] {
+					t.Errorf("reading %d (%d): median %v, want %v", i, aout, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestMedianWindowRandom checks the heaps against sorting the window on
+// every reading.
+func TestMedianWindowRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for size := 1; size <= 9; size++ {
+		m := newMedianWindow(size)
+		var readings []int
+		for i := 0; i < 500; i++ {
+			// repeats too, so equal samples sit on both sides
+			aout := rng.Intn(64) * 64
+			readings = append(readings, aout)
+			if len(readings) > size {
+				readings = readings[1:]
+			}
+			if got, want := m.Smooth(aout), sortedMedian(readings); got != want {
+				t.Fatalf("size %d, reading %d: median %v, want %v of %v", size, i, got, want, readings)
+			}
+		}
+	}
+}
+
+func sortedMedian(readings []int) float64 {
+	s := append([]int(nil), readings...)
+	sort.Ints(s)
+	n := len(s)
+	if n%2 == 1 {
+		return float64(s[n/2])
+	}
+	return float64(s[n/2-1]+s[n/2]) / 2
+}
+
+// benchWindow is wide enough that sorting every reading shows its cost.
+const benchWindow = 1000
+
+func benchReadings(n int) []int {
+	rng := rand.New(rand.NewSource(1))
+	readings := make([]int, n)
+	for i := range readings {
+		readings[i] = rng.Intn(4096)
+	}
+	return readings
+}
+
+// BenchmarkMedianSort is the median by sorting the window on every reading,
+// which the heaps replace.
+func BenchmarkMedianSort(b *testing.B) {
+	readings := benchReadings(b.N + benchWindow)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sortedMedian(readings[i+1 : i+1+benchWindow])
+	}
+}
+
+func BenchmarkMedianWindow(b *testing.B) {
+	readings := benchReadings(b.N + benchWindow)
+	m := newMedianWindow(benchWindow)
+	for _, aout := range readings[:benchWindow] {
+		m.Smooth(aout)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Smooth(readings[benchWindow+i])
+	}
+}
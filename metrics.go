@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Loop timing and under-reads are recorded as they happen; both are atomic
+// updates. Per channel values are read from the status snapshot at scrape
+// time so the main loop never waits on a scrape.
+var (
+	loopSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ledlightfantastic_loop_seconds",
+		Help:    "Time spent in one main loop iteration, excluding -sleep.",
+		Buckets: prometheus.ExponentialBuckets(100e-6, 2, 12), // 100us to 200ms
+	})
+	missedTicks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ledlightfantastic_missed_ticks_total",
+		Help: "Loop periods skipped because an iteration took longer than -sleep.",
+	})
+	underReads = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ledlightfantastic_fifo_underreads_total",
+		Help: "ADC reads that returned before every step converted.",
+	})
+)
+
+// statusCollector turns the latest status snapshot into per channel gauges.
+type statusCollector struct {
+	aout, median, duty, clipped, autoMode, loopRate *prometheus.Desc
+}
+
+func newStatusCollector() *statusCollector {
+	labels := []string{"step", "name"}
+	return &statusCollector{
+		aout:     prometheus.NewDesc("ledlightfantastic_aout", "Raw analog reading of the channel's pot, 0 to 4095.", labels, nil),
+		median:   prometheus.NewDesc("ledlightfantastic_aout_smoothed", "Smoothed analog reading of the channel's pot.", labels, nil),
+		duty:     prometheus.NewDesc("ledlightfantastic_duty_seconds", "Normalized PWM duty applied to the channel's LED.", labels, nil),
+		clipped:  prometheus.NewDesc("ledlightfantastic_aout_clipped_total", "Raw readings of the channel's pot at or beyond the ADC range.", labels, nil),
+		autoMode: prometheus.NewDesc("ledlightfantastic_auto_mode", "1 while auto mode is active.", nil, nil),
+		loopRate: prometheus.NewDesc("ledlightfantastic_loop_rate_hz", "Main loop iterations per second achieved over the last second.", nil, nil),
+	}
+}
+
+func (c *statusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.aout
+	ch <- c.median
+	ch <- c.duty
+	ch <- c.clipped
+	ch <- c.autoMode
+	ch <- c.loopRate
+}
+
+func (c *statusCollector) Collect(ch chan<- prometheus.Metric) {
+	s := snapshotStatus()
+	for _, st := range s.Channels {
+		step := strconv.Itoa(int(st.Step))
+		ch <- prometheus.MustNewConstMetric(c.aout, prometheus.GaugeValue, float64(st.Aout), step, st.Name)
+		ch <- prometheus.MustNewConstMetric(c.median, prometheus.GaugeValue, st.Median, step, st.Name)
+		ch <- prometheus.MustNewConstMetric(c.duty, prometheus.GaugeValue, st.Duty.Seconds(), step, st.Name)
+		ch <- prometheus.MustNewConstMetric(c.clipped, prometheus.CounterValue, float64(st.Clipped), step, st.Name)
+	}
+	var auto float64
+	if s.AutoMode {
+		auto = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.autoMode, prometheus.GaugeValue, auto)
+	ch <- prometheus.MustNewConstMetric(c.loopRate, prometheus.GaugeValue, s.LoopRate)
+}
+
+// registerMetrics adds the fixture's metrics to the default registry.
+func registerMetrics() {
+	prometheus.MustRegister(loopSeconds, missedTicks, underReads, newStatusCollector())
+}
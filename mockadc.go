@@ -0,0 +1,198 @@
+package main
+
+import "time"
+
+// mockADC serves scripted readings in place of the converter so the rest
+// of the program runs, and can be tested, off the BeagleBone. Each call to
+// ReadAnalog returns the next entry of the script, wrapping around, or
+// with samples above 1 the average of that many entries, as
+// ReadAnalogSamples takes that many conversions.
+type mockADC struct {
+	script  []map[byte]int
+	next    int
+	samples int
+	ready   bool
+}
+
+func newMockADC(script []map[byte]int) *mockADC {
+	return &mockADC{script: script}
+}
+
+func (m *mockADC) Init(clockDivider, sampleAvg byte, steps int) error {
+	m.ready = true
+	return nil
+}
+
+func (m *mockADC) ReadAnalog(pins ...Pin) (map[byte]int, error) {
+	if !m.ready {
+		return nil, ErrNotMapped
+	}
+	if len(pins) == 0 {
+		return nil, ErrNoPins
+	}
+	samples := m.samples
+	if samples < 1 {
+		samples = 1
+	}
+	// like the hardware, only the requested steps come back
+	sums := make(map[byte]int, len(pins))
+	counts := make(map[byte]int, len(pins))
+	for i := 0; i < samples && len(m.script) > 0; i++ {
+		entry := m.script[m.next]
+		m.next = (m.next + 1) % len(m.script)
+		for _, pin := range pins {
+			if aout, ok := entry[pin.bank_id]; ok {
+				sums[pin.bank_id] += aout
+				counts[pin.bank_id]++
+			}
+		}
+	}
+	aoutMap := make(map[byte]int, len(pins))
+	for step, sum := range sums {
+		aoutMap[step] = (sum + counts[step]/2) / counts[step]
+	}
+	if missing := missingSteps(aoutMap, pins); len(missing) > 0 {
+		return aoutMap, &UnderReadError{Missing: missing}
+	}
+	return aoutMap, nil
+}
+
+func (m *mockADC) Disable() {
+	m.ready = false
+}
+
+// sweepScript turns each of steps pots from 0 to full and back over
+// length readings, each pot a little behind the one before.
+func sweepScript(steps, length int) []map[byte]int {
+	script := make([]map[byte]int, length)
+	for i := range script {
+		script[i] = make(map[byte]int, steps)
+		for step := 0; step < steps; step++ {
+			pos := (i + step*length/(2*steps)) % length
+			if pos > length/2 {
+				pos = length - pos
+			}
+			script[i][byte(step)] = pos * (ainLevels - 1) / (length / 2)
+		}
+	}
+	return script
+}
+
+// mockFIFO models FIFO0 in place of mappedFIFO, so the code that reads
+// the converter can be tested off the BeagleBone. Entries come out oldest
+// first, and each pop takes one off, as each read of the data register
+// does.
+//
+// Tests push entries themselves, or let the enabled steps convert: one at
+// a time in step order from when they are enabled, each taking convert
+// and landing its sample from aouts, then clearing its own enable as a
+// one-shot step does. Continuous steps keep theirs and go round until
+// disabled. The conversions due land whenever the FIFO is looked at. As
+// on the AM335x, a full FIFO takes no more: a sample that finds it full
+// is lost, and counted in overruns, until it is read down.
+type mockFIFO struct {
+	words    []uint32
+	level    int  // entries that raise the threshold flag; 0 never does
+	flagged  bool // the threshold flag, until cleared
+	stuck    bool // pop leaves the entry, as a hung converter does
+	overruns int
+
+	aouts      map[byte]int // by step
+	ramp       int          // added to a step's sample for each conversion it has made
+	converted  map[byte]int
+	convert    time.Duration // per step; above 0 if continuous
+	continuous bool
+	steps      byte      // STEPENABLE
+	on         bool      // CTRL_ENABLE
+	next       byte      // the step converting is the first enabled from here
+	since      time.Time // when it started
+}
+
+// push adds a sample for step, as a conversion would, tagged with its
+// step ID.
+func (f *mockFIFO) push(step byte, aout int) {
+	if len(f.words) >= ADC_FIFO_DEPTH {
+		f.overruns++
+		return
+	}
+	f.words = append(f.words, uint32(step)<<16|uint32(aout)&ADC_FIFO_MASK)
+	if f.level > 0 && len(f.words) >= f.level {
+		f.flagged = true
+	}
+}
+
+// convertDue lands the conversions finished by now.
+func (f *mockFIFO) convertDue() {
+	now := time.Now()
+	for f.on && f.steps&^1 != 0 {
+		step := f.nextStep()
+		if now.Sub(f.since) < f.convert {
+			return
+		}
+		f.since = f.since.Add(f.convert)
+		if f.converted == nil {
+			f.converted = make(map[byte]int)
+		}
+		f.push(step, f.aouts[step]+f.ramp*f.converted[step])
+		f.converted[step]++
+		if !f.continuous {
+			f.steps &^= 1 << (step + 1)
+		}
+		f.next = step + 1
+	}
+}
+
+// nextStep is the first enabled step from next on, wrapping around.
+func (f *mockFIFO) nextStep() byte {
+	for i := 0; i < len(ainPins); i++ {
+		step := (int(f.next) + i) % len(ainPins)
+		if f.steps&(1<<(step+1)) != 0 {
+			return byte(step)
+		}
+	}
+	return f.next
+}
+
+func (f *mockFIFO) count() byte {
+	f.convertDue()
+	return byte(len(f.words))
+}
+
+// pop returns the oldest entry, or 0 like the hardware when empty.
+func (f *mockFIFO) pop() uint32 {
+	f.convertDue()
+	if len(f.words) == 0 {
+		return 0
+	}
+	word := f.words[0]
+	if !f.stuck {
+		f.words = f.words[1:]
+	}
+	return word
+}
+
+func (f *mockFIFO) thresholdReached() bool {
+	f.convertDue()
+	return f.flagged
+}
+
+func (f *mockFIFO) clearThreshold() {
+	f.flagged = false
+}
+
+// enableSteps starts the sequence over from the first step if it had
+// finished.
+func (f *mockFIFO) enableSteps(bits byte) {
+	f.convertDue()
+	if !f.on || f.steps&^1 == 0 {
+		f.next, f.since = 0, time.Now()
+	}
+	f.steps |= bits
+	f.on = true
+}
+
+func (f *mockFIFO) disableSteps(bits byte) {
+	f.convertDue()
+	f.steps &^= bits
+	f.on = false
+}
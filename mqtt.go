@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	mqttClientID     = "LEDLightFantastic"
+	mqttMax          = 100 // brightness payloads are 0-100
+	mqttStateRefresh = time.Second
+)
+
+// mqttSource follows <prefix>/<step>/set topics for home automation and
+// publishes each LED's level to <prefix>/<step>/state. It is in charge of
+// the LEDs while connected to the broker; the pots take over again when
+// the connection drops.
+type mqttSource struct {
+	client mqtt.Client
+	prefix string
+	count  int // number of LEDs
+	out    chan map[byte]int
+
+	mu     sync.Mutex
+	levels map[byte]int // latest level per step on the ADC scale
+}
+
+func newMQTTSource(broker, prefix string, count int) (*mqttSource, error) {
+	m := &mqttSource{prefix: prefix, count: count, out: make(chan map[byte]int, 1)}
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(mqttClientID).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(m.connected).
+		SetConnectionLostHandler(m.lost)
+	m.client = mqtt.NewClient(opts)
+	if t := m.client.Connect(); t.Wait() && t.Error() != nil {
+		return nil, t.Error()
+	}
+	go m.publishState()
+	return m, nil
+}
+
+func (m *mqttSource) name() string                { return "mqtt" }
+func (m *mqttSource) frames() <-chan map[byte]int { return m.out }
+
+func (m *mqttSource) topic(step byte, leaf string) string {
+	return fmt.Sprintf("%s/%d/%s", m.prefix, step, leaf)
+}
+
+// connected takes over from the pots, starting from whatever the LEDs are
+// showing now, and subscribes to the set topics. It also runs after every
+// reconnect.
+func (m *mqttSource) connected(c mqtt.Client) {
+	slog.Info("MQTT connected")
+	s := snapshotStatus()
+	m.mu.Lock()
+	m.levels = make(map[byte]int, m.count)
+	for step := 0; step < m.count; step++ {
+		if step < len(s.Channels) {
+			m.levels[byte(step)] = int(s.Channels[step].Median)
+		}
+	}
+	m.send()
+	m.mu.Unlock()
+
+	for step := 0; step < m.count; step++ {
+		topic := m.topic(byte(step), "set")
+		if t := c.Subscribe(topic, 0, m.set); t.Wait() && t.Error() != nil {
+			slog.Error("could not subscribe", "topic", topic, "err", t.Error())
+		}
+	}
+}
+
+// lost hands the LEDs back to the pots.
+func (m *mqttSource) lost(c mqtt.Client, err error) {
+	slog.Warn("MQTT connection lost", "err", err)
+	sendLatest(m.out, nil)
+}
+
+// set handles a 0-100 brightness on <prefix>/<step>/set.
+func (m *mqttSource) set(c mqtt.Client, msg mqtt.Message) {
+	parts := strings.Split(msg.Topic(), "/")
+	if len(parts) < 2 {
+		return
+	}
+	step, err := strconv.Atoi(parts[len(parts)-2])
+	if err != nil || step < 0 || step >= m.count {
+		return
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(string(msg.Payload())), 64)
+	if err != nil || v < 0 || v > mqttMax {
+		slog.Warn("ignoring MQTT message: payload out of range", "topic", msg.Topic(), "payload", string(msg.Payload()), "max", mqttMax)
+		return
+	}
+	m.mu.Lock()
+	m.levels[byte(step)] = int(v * (ainLevels - 1) / mqttMax)
+	m.send()
+	m.mu.Unlock()
+}
+
+// send passes a copy of levels to the main loop; call with mu held.
+func (m *mqttSource) send() {
+	frame := make(map[byte]int, len(m.levels))
+	for step, level := range m.levels {
+		frame[step] = level
+	}
+	sendLatest(m.out, frame)
+}
+
+// publishState keeps the retained state topics in step with the LEDs,
+// whether MQTT or the pots are in charge.
+func (m *mqttSource) publishState() {
+	defer failsafe()
+	last := make(map[byte]int)
+	for range time.Tick(mqttStateRefresh) {
+		if !m.client.IsConnectionOpen() {
+			continue
+		}
+		for _, ch := range snapshotStatus().Channels {
+			level := int(math.Round(ch.Median * mqttMax / (ainLevels - 1)))
+			if prev, ok := last[ch.Step]; ok && prev == level {
+				continue
+			}
+			last[ch.Step] = level
+			m.client.Publish(m.topic(ch.Step, "state"), 0, true, strconv.Itoa(level))
+		}
+	}
+}
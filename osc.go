@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oscBufSize      = 1536 // larger than any packet on an ethernet link
+	oscStateRefresh = 200 * time.Millisecond
+)
+
+var (
+	oscBundleID   = []byte("#bundle\x00")
+	errOSCPadding = errors.New("OSC packet truncated")
+)
+
+// oscMessage is an OSC message with its numeric arguments.
+type oscMessage struct {
+	addr string
+	args []float64
+}
+
+// oscSource takes levels from OSC controllers such as TouchOSC or Max.
+// /led/{step} takes a float from 0 to 1 and /all takes one float per LED.
+// The first message takes over from the pots, which then stay out of it
+// until restart, as with Art-Net. With a reply address, each LED's level
+// is sent back as /led/{step} so faders follow the fixture.
+type oscSource struct {
+	conn  *net.UDPConn
+	reply *net.UDPAddr // nil for no feedback
+	count int          // number of LEDs
+	out   chan map[byte]int
+
+	mu     sync.Mutex
+	levels map[byte]int // latest level per step on the ADC scale
+}
+
+func newOSCSource(addr, reply string, count int) (*oscSource, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	o := &oscSource{count: count, out: make(chan map[byte]int, 1)}
+	if reply != "" {
+		if o.reply, err = net.ResolveUDPAddr("udp", reply); err != nil {
+			return nil, err
+		}
+	}
+	if o.conn, err = net.ListenUDP("udp", udpAddr); err != nil {
+		return nil, err
+	}
+	go o.run()
+	if o.reply != nil {
+		go o.publishState()
+	}
+	return o, nil
+}
+
+func (o *oscSource) name() string                { return "osc" }
+func (o *oscSource) frames() <-chan map[byte]int { return o.out }
+
+func (o *oscSource) run() {
+	defer failsafe()
+	buf := make([]byte, oscBufSize)
+	for {
+		n, _, err := o.conn.ReadFromUDP(buf)
+		if err != nil {
+			slog.Error("OSC input stopped", "err", err)
+			return
+		}
+		msgs, err := parseOSC(buf[:n])
+		if err != nil {
+			slog.Debug("ignoring OSC packet", "err", err)
+			continue
+		}
+		for _, m := range msgs {
+			o.handle(m)
+		}
+	}
+}
+
+// handle applies one message and passes the new levels to the main loop.
+func (o *oscSource) handle(m oscMessage) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.levels == nil {
+		// start from whatever the LEDs are showing now
+		s := snapshotStatus()
+		o.levels = make(map[byte]int, o.count)
+		for step := 0; step < o.count && step < len(s.Channels); step++ {
+			o.levels[byte(step)] = int(s.Channels[step].Median)
+		}
+	}
+
+	switch {
+	case m.addr == "/all":
+		if len(m.args) != o.count {
+			slog.Warn("ignoring OSC message: need one level per LED", "addr", m.addr, "args", len(m.args), "leds", o.count)
+			return
+		}
+		for _, v := range m.args {
+			if !oscLevelOK(v) {
+				slog.Warn("ignoring OSC message: level must be 0 to 1", "addr", m.addr, "level", v)
+				return
+			}
+		}
+		for step, v := range m.args {
+			o.levels[byte(step)] = oscLevel(v)
+		}
+	case strings.HasPrefix(m.addr, "/led/"):
+		step, err := strconv.Atoi(strings.TrimPrefix(m.addr, "/led/"))
+		if err != nil || step < 0 || step >= o.count || len(m.args) != 1 || !oscLevelOK(m.args[0]) {
+			slog.Warn("ignoring OSC message: want /led/{step} with a level of 0 to 1", "addr", m.addr, "args", m.args)
+			return
+		}
+		o.levels[byte(step)] = oscLevel(m.args[0])
+	default:
+		return
+	}
+
+	frame := make(map[byte]int, len(o.levels))
+	for step, level := range o.levels {
+		frame[step] = level
+	}
+	sendLatest(o.out, frame)
+}
+
+func oscLevelOK(v float64) bool { return v >= 0 && v <= 1 }
+
+// oscLevel converts a 0 to 1 level onto the ADC scale.
+func oscLevel(v float64) int {
+	return int(math.Round(v * (ainLevels - 1)))
+}
+
+// publishState sends each LED's level to the reply address when it changes,
+// whether OSC or the pots are in charge.
+func (o *oscSource) publishState() {
+	defer failsafe()
+	last := make(map[byte]float32)
+	for range time.Tick(oscStateRefresh) {
+		for _, ch := range snapshotStatus().Channels {
+			level := float32(ch.Median / (ainLevels - 1))
+			if prev, ok := last[ch.Step]; ok && prev == level {
+				continue
+			}
+			last[ch.Step] = level
+			p := appendOSCMessage(nil, fmt.Sprintf("/led/%d", ch.Step), level)
+			if _, err := o.conn.WriteToUDP(p, o.reply); err != nil {
+				slog.Debug("could not send OSC state", "addr", o.reply, "err", err)
+			}
+		}
+	}
+}
+
+// parseOSC returns the messages in an OSC packet, unpacking bundles.
+// Messages with arguments other than numbers are skipped.
+func parseOSC(p []byte) ([]oscMessage, error) {
+	if bytes.HasPrefix(p, oscBundleID) {
+		// bundle ID and time tag, then size-prefixed elements
+		if len(p) < 16 {
+			return nil, errOSCPadding
+		}
+		var msgs []oscMessage
+		for p = p[16:]; len(p) > 0; {
+			if len(p) < 4 {
+				return nil, errOSCPadding
+			}
+			size := int(binary.BigEndian.Uint32(p))
+			if size < 0 || 4+size > len(p) {
+				return nil, errOSCPadding
+			}
+			inner, err := parseOSC(p[4 : 4+size])
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, inner...)
+			p = p[4+size:]
+		}
+		return msgs, nil
+	}
+
+	addr, p, err := oscString(p)
+	if err != nil {
+		return nil, err
+	}
+	tags, p, err := oscString(p)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(tags, ",") {
+		return nil, fmt.Errorf("OSC message %s has no type tags", addr)
+	}
+	m := oscMessage{addr: addr}
+	for _, tag := range tags[1:] {
+		var size int
+		switch tag {
+		case 'f', 'i':
+			size = 4
+		case 'd':
+			size = 8
+		default:
+			return nil, nil
+		}
+		if len(p) < size {
+			return nil, errOSCPadding
+		}
+		switch tag {
+		case 'f':
+			m.args = append(m.args, float64(math.Float32frombits(binary.BigEndian.Uint32(p))))
+		case 'i':
+			m.args = append(m.args, float64(int32(binary.BigEndian.Uint32(p))))
+		case 'd':
+			m.args = append(m.args, math.Float64frombits(binary.BigEndian.Uint64(p)))
+		}
+		p = p[size:]
+	}
+	return []oscMessage{m}, nil
+}
+
+// oscString reads a NUL terminated string padded to 4 bytes.
+func oscString(p []byte) (string, []byte, error) {
+	end := bytes.IndexByte(p, 0)
+	if end < 0 {
+		return "", nil, errOSCPadding
+	}
+	next := (end + 4) &^ 3
+	if next > len(p) {
+		return "", nil, errOSCPadding
+	}
+	return string(p[:end]), p[next:], nil
+}
+
+// appendOSCMessage encodes a message with one float argument.
+func appendOSCMessage(p []byte, addr string, v float32) []byte {
+	p = appendOSCString(p, addr)
+	p = appendOSCString(p, ",f")
+	return binary.BigEndian.AppendUint32(p, math.Float32bits(v))
+}
+
+func appendOSCString(p []byte, s string) []byte {
+	p = append(p, s...)
+	return append(p, make([]byte, 4-len(s)%4)...)
+}
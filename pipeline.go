@@ -0,0 +1,65 @@
+package main
+
+import "time"
+
+// channelInput is one channel's part of a loop: a reading for the
+// brightness curve, or a duty set past the curve, as scenes, auto mode's
+// effects, -replay and a restart's saved duty give.
+type channelInput struct {
+	aout   float64
+	duty   time.Duration
+	direct bool // duty is used and aout is not
+}
+
+// dutyInputs is everything besides the channels' own inputs that decides
+// a loop's duties. POST /preview gathers the same from the running loop.
+type dutyInputs struct {
+	overrides map[byte]time.Duration // POST /led and /color, past the curve
+	disabled  []bool                 // by step; off whatever they are given
+	ambient   float64                // -ambient's scale, 1 without a sensor
+	fade      float64                // the startup fade-in, 1 once done
+	master    float64                // the master pot, 1 without one
+	recorded  bool                   // -replay duties, already scaled
+	// each channel's floor and ceiling, as minDuty and maxDuty give them,
+	// and the total current limit, -thermal throttling included
+	minDuties, maxDuties []time.Duration
+	limit                time.Duration
+}
+
+// pipelineDuties takes one loop's inputs through the curve, the overrides,
+// ambient light, the fade-in, trim and the master level, switches the
+// disabled channels off and last applies max_duty and the current limit
+// with normalize. raw gets the duties before the limits and applied after,
+// and it returns whether the limit scaled them down.
+//
+// It keeps no state and touches no PWM line, so POST /preview runs it just
+// as the main loop does. The main loop's stages that keep state between
+// loops, freezing, the emergency lights and the slew limit, go in hold,
+// which is handed the scaled duties before any channel is switched off;
+// nil for none.
+func (c *Config) pipelineDuties(curve Curve, in []channelInput, d *dutyInputs, hold func(raw []time.Duration), raw, applied []time.Duration) (scaled bool) {
+	for step := range in {
+		duty := in[step].duty
+		if !in[step].direct {
+			duty = c.potDuty(curve, byte(step), d.minDuties[step], in[step].aout)
+		}
+		if o, ok := d.overrides[byte(step)]; ok {
+			duty = o
+		}
+		if !d.recorded {
+			// trim balances the colors and the master pot dims them all;
+			// max_duty and the total limit still cap the result
+			duty = time.Duration(float64(duty) * d.ambient * d.fade * c.trim(byte(step)) * d.master)
+		}
+		raw[step] = duty
+	}
+	if hold != nil {
+		hold(raw)
+	}
+	for step := range raw {
+		if d.disabled[step] {
+			raw[step] = 0
+		}
+	}
+	return normalize(raw, d.minDuties, d.maxDuties, applied, d.limit, c.limiterKnee())
+}
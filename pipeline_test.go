@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dutyPoint is one reading's calibrated pot value and applied duty for a
+// channel.
+type dutyPoint struct {
+	aout float64
+	duty time.Duration
+}
+
+// TestPipelineSweep runs one full mock pot sweep through calibration and
+// pipelineDuties and checks the applied duties: each within its
+// max_duty, all of them together within the current limit, and each
+// following the brightness curve, so a higher reading never gives a lower
+// duty.
+func TestPipelineSweep(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(c *Config)
+	}{
+		{"defaults", func(c *Config) {}},
+		{"max duty", func(c *Config) {
+			c.Channels[0].MaxDuty = 0.3
+			c.Channels[2].MaxDuty = 0.5
+		}},
+		{"min duty", func(c *Config) {
+			for i := range c.Channels {
+				c.Channels[i].MinDuty = 0.01
+			}
+		}},
+		{"trim and output range", func(c *Config) {
+			trim := 0.6
+			c.Channels[1].Trim = &trim
+			c.OutputMin, c.OutputMax = 0.05, 0.9
+		}},
+		{"compressor", func(c *Config) {
+			c.Limiter = limiterCompressor
+		}},
+		{"linear", func(c *Config) {
+			c.Curve = curveLinear
+		}},
+		{"calibrated", func(c *Config) {
+			c.Channels[3].AoutMin, c.Channels[3].AoutMax = 300, 3800
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfig()
+			tt.config(c)
+			if err := c.validate(); err != nil {
+				t.Fatal(err)
+			}
+			curve, err := newCurve(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n := len(c.Channels)
+			pins := ainPins[:n]
+			adc := newMockADC(sweepScript(stepCount(pins), mockSweepLength))
+			if err := adc.Init(0, ADC_AVG_1, stepCount(pins)); err != nil {
+				t.Fatal(err)
+			}
+
+			raw := make([]time.Duration, n)
+			applied := make([]time.Duration, n)
+			in := make([]channelInput, n)
+			d := testInputs(c)
+			minDuties, maxDuties, limit := d.minDuties, d.maxDuties, d.limit
+			points := make([][]dutyPoint, n)
+			for loop := 0; loop < mockSweepLength; loop++ {
+				aoutMap, err := adc.ReadAnalog(pins...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for step := range c.Channels {
+					in[step] = channelInput{aout: float64(c.Channels[step].calibrated(aoutMap[byte(step)]))}
+				}
+				scaled := c.pipelineDuties(curve, in, d, nil, raw, applied)
+
+				var sum time.Duration
+				for step, d := range applied {
+					if d > maxDuties[step] && d > minDuties[step] {
+						t.Fatalf("loop %d: step %d duty %v above max_duty %v", loop, step, d, maxDuties[step])
+					}
+					if d < 0 {
+						t.Fatalf("loop %d: step %d duty %v below 0", loop, step, d)
+					}
+					sum += d
+				}
+				if sum > limit {
+					t.Fatalf("loop %d: total duty %v above the current limit %v", loop, sum, limit)
+				}
+				if !scaled {
+					for step := range applied {
+						points[step] = append(points[step], dutyPoint{in[step].aout, applied[step]})
+					}
+				}
+			}
+
+			for step, p := range points {
+				if len(p) < mockSweepLength/4 {
+					t.Fatalf("step %d: only %d unscaled readings to check the curve with", step, len(p))
+				}
+				sort.Slice(p, func(i, j int) bool { return p[i].aout < p[j].aout })
+				for i := 1; i < len(p); i++ {
+					if p[i].aout > p[i-1].aout && p[i].duty < p[i-1].duty {
+						t.Fatalf("step %d: duty falls as the reading rises: %v at %v, %v at %v",
+							step, p[i-1].duty, p[i-1].aout, p[i].duty, p[i].aout)
+					}
+				}
+			}
+		})
+	}
+}
+
+// testInputs are the dutyInputs of a loop with nothing but the pots: no
+// overrides, no disabled channels, no ambient light or master pot.
+func testInputs(c *Config) *dutyInputs {
+	n := len(c.Channels)
+	d := &dutyInputs{
+		disabled:  make([]bool, n),
+		ambient:   1,
+		fade:      1,
+		master:    1,
+		minDuties: make([]time.Duration, n),
+		maxDuties: make([]time.Duration, n),
+		limit:     c.maxTotalDuty(),
+	}
+	for step := range c.Channels {
+		d.minDuties[step], d.maxDuties[step] = c.minDuty(byte(step)), c.maxDuty(byte(step))
+	}
+	return d
+}
+
+// TestPipelineStages checks each stage of pipelineDuties on a channel at
+// a time, before max_duty and the current limit.
+func TestPipelineStages(t *testing.T) {
+	c := defaultConfig()
+	trim := 0.5
+	c.Channels[1].Trim = &trim
+	curve, err := newCurve(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := c.curveDuty(curve, 2048) + ainMinPad // uncalibrated
+	tenth := pwmPeriod / 10
+	scale := func(d time.Duration, f float64) time.Duration { return time.Duration(float64(d) * f) }
+	tests := []struct {
+		name  string
+		in    channelInput
+		setup func(d *dutyInputs)
+		want  [2]time.Duration // channels 0 and 1, trimmed by half
+	}{
+		{"curve", channelInput{aout: 2048}, nil, [2]time.Duration{half, half / 2}},
+		{"direct", channelInput{duty: tenth, direct: true}, nil, [2]time.Duration{tenth, tenth / 2}},
+		{"override", channelInput{aout: 2048}, func(d *dutyInputs) {
+			d.overrides = map[byte]time.Duration{0: tenth, 1: tenth}
+		}, [2]time.Duration{tenth, tenth / 2}},
+		{"ambient", channelInput{duty: tenth, direct: true}, func(d *dutyInputs) {
+			d.ambient = 0.4
+		}, [2]time.Duration{scale(tenth, 0.4), scale(tenth, 0.4*0.5)}},
+		{"fade and master", channelInput{duty: tenth, direct: true}, func(d *dutyInputs) {
+			d.fade, d.master = 0.5, 0.6
+		}, [2]time.Duration{scale(tenth, 0.5*0.6), scale(tenth, 0.5*0.5*0.6)}},
+		{"recorded", channelInput{duty: tenth, direct: true}, func(d *dutyInputs) {
+			d.recorded = true
+			d.ambient, d.master = 0.4, 0.6
+		}, [2]time.Duration{tenth, tenth}},
+		{"disabled", channelInput{duty: tenth, direct: true}, func(d *dutyInputs) {
+			d.disabled[1] = true
+			d.overrides = map[byte]time.Duration{1: tenth}
+		}, [2]time.Duration{tenth, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := testInputs(c)
+			if tt.setup != nil {
+				tt.setup(d)
+			}
+			n := len(c.Channels)
+			in := make([]channelInput, n)
+			in[0], in[1] = tt.in, tt.in
+			raw, applied := make([]time.Duration, n), make([]time.Duration, n)
+			held := false
+			hold := func(duties []time.Duration) {
+				held = true
+				if tt.want[0] != duties[0] {
+					t.Errorf("hold given %v, want %v", duties[0], tt.want[0])
+				}
+			}
+			if c.pipelineDuties(curve, in, d, hold, raw, applied) {
+				t.Error("scaled down below the limit")
+			}
+			if !held {
+				t.Error("hold not called")
+			}
+			for step, want := range tt.want {
+				if raw[step] != want || applied[step] != want {
+					t.Errorf("step %d: raw %v applied %v, want %v", step, raw[step], applied[step], want)
+				}
+			}
+		})
+	}
+}
+
+// TestPreviewMatchesLoop sets up overrides, a disabled channel and a
+// published ambient light and master level, and checks POST /preview
+// gives what pipelineDuties gives the main loop for the same readings.
+func TestPreviewMatchesLoop(t *testing.T) {
+	c := defaultConfig()
+	trim := 0.7
+	c.Channels[2].Trim = &trim
+	useConfig(t, c)
+	prevCurve := brightness
+	curve, err := newCurve(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	brightness = curve
+	prevStatus := snapshotStatus()
+	t.Cleanup(func() {
+		brightness = prevCurve
+		publishStatus(&prevStatus)
+		overrides.Lock()
+		overrides.duty = nil
+		overrides.Unlock()
+		disableFromConfig(conf)
+	})
+
+	disableFromConfig(c)
+	setDisabled(3, true)
+	setOverrides(map[byte]time.Duration{1: pwmPeriod / 3})
+	publishStatus(&fixtureStatus{Channels: make([]channelStatus, 4), Ambient: 0.6, Master: 0.8})
+
+	aouts := []float64{4095, 1000, 3000, 4095}
+	w := httptest.NewRecorder()
+	apiHandler().ServeHTTP(w, httptest.NewRequest("POST", "/preview", strings.NewReader(`{"aout": [4095, 1000, 3000, 4095]}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var got preview
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	// what the main loop does with the same readings and state
+	d := testInputs(c)
+	d.overrides = map[byte]time.Duration{1: pwmPeriod / 3}
+	d.disabled[3] = true
+	d.ambient, d.master = 0.6, 0.8
+	in := make([]channelInput, len(aouts))
+	for step, aout := range aouts {
+		in[step] = channelInput{aout: float64(c.Channels[step].calibrated(int(aout)))}
+	}
+	raw, applied := make([]time.Duration, len(aouts)), make([]time.Duration, len(aouts))
+	scaled := c.pipelineDuties(curve, in, d, nil, raw, applied)
+
+	if got.Normalized != scaled {
+		t.Errorf("preview normalized %v, loop %v", got.Normalized, scaled)
+	}
+	for step, ch := range got.Channels {
+		if ch.Raw != raw[step] || ch.Duty != applied[step] {
+			t.Errorf("step %d: preview raw %v duty %v, loop raw %v duty %v", step, ch.Raw, ch.Duty, raw[step], applied[step])
+		}
+	}
+	if got.Channels[3].Duty != 0 {
+		t.Errorf("disabled step 3 previewed at %v", got.Channels[3].Duty)
+	}
+}
+
+// TestFullPots turns every pot all the way up and checks the summed
+// applied duty stays within maxTotalDuty, the fixture's current limit.
+func TestFullPots(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(c *Config)
+	}{
+		{"defaults", func(c *Config) {}},
+		{"compressor", func(c *Config) { c.Limiter = limiterCompressor }},
+		{"linear", func(c *Config) { c.Curve = curveLinear }},
+		{"long period", func(c *Config) { c.PWMPeriod.Duration = pwmPeriodMax }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfig()
+			tt.config(c)
+			if err := c.validate(); err != nil {
+				t.Fatal(err)
+			}
+			curve, err := newCurve(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n := len(c.Channels)
+			in := make([]channelInput, n)
+			for step := range in {
+				in[step] = channelInput{aout: float64(c.Channels[step].calibrated(ainLevels - 1))}
+			}
+			raw, applied := make([]time.Duration, n), make([]time.Duration, n)
+			if !c.pipelineDuties(curve, in, testInputs(c), nil, raw, applied) {
+				t.Error("not scaled down with every pot at full")
+			}
+			var sum time.Duration
+			for _, d := range applied {
+				sum += d
+			}
+			if sum > c.maxTotalDuty() {
+				t.Errorf("total duty %v above maxTotalDuty %v", sum, c.maxTotalDuty())
+			}
+		})
+	}
+}
+
+// TestClampOrder checks output_min and output_max clamp the curve's duty
+// before trim and the master level scale it, so those dim a channel past
+// either end of the range, and that the current limit comes last.
+func TestClampOrder(t *testing.T) {
+	c := defaultConfig()
+	c.OutputMin, c.OutputMax = 0.1, 0.6
+	trim := 0.5
+	c.Channels[1].Trim = &trim
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	curve, err := newCurve(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	period := c.PWMPeriod.Duration
+	frac := func(f float64) time.Duration { return time.Duration(f * float64(period)) }
+	tests := []struct {
+		name    string
+		aout    float64
+		master  float64
+		wantRaw [2]time.Duration // channels 0 and 1, trimmed by half
+	}{
+		{"full", ainLevels - 1, 1, [2]time.Duration{frac(0.6), frac(0.3)}},
+		{"off", 0, 1, [2]time.Duration{frac(0.1), frac(0.05)}},
+		{"full, master at half", ainLevels - 1, 0.5, [2]time.Duration{frac(0.3), frac(0.15)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := len(c.Channels)
+			in := make([]channelInput, n)
+			for step := range in {
+				in[step] = channelInput{aout: tt.aout}
+			}
+			d := testInputs(c)
+			d.master = tt.master
+			raw, applied := make([]time.Duration, n), make([]time.Duration, n)
+			scaled := c.pipelineDuties(curve, in, d, nil, raw, applied)
+			for step, want := range tt.wantRaw {
+				if raw[step] != want {
+					t.Errorf("step %d: %v before the limit, want %v", step, raw[step], want)
+				}
+			}
+
+			var rawSum, sum time.Duration
+			for step := range raw {
+				rawSum += raw[step]
+				sum += applied[step]
+			}
+			if scaled != (rawSum > d.limit) {
+				t.Errorf("scaled %v with %v against a limit of %v", scaled, rawSum, d.limit)
+			}
+			if sum > d.limit {
+				t.Errorf("total %v above the limit %v", sum, d.limit)
+			}
+		})
+	}
+}
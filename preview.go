@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// previewChannel is what one channel would be given.
+type previewChannel struct {
+	Step byte   `json:"step"`
+	Name string `json:"name"`
+	// the reading after calibration, as the curve sees it
+	Aout float64 `json:"aout"`
+	// the duty before max_duty and the current limit, and after
+	Raw  time.Duration `json:"raw"`
+	Duty time.Duration `json:"duty"`
+}
+
+// preview is the outcome of a set of inputs, as POST /preview returns it.
+type preview struct {
+	Channels []previewChannel `json:"channels"`
+	Limit    time.Duration    `json:"limit"` // the total current limit
+	Total    time.Duration    `json:"total"` // the duties' sum
+	// the current limit scaled the duties down
+	Normalized bool `json:"normalized"`
+}
+
+// previewDuties runs the pots' readings, one per channel, through
+// pipelineDuties as the main loop would with d, and returns what each
+// channel would be given. It touches no PWM line and no state of the
+// loop's: the readings are taken as already smoothed, and deadband, slew,
+// auto mode, breathing, the LFO and scenes are left out.
+func (c *Config) previewDuties(curve Curve, aouts []float64, d *dutyInputs) preview {
+	n := len(c.Channels)
+	in := make([]channelInput, n)
+	raw := make([]time.Duration, n)
+	applied := make([]time.Duration, n)
+	p := preview{Channels: make([]previewChannel, n), Limit: d.limit}
+	for i := range c.Channels {
+		step := byte(i)
+		aout := float64(c.Channels[i].calibrated(int(aouts[i])))
+		in[i] = channelInput{aout: aout}
+		p.Channels[i] = previewChannel{Step: step, Name: c.channelName(step), Aout: aout}
+	}
+	p.Normalized = c.pipelineDuties(curve, in, d, nil, raw, applied)
+	for i := range p.Channels {
+		p.Channels[i].Raw, p.Channels[i].Duty = raw[i], applied[i]
+		p.Total += applied[i]
+	}
+	return p
+}
+
+// previewInputs gathers the running loop's dutyInputs for c: the overrides,
+// the disabled channels, the ambient light and master level it last
+// published and the current limit, -thermal throttling included. A preview
+// shows the fade-in as done.
+func previewInputs(c *Config) *dutyInputs {
+	n := len(c.Channels)
+	d := &dutyInputs{
+		overrides: currentOverrides(),
+		disabled:  make([]bool, n),
+		ambient:   1,
+		fade:      1,
+		master:    1,
+		minDuties: make([]time.Duration, n),
+		maxDuties: make([]time.Duration, n),
+		limit:     c.maxTotalDuty(),
+	}
+	for i := range c.Channels {
+		d.minDuties[i], d.maxDuties[i] = c.minDuty(byte(i)), c.maxDuty(byte(i))
+	}
+	disabledSteps.Lock()
+	for step := range disabledSteps.steps {
+		if int(step) < n {
+			d.disabled[step] = true
+		}
+	}
+	disabledSteps.Unlock()
+	// nothing is published before the first loop
+	if s := snapshotStatus(); len(s.Channels) > 0 {
+		if s.Ambient > 0 {
+			d.ambient = s.Ambient
+		}
+		d.master = s.Master
+		if *thermalPath != "" {
+			d.limit = time.Duration(float64(d.limit) * s.Throttle)
+		}
+	}
+	return d
+}
+
+// POST /preview {"aout": [0, 2048, 4095, 1000], "master": 1} shows the
+// duties the LEDs would get from those pot readings, one per channel,
+// without changing them. "color": {"h": 30, "s": 1, "v": 1, "w": 0} sets
+// the colored channels instead, as POST /color would. Everything else is
+// as the running loop has it: the overrides, disabled channels, ambient
+// light, the master level unless "master" is given, and the current limit,
+// -thermal throttling included.
+func handlePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c := currentConfig()
+	req := struct {
+		Aout   []float64 `json:"aout"`
+		Master *float64  `json:"master"`
+		Color  *struct {
+			H float64 `json:"h"`
+			S float64 `json:"s"`
+			V float64 `json:"v"`
+			W float64 `json:"w"`
+		} `json:"color"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, `body must be {"aout": [readings], "master": 0-1, "color": {"h", "s", "v", "w"}}`, http.StatusBadRequest)
+		return
+	}
+	if req.Aout == nil {
+		req.Aout = make([]float64, len(c.Channels))
+	}
+	if len(req.Aout) != len(c.Channels) {
+		writeError(w, fmt.Sprintf("aout needs one reading per channel: %d", len(c.Channels)), http.StatusBadRequest)
+		return
+	}
+	for _, aout := range req.Aout {
+		if aout < 0 || aout > ainLevels-1 {
+			writeError(w, fmt.Sprintf("aout readings must be 0 to %d", ainLevels-1), http.StatusBadRequest)
+			return
+		}
+	}
+	d := previewInputs(c)
+	if req.Master != nil {
+		if *req.Master < 0 || *req.Master > 1 {
+			writeError(w, "master must be 0 to 1", http.StatusBadRequest)
+			return
+		}
+		d.master = *req.Master
+	}
+	if col := req.Color; col != nil {
+		if col.S < 0 || col.S > 1 || col.V < 0 || col.V > 1 || col.W < 0 || col.W > 1 {
+			writeError(w, "s, v and w must be 0 to 1", http.StatusBadRequest)
+			return
+		}
+		colors := c.colorDuties(hsvToRGBW(col.H, col.S, col.V, col.W))
+		if len(colors) == 0 {
+			writeError(w, "no channel has a color", http.StatusConflict)
+			return
+		}
+		for step, duty := range colors {
+			d.overrides[step] = duty
+		}
+	}
+	writeJSON(w, c.previewDuties(currentCurve(), req.Aout, d))
+}
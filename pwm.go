@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/btittelbach/go-bbhw"
+)
+
+// PWM is the part of a PWM output the fixture uses. *bbhw.PWMLine drives
+// the real pins on 3.8 kernels and *classPWM on later ones; simPWM stands
+// in for them with -simulate.
+type PWM interface {
+	SetPWM(period, duty time.Duration)
+	SetPolarity(polarity bool)
+	DisablePWM()
+}
+
+var _ PWM = (*bbhw.PWMLine)(nil)
+
+// readablePWM is a PWM that reports what it is putting out. All three
+// backends are, so checkPWM can hold them to the same behaviour.
+type readablePWM interface {
+	PWM
+	GetPWM() (period, duty time.Duration)
+}
+
+var (
+	_ readablePWM = (*bbhw.PWMLine)(nil)
+	_ readablePWM = (*classPWM)(nil)
+	_ readablePWM = (*simPWM)(nil)
+)
+
+// checkPWM puts a line through what the fixture relies on from every PWM
+// backend: a duty written at period reads back within the PWM resolution,
+// a duty longer than the period is never put out, and a disabled line puts
+// out nothing. The line is left disabled; the caller sets it up again.
+func checkPWM(p readablePWM, period time.Duration) error {
+	var errs []error
+	res := conf.PWMResolution.Duration
+	near := func(a, b time.Duration) bool {
+		return a-b < res && b-a < res
+	}
+
+	duty := period / 4
+	p.SetPWM(period, duty)
+	if gotPeriod, gotDuty := p.GetPWM(); !near(gotPeriod, period) || !near(gotDuty, duty) {
+		errs = append(errs, fmt.Errorf("wrote period %v duty %v, read back period %v duty %v", period, duty, gotPeriod, gotDuty))
+	}
+	p.SetPWM(period, 2*period)
+	if _, gotDuty := p.GetPWM(); gotDuty > period {
+		errs = append(errs, fmt.Errorf("put out duty %v, longer than the period %v", gotDuty, period))
+	}
+	p.DisablePWM()
+	if _, gotDuty := p.GetPWM(); gotDuty != 0 {
+		errs = append(errs, fmt.Errorf("still puts out duty %v once disabled", gotDuty))
+	}
+	return errors.Join(errs...)
+}
+
+// powerSaver disables the PWM lines once every LED has been dark for a
+// while, to save power and heat, and brings them back when one lights.
+// Any lit LED restarts the wait, so a fixture being dimmed up and down is
+// never powered down between changes.
+type powerSaver struct {
+	after time.Duration
+	dark  time.Time // since when every LED has been dark; zero while one is lit
+	off   bool
+}
+
+// update takes each loop's applied duties before they are written and
+// powers the lines down or up. It returns false while they are off, when
+// there is nothing to write.
+func (p *powerSaver) update(now time.Time, LEDMap map[byte]*LED, applied, written []time.Duration) bool {
+	lit := false
+	for step, led := range LEDMap {
+		if applied[step] >= conf.PWMResolution.Duration || led.strobe != nil {
+			lit = true
+		}
+	}
+	switch {
+	case lit && p.off:
+		// DisablePWM may reset the line, so set it up again in full
+		for step, led := range LEDMap {
+			led.pwm.SetPolarity(conf.Channels[step].polarity())
+			written[step] = -1
+		}
+		p.off = false
+		p.dark = time.Time{}
+		slog.Info("PWM powered up")
+	case lit:
+		p.dark = time.Time{}
+	case p.off:
+		return false
+	case p.dark.IsZero():
+		p.dark = now
+	case now.Sub(p.dark) >= p.after:
+		for _, led := range LEDMap {
+			// an inverted LED would light on an idle pin; leave it at off
+			if !led.invert {
+				led.pwm.DisablePWM()
+			}
+		}
+		p.off = true
+		slog.Info("PWM powered down; all LEDs dark", "for", now.Sub(p.dark))
+		return false
+	}
+	return true
+}
+
+// simPWM logs what would be written to a PWM pin. Like the kernel, it
+// keeps the duty within the period, and a disabled line puts out nothing.
+type simPWM struct {
+	pin          string
+	period, duty time.Duration
+	polarity     bool
+}
+
+func (p *simPWM) SetPWM(period, duty time.Duration) {
+	slog.Info("simulated PWM", "pin", p.pin, "period", period, "duty", duty)
+	if duty > period {
+		duty = period
+	}
+	p.period, p.duty = period, duty
+}
+
+func (p *simPWM) GetPWM() (period, duty time.Duration) {
+	return p.period, p.duty
+}
+
+func (p *simPWM) SetPolarity(polarity bool) {
+	slog.Debug("simulated PWM polarity", "pin", p.pin, "polarity", polarity)
+	p.polarity = polarity
+}
+
+func (p *simPWM) DisablePWM() {
+	slog.Info("simulated PWM disabled", "pin", p.pin)
+	p.duty = 0
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestClassPWM lays out an exported channel's files in a temporary
+// directory, as the kernel would, and opens a classPWM on them.
+func newTestClassPWM(t *testing.T) *classPWM {
+	t.Helper()
+	dir := t.TempDir()
+	for name, value := range map[string]string{
+		"period":     "0",
+		"duty_cycle": "0",
+		"enable":     "0",
+		"polarity":   "normal",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &classPWM{pin: "P9_14", dir: dir}
+}
+
+func readPolarity(t *testing.T, p *classPWM) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join(p.dir, "polarity"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func TestCheckPWM(t *testing.T) {
+	backends := []struct {
+		name string
+		pwm  func(t *testing.T) readablePWM
+	}{
+		{"sim", func(t *testing.T) readablePWM { return &simPWM{pin: "P9_14"} }},
+		{"class", func(t *testing.T) readablePWM { return newTestClassPWM(t) }},
+	}
+	for _, b := range backends {
+		for _, period := range []time.Duration{50 * time.Microsecond, pwmPeriod, time.Millisecond} {
+			t.Run(b.name+"/"+period.String(), func(t *testing.T) {
+				if err := checkPWM(b.pwm(t), period); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+func TestPWMRoundTrip(t *testing.T) {
+	tests := []struct {
+		period, duty time.Duration
+		wantDuty     time.Duration
+	}{
+		{pwmPeriod, 0, 0},
+		{pwmPeriod, pwmPeriod / 3, pwmPeriod / 3},
+		{pwmPeriod, pwmPeriod, pwmPeriod},
+		{pwmPeriod, 2 * pwmPeriod, pwmPeriod}, // held to the period
+		// a shorter period after a long duty
+		{100 * time.Microsecond, 80 * time.Microsecond, 80 * time.Microsecond},
+		{time.Millisecond, 10 * time.Nanosecond, 10 * time.Nanosecond},
+	}
+	sim := &simPWM{pin: "P9_14"}
+	class := newTestClassPWM(t)
+	for _, p := range []readablePWM{sim, class} {
+		for _, tt := range tests {
+			p.SetPWM(tt.period, tt.duty)
+			if period, duty := p.GetPWM(); period != tt.period || duty != tt.wantDuty {
+				t.Errorf("%T: SetPWM(%v, %v) reads back period %v duty %v, want %v %v",
+					p, tt.period, tt.duty, period, duty, tt.period, tt.wantDuty)
+			}
+		}
+		p.DisablePWM()
+		if _, duty := p.GetPWM(); duty != 0 {
+			t.Errorf("%T: disabled line puts out duty %v", p, duty)
+		}
+	}
+}
+
+func TestPWMPolarity(t *testing.T) {
+	sim := &simPWM{pin: "P9_14"}
+	class := newTestClassPWM(t)
+	for _, polarity := range []bool{false, true, false} {
+		sim.SetPolarity(polarity)
+		if sim.polarity != polarity {
+			t.Errorf("simPWM: SetPolarity(%v) left polarity %v", polarity, sim.polarity)
+		}
+
+		class.SetPWM(pwmPeriod, pwmPeriod/2)
+		class.SetPolarity(polarity)
+		want := "normal"
+		if !polarity {
+			want = "inversed"
+		}
+		if got := readPolarity(t, class); got != want {
+			t.Errorf("classPWM: SetPolarity(%v) wrote %q, want %q", polarity, got, want)
+		}
+		// the kernel only takes a polarity with the line disabled
+		if class.enabled {
+			t.Errorf("classPWM: SetPolarity(%v) left the line enabled", polarity)
+		}
+		if _, duty := class.GetPWM(); duty != 0 {
+			t.Errorf("classPWM: SetPolarity(%v) left duty %v", polarity, duty)
+		}
+		// and the next SetPWM enables it again
+		class.SetPWM(pwmPeriod, pwmPeriod/2)
+		if _, duty := class.GetPWM(); duty != pwmPeriod/2 {
+			t.Errorf("classPWM: duty %v after SetPolarity(%v), want %v", duty, polarity, pwmPeriod/2)
+		}
+	}
+	if class.failed {
+		t.Error("classPWM: a write failed")
+	}
+}
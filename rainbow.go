@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// auto mode effects, chosen with -automode
+const (
+	autoRandom  = "random"  // each LED wanders around its pot on its own
+	autoDark    = "dark"    // the random walk, mostly below the pots and now and then above
+	autoRainbow = "rainbow" // the colored LEDs cycle through the hues together
+	autoChase   = "chase"   // the LEDs light one after another
+)
+
+// Time a rainbow cycle takes per unit of loop max: from a quarter second
+// with the speed pot at full to about four minutes at the bottom.
+const rainbowUnit = 250 * time.Millisecond
+
+// rainbowEffect turns the hue wheel at a rate set by the speed pot.
+type rainbowEffect struct {
+	hue  float64   // degrees
+	last time.Time // zero until the first advance after entering auto mode
+}
+
+// advance moves the hue on by the time since the last call, so the cycle
+// takes loopMax * rainbowUnit however fast the loop runs.
+func (r *rainbowEffect) advance(now time.Time, loopMax int) float64 {
+	if !r.last.IsZero() && loopMax > 0 {
+		cycle := float64(time.Duration(loopMax) * rainbowUnit)
+		r.hue = math.Mod(r.hue+360*float64(now.Sub(r.last))/cycle, 360)
+	}
+	r.last = now
+	return r.hue
+}
+
+// pause makes the next advance start afresh, so leaving auto mode for a
+// while does not make the hue jump.
+func (r *rainbowEffect) pause() {
+	r.last = time.Time{}
+}
+
+// duties gives the colored LEDs the current hue. The pots other than the
+// speed pot set the brightness together, from their mean.
+func (r *rainbowEffect) duties(now time.Time, loopMax int, channels []channelStatus, speedStep byte) map[byte]time.Duration {
+	hue := r.advance(now, loopMax)
+	var sum float64
+	var n int
+	for _, ch := range channels {
+		if ch.Step != speedStep {
+			sum += ch.Median
+			n++
+		}
+	}
+	v := 0.0
+	if n > 0 {
+		v = math.Min(1, math.Max(0, sum/float64(n)/(ainLevels-1)))
+	}
+	return conf.colorDuties(hsvToRGBW(hue, 1, v, 0))
+}
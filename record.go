@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// how often the -record file is flushed to disk
+const recordFlush = time.Second
+
+// recorder writes a CSV line per channel per loop to the -record file, for
+// tuning effects offline. It sits beside the PWM writes rather than in
+// place of them. A write error is logged once and recording stops; the
+// lights carry on.
+type recorder struct {
+	file      *os.File
+	buf       *bufio.Writer
+	csv       *csv.Writer
+	lastFlush time.Time
+	failed    bool
+}
+
+// newRecorder creates path, replacing any earlier recording, and writes
+// the header.
+func newRecorder(path string) (*recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(f)
+	r := &recorder{file: f, buf: buf, csv: csv.NewWriter(buf), lastFlush: time.Now()}
+	r.write([]string{"time", "step", "name", "aout", "median", "duty_ns"})
+	return r, nil
+}
+
+// record adds a line for each channel's raw reading, smoothed reading and
+// applied duty at now.
+func (r *recorder) record(now time.Time, channels []channelStatus) {
+	if r.failed {
+		return
+	}
+	t := now.Format(time.RFC3339Nano)
+	for _, ch := range channels {
+		r.write([]string{
+			t,
+			strconv.Itoa(int(ch.Step)),
+			ch.Name,
+			strconv.Itoa(ch.Aout),
+			strconv.FormatFloat(ch.Median, 'f', 1, 64),
+			strconv.FormatInt(int64(ch.Duty), 10),
+		})
+	}
+	if now.Sub(r.lastFlush) >= recordFlush {
+		r.flush()
+		r.lastFlush = now
+	}
+}
+
+func (r *recorder) write(fields []string) {
+	if err := r.csv.Write(fields); err != nil {
+		r.fail(err)
+	}
+}
+
+func (r *recorder) flush() {
+	r.csv.Flush()
+	if err := r.csv.Error(); err != nil {
+		r.fail(err)
+		return
+	}
+	if err := r.buf.Flush(); err != nil {
+		r.fail(err)
+	}
+}
+
+func (r *recorder) fail(err error) {
+	if !r.failed {
+		slog.Warn("could not write recording, stopped recording", "path", r.file.Name(), "err", err)
+		r.failed = true
+	}
+}
+
+// close flushes what is buffered and closes the file.
+func (r *recorder) close() {
+	if !r.failed {
+		r.flush()
+	}
+	r.file.Close()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A config reloaded with POST /reload or SIGHUP, checked and waiting for
+// the main loop to swap it in between iterations, so a loop never sees
+// half of it.
+var reload struct {
+	sync.Mutex
+	pending *Config
+	curve   Curve
+}
+
+// restartOnly lists what a reload cannot change, because the PWM lines,
+// pots and their state were set up from it at startup, and how to compare
+// it between two configs.
+var restartOnly = []struct {
+	key   string
+	value func(c *Config) interface{}
+}{
+	{"pwm_period", func(c *Config) interface{} { return c.PWMPeriod }},
+	{"aux_pots", func(c *Config) interface{} { return c.AuxPots }},
+	{"adc_range_min, adc_range_max", func(c *Config) interface{} { return [2]int{c.ADCRangeMin, c.ADCRangeMax} }},
+	{"channels", func(c *Config) interface{} { return len(c.Channels) }},
+	{"channels[].pwm", func(c *Config) interface{} {
+		pins := make([]string, len(c.Channels))
+		for i, ch := range c.Channels {
+			pins[i] = ch.PWM
+		}
+		return pins
+	}},
+	{"channels[].invert_polarity, invert", func(c *Config) interface{} {
+		inverts := make([][2]bool, len(c.Channels))
+		for i, ch := range c.Channels {
+			inverts[i] = [2]bool{ch.InvertPolarity, ch.Invert}
+		}
+		return inverts
+	}},
+}
+
+// requestReload reads and checks the -config file and queues it for the
+// main loop. Nothing changes if the file is bad or changes something that
+// needs a restart; the error says which.
+func requestReload() error {
+	if *configPath == "" {
+		return errors.New("no -config file to reload")
+	}
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	old := currentConfig()
+	// flags still override the file
+	if *gammaFlag != 0 {
+		c.Gamma = *gammaFlag
+	}
+	if *pwmPeriodArg != "" {
+		c.PWMPeriod = old.PWMPeriod
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	var changed []string
+	for _, f := range restartOnly {
+		if !reflect.DeepEqual(f.value(old), f.value(c)) {
+			changed = append(changed, f.key)
+		}
+	}
+	if len(changed) > 0 {
+		return fmt.Errorf("needs a restart to change %s", strings.Join(changed, "; "))
+	}
+	curve, err := newCurve(c)
+	if err != nil {
+		return err
+	}
+	reload.Lock()
+	reload.pending, reload.curve = c, curve
+	reload.Unlock()
+	return nil
+}
+
+// pendingReload returns a config waiting to be swapped in, and its curve,
+// or nil.
+func pendingReload() (*Config, Curve) {
+	reload.Lock()
+	defer reload.Unlock()
+	c, curve := reload.pending, reload.curve
+	reload.pending, reload.curve = nil, nil
+	return c, curve
+}
+
+// applyConfig swaps in a reloaded config and updates what the LEDs took
+// from it at startup. Called by the main loop between iterations.
+func applyConfig(c *Config, curve Curve, LEDMap map[byte]*LED, minDuties, maxDuties []time.Duration) {
+	confMu.Lock()
+	conf, brightness = c, curve
+	confMu.Unlock()
+	disableFromConfig(c)
+	for step, led := range LEDMap {
+		led.maxDuty = conf.maxDuty(step)
+		led.minDuty = conf.minDuty(step)
+		led.slew = conf.slew(step)
+		led.trim = conf.trim(step)
+		led.name = conf.channelName(step)
+		// keep the direction of the walk, at the new pace
+		if led.autoOffsetDelta < 0 {
+			led.autoOffsetDelta = -conf.AutoOffsetDelta
+		} else {
+			led.autoOffsetDelta = conf.AutoOffsetDelta
+		}
+		maxDuties[step] = led.maxDuty
+		minDuties[step] = led.minDuty
+	}
+}
+
+// watchSIGHUP reloads the config on each SIGHUP.
+func watchSIGHUP(hup <-chan os.Signal) {
+	defer failsafe()
+	for range hup {
+		if err := requestReload(); err != nil {
+			slog.Error("could not reload config", "path", *configPath, "err", err)
+			continue
+		}
+		slog.Info("reloading config", "path", *configPath)
+	}
+}
+
+// POST /reload re-reads the -config file and applies it from the next loop.
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := requestReload(); err != nil {
+		writeError(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	slog.Info("reloading config", "path", *configPath, "remote", r.RemoteAddr)
+	writeJSON(w, map[string]string{"reloaded": *configPath})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// replaySource plays back a -record file: each loop's applied duties, at the
+// pace they were recorded, sped up or slowed down by speed. Unlike other
+// sources its frames are duties in nanoseconds rather than levels; see
+// replaying. At the end of the file it starts over if looping, and
+// otherwise hands back to the pots.
+type replaySource struct {
+	path  string
+	count int // number of LEDs; other steps in the file are ignored
+	speed float64
+	loop  bool
+	out   chan map[byte]int
+}
+
+// the columns a recording needs, by header name
+var replayColumns = []string{"time", "step", "duty_ns"}
+
+func newReplaySource(path string, count int, speed float64, loop bool) (*replaySource, error) {
+	if speed <= 0 {
+		return nil, fmt.Errorf("illegal replay speed %g: must be positive", speed)
+	}
+	// check the header now, so a wrong file stops startup
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = replayHeader(csv.NewReader(f))
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	r := &replaySource{path: path, count: count, speed: speed, loop: loop, out: make(chan map[byte]int, 1)}
+	go r.run()
+	return r, nil
+}
+
+func (r *replaySource) name() string                { return "replay" }
+func (r *replaySource) frames() <-chan map[byte]int { return r.out }
+
+// replaying reports whether source sends duties rather than levels.
+func replaying(source controlSource) bool {
+	_, ok := source.(*replaySource)
+	return ok
+}
+
+// replayHeader reads the header line and returns the index of each of
+// replayColumns.
+func replayHeader(cr *csv.Reader) ([]int, error) {
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("no recording header: %w", err)
+	}
+	cols := make([]int, len(replayColumns))
+	for i, name := range replayColumns {
+		cols[i] = -1
+		for j, h := range header {
+			if h == name {
+				cols[i] = j
+			}
+		}
+		if cols[i] < 0 {
+			return nil, fmt.Errorf("not a recording: no %s column", name)
+		}
+	}
+	return cols, nil
+}
+
+func (r *replaySource) run() {
+	defer failsafe()
+	for {
+		if err := r.play(); err != nil {
+			slog.Error("replay stopped", "path", r.path, "err", err)
+			break
+		}
+		if !r.loop {
+			slog.Info("replay finished", "path", r.path)
+			break
+		}
+	}
+	sendLatest(r.out, nil)
+}
+
+// play goes through the file once. The lines of one loop share a time and
+// make up one frame, which is sent when the next loop's lines start.
+func (r *replaySource) play() error {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cr := csv.NewReader(f)
+	cols, err := replayHeader(cr)
+	if err != nil {
+		return err
+	}
+
+	var start, first, at time.Time // wall clock and recorded times
+	var frame map[byte]int
+	send := func() {
+		if frame == nil {
+			return
+		}
+		if start.IsZero() {
+			start, first = time.Now(), at
+		} else {
+			due := start.Add(time.Duration(float64(at.Sub(first)) / r.speed))
+			time.Sleep(time.Until(due))
+		}
+		sendLatest(r.out, frame)
+		frame = nil
+	}
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			send()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		t, err := time.Parse(time.RFC3339Nano, rec[cols[0]])
+		if err != nil {
+			return fmt.Errorf("line %d: bad time %q", line, rec[cols[0]])
+		}
+		step, err := strconv.ParseUint(rec[cols[1]], 10, 8)
+		if err != nil {
+			return fmt.Errorf("line %d: bad step %q", line, rec[cols[1]])
+		}
+		duty, err := strconv.ParseInt(rec[cols[2]], 10, 64)
+		if err != nil || duty < 0 {
+			return fmt.Errorf("line %d: bad duty %q", line, rec[cols[2]])
+		}
+		if !t.Equal(at) {
+			send()
+			at = t
+		}
+		if int(step) >= r.count {
+			continue
+		}
+		if frame == nil {
+			frame = make(map[byte]int, r.count)
+		}
+		frame[byte(step)] = int(duty)
+	}
+}
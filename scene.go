@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// how often a crossfade recomputes the duties
+	sceneFrame = 20 * time.Millisecond
+	// range of the log easing; the duty rises this many dB over the fade
+	easingLogDB = 40
+)
+
+// Scene is a named look for the fixture: one duty per channel, as a fraction
+// of the PWM period.
+type Scene struct {
+	Name   string    `json:"name"`
+	Duties []float64 `json:"duties"`
+	Easing string    `json:"easing,omitempty"` // empty for scene_easing
+}
+
+// An Easing maps how far a fade is through its time, 0 to 1, onto how far
+// the duties have moved, 0 to 1. Every easing rises monotonically from
+// exactly 0 at 0 to exactly 1 at 1.
+type Easing func(t float64) float64
+
+var easings = map[string]Easing{
+	"linear":      func(t float64) float64 { return t },
+	"ease-in":     func(t float64) float64 { return t * t },
+	"ease-out":    func(t float64) float64 { return 1 - (1-t)*(1-t) },
+	"ease-in-out": func(t float64) float64 { return t * t * (3 - 2*t) },
+	// even steps in dB, which the eye sees as an even fade
+	"log": func(t float64) float64 {
+		span := math.Pow(10, easingLogDB/20) - 1
+		return (math.Pow(10, t*easingLogDB/20) - 1) / span
+	},
+}
+
+// findEasing returns the easing called name.
+func findEasing(name string) (Easing, error) {
+	e, ok := easings[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown easing %q: must be linear, ease-in, ease-out, ease-in-out or log", name)
+	}
+	return e, nil
+}
+
+// findScene returns the configured scene called name.
+func (c *Config) findScene(name string) (Scene, bool) {
+	for _, s := range c.Scenes {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Scene{}, false
+}
+
+// While a scene is playing its duties replace the pots. The sequencer
+// goroutine moves duties toward the scene; the main loop copies them once
+// per iteration. A scene holds after its fade until it is stopped.
+var sequencer struct {
+	sync.Mutex
+	scene  string // empty when no scene is playing
+	duties []time.Duration
+	cancel chan struct{} // closed to end the running fade early
+}
+
+// playScene crossfades from the given duties to s over fade, replacing any
+// scene already playing or fading.
+func playScene(s Scene, from []time.Duration, fade time.Duration, ease Easing) {
+	to := make([]time.Duration, len(s.Duties))
+	for i, f := range s.Duties {
+		to[i] = fractionDuty(f)
+	}
+	if len(from) != len(to) {
+		// nothing shown yet; fade up from dark
+		from = make([]time.Duration, len(to))
+	}
+	cancel := make(chan struct{})
+
+	sequencer.Lock()
+	if sequencer.cancel != nil {
+		close(sequencer.cancel)
+	}
+	sequencer.scene = s.Name
+	sequencer.duties = append([]time.Duration(nil), from...)
+	sequencer.cancel = cancel
+	sequencer.Unlock()
+
+	go crossfade(from, to, fade, ease, cancel)
+}
+
+// stopScene ends the playing scene and hands the LEDs back to the pots.
+func stopScene() {
+	sequencer.Lock()
+	if sequencer.cancel != nil {
+		close(sequencer.cancel)
+		sequencer.cancel = nil
+	}
+	sequencer.scene = ""
+	sequencer.Unlock()
+}
+
+// crossfade interpolates from one set of duties to another, with the
+// progress through the fade shaped by ease.
+func crossfade(from, to []time.Duration, fade time.Duration, ease Easing, cancel chan struct{}) {
+	defer failsafe()
+	ticker := time.NewTicker(sceneFrame)
+	defer ticker.Stop()
+	start := time.Now()
+	for {
+		progress := 1.0
+		if fade > 0 {
+			progress = float64(time.Since(start)) / float64(fade)
+			if progress > 1 {
+				progress = 1
+			}
+		}
+
+		sequencer.Lock()
+		select {
+		case <-cancel:
+			// replaced or stopped; leave the duties to the new owner
+			sequencer.Unlock()
+			return
+		default:
+		}
+		eased := ease(progress)
+		for i := range to {
+			if progress >= 1 {
+				// exactly on the scene, whatever rounding the easing does
+				sequencer.duties[i] = to[i]
+				continue
+			}
+			sequencer.duties[i] = from[i] + time.Duration(eased*float64(to[i]-from[i]))
+		}
+		sequencer.Unlock()
+
+		if progress >= 1 {
+			return
+		}
+		select {
+		case <-cancel:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sceneDuties copies the playing scene's current duties into duties and
+// returns its name, or "" if no scene is playing.
+func sceneDuties(duties []time.Duration) string {
+	sequencer.Lock()
+	defer sequencer.Unlock()
+	if sequencer.scene != "" {
+		copy(duties, sequencer.duties)
+	}
+	return sequencer.scene
+}
+
+// fractionDuty turns a fraction of the PWM period into a duty, with the same
+// ceiling as calcDuty.
+func fractionDuty(f float64) time.Duration {
+	c := currentConfig()
+	duty := time.Duration(f * float64(c.PWMPeriod.Duration))
+	if ceiling := c.PWMPeriod.Duration - c.PWMResolution.Duration; duty > ceiling {
+		duty = ceiling
+	}
+	return duty
+}
+
+func (s Scene) validate(channels int) error {
+	if s.Name == "" {
+		return fmt.Errorf("name missing")
+	}
+	if s.Easing != "" {
+		if _, err := findEasing(s.Easing); err != nil {
+			return fmt.Errorf("scene %s: %s", s.Name, err)
+		}
+	}
+	if len(s.Duties) != channels {
+		return fmt.Errorf("scene %s: need %d duties, one per channel: %d", s.Name, channels, len(s.Duties))
+	}
+	for i, d := range s.Duties {
+		if d < 0 || d > 1 {
+			return fmt.Errorf("scene %s: duties[%d] must be 0 to 1: %v", s.Name, i, d)
+		}
+	}
+	return nil
+}
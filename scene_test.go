@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// TestEasings checks every easing starts at 0, ends at 1 and rises all
+// the way between, so no fade overshoots or turns back.
+func TestEasings(t *testing.T) {
+	for name := range easings {
+		e, err := findEasing(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := e(0); math.Abs(got) > 1e-9 {
+			t.Errorf("%s(0) = %v, want 0", name, got)
+		}
+		if got := e(1); math.Abs(got-1) > 1e-9 {
+			t.Errorf("%s(1) = %v, want 1", name, got)
+		}
+		const n = 1000
+		prev := e(0)
+		for i := 1; i <= n; i++ {
+			x := float64(i) / n
+			got := e(x)
+			if got <= prev {
+				t.Fatalf("%s(%v) = %v, not above %v", name, x, got, prev)
+			}
+			if got < 0 || got > 1+1e-9 {
+				t.Fatalf("%s(%v) = %v, outside 0 to 1", name, x, got)
+			}
+			prev = got
+		}
+	}
+}
+
+func TestFindEasingUnknown(t *testing.T) {
+	_, err := findEasing("bounce")
+	if err == nil {
+		t.Fatal("found an easing called bounce")
+	}
+	// the error lists them all
+	for name := range easings {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q does not list %s", err, name)
+		}
+	}
+}
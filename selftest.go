@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"time"
+)
+
+const (
+	selfTestLevel = 0.25 // fraction of each LED's max_duty
+	selfTestHold  = time.Second
+)
+
+// selfTest lights each LED in turn at a fixed level, logging its color and
+// pin, then all of them together, then none, so the wiring can be checked
+// against the config without touching the pots. The duties go through
+// normalize like any others. Before that each PWM line is put through
+// checkPWM. It returns false if stopped by a signal.
+func selfTest(LEDMap map[byte]*LED, minDuties, maxDuties, applied, written []time.Duration, stop <-chan os.Signal) bool {
+	duties := make([]time.Duration, len(LEDMap))
+	show := func(msg string, args ...any) bool {
+		slog.Info(msg, args...)
+		normalize(duties, minDuties, maxDuties, applied, conf.maxTotalDuty(), conf.limiterKnee())
+		setDuties(LEDMap, applied, written)
+		select {
+		case sig := <-stop:
+			slog.Info("self test stopped", "signal", sig)
+			return false
+		case <-time.After(selfTestHold):
+			return true
+		}
+	}
+	level := func(step int) time.Duration {
+		return time.Duration(selfTestLevel * float64(maxDuties[step]))
+	}
+
+	// each line must behave as the rest of the program expects before it
+	// is trusted to show anything
+	for step, led := range LEDMap {
+		if p, ok := led.pwm.(readablePWM); ok {
+			if err := checkPWM(p, conf.PWMPeriod.Duration); err != nil {
+				slog.Warn("PWM line misbehaves", "step", step, "name", led.name, "pin", conf.Channels[step].PWM, "err", err)
+			}
+			// DisablePWM may reset the line, so set it up again in full
+			p.SetPolarity(conf.Channels[step].polarity())
+			written[step] = -1
+		}
+	}
+
+	for step, ch := range conf.Channels {
+		for i := range duties {
+			duties[i] = 0
+		}
+		duties[step] = level(step)
+		if !show("self test", "step", step, "name", conf.channelName(byte(step)), "color", ch.Color, "pin", ch.PWM) {
+			return false
+		}
+	}
+	for step := range duties {
+		duties[step] = level(step)
+	}
+	if !show("self test", "step", "all") {
+		return false
+	}
+	for step := range duties {
+		duties[step] = 0
+	}
+	return show("self test done; all off")
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"container/ring"
+	"fmt"
+	"sync"
+)
+
+// A Smoother filters the noisy readings of one pot. Smooth takes the
+// latest reading and returns the smoothed value.
+type Smoother interface {
+	Smooth(aout int) float64
+}
+
+// emaSmoother is an exponential moving average. It follows real fades
+// faster than a median but lets more of a spike through.
+type emaSmoother struct {
+	alpha  float64 // weight of the newest reading, 0 to 1
+	value  float64
+	primed bool
+}
+
+func (e *emaSmoother) Smooth(aout int) float64 {
+	if !e.primed {
+		e.value = float64(aout)
+		e.primed = true
+	} else {
+		e.value += e.alpha * (float64(aout) - e.value)
+	}
+	return e.value
+}
+
+// ringWindow is a window over the last size readings like medianWindow,
+// reduced to their mean or their maximum for -aggregate. The sum is kept
+// as readings come and go; the maximum is only searched for again when
+// the reading leaving the window held it. Until the window fills, only the
+// readings added so far count.
+type ringWindow struct {
+	win *ring.Ring // int, oldest first once full
+	max bool       // the maximum rather than the mean
+	n   int        // readings in the window
+	sum int
+	top int // the maximum
+}
+
+func newRingWindow(size int, max bool) *ringWindow {
+	return &ringWindow{win: ring.New(size), max: max}
+}
+
+func (w *ringWindow) Smooth(aout int) float64 {
+	old, full := w.win.Value.(int)
+	w.win.Value = aout
+	w.win = w.win.Next()
+	if full {
+		w.sum -= old
+	} else {
+		w.n++
+	}
+	w.sum += aout
+
+	if !w.max {
+		return float64(w.sum) / float64(w.n)
+	}
+	switch {
+	case w.n == 1 || aout >= w.top:
+		w.top = aout
+	case full && old == w.top:
+		w.top = aout
+		w.win.Do(func(v interface{}) {
+			if v, ok := v.(int); ok && v > w.top {
+				w.top = v
+			}
+		})
+	}
+	return float64(w.top)
+}
+
+// resized returns a window of size holding as many of w's most recent
+// readings as fit.
+func (w *ringWindow) resized(size int) *ringWindow {
+	var readings []int
+	// the current slot holds the oldest reading once the window is full
+	w.win.Do(func(v interface{}) {
+		if aout, ok := v.(int); ok {
+			readings = append(readings, aout)
+		}
+	})
+	if len(readings) > size {
+		readings = readings[len(readings)-size:]
+	}
+	n := newRingWindow(size, w.max)
+	for _, aout := range readings {
+		n.Smooth(aout)
+	}
+	return n
+}
+
+// Median window sizes the -window flag and POST /window accept.
+const (
+	windowSizeMin = 1
+	windowSizeMax = 10000
+)
+
+// Size of the median window, changed over HTTP and applied by the main
+// loop, which owns the smoothers.
+var window struct {
+	sync.Mutex
+	size    int
+	pending bool // size has not been applied yet
+}
+
+// requestWindow asks the main loop to resize every median window.
+func requestWindow(size int) {
+	window.Lock()
+	window.size, window.pending = size, true
+	window.Unlock()
+}
+
+// pendingWindow returns a requested window size not yet applied.
+func pendingWindow() (int, bool) {
+	window.Lock()
+	defer window.Unlock()
+	if !window.pending {
+		return 0, false
+	}
+	window.pending = false
+	return window.size, true
+}
+
+// windowSizeNow is the median window size in use or about to be.
+func windowSizeNow() int {
+	window.Lock()
+	defer window.Unlock()
+	return window.size
+}
+
+// resizeSmoother returns s with a window of size, or s itself if it has
+// no window.
+func resizeSmoother(s Smoother, size int) Smoother {
+	switch w := s.(type) {
+	case *medianWindow:
+		return w.resized(size)
+	case *ringWindow:
+		return w.resized(size)
+	}
+	return s
+}
+
+// newSmoother returns a window or EMA smoother as chosen by the flags. A
+// window takes the size in use, which starts at -window but may have been
+// changed since, and is reduced as -aggregate says.
+func newSmoother() (Smoother, error) {
+	if *smoothing != "median" && *aggregate != "median" {
+		return nil, fmt.Errorf("-aggregate %s needs -smooth median", *aggregate)
+	}
+	switch *smoothing {
+	case "median":
+		switch *aggregate {
+		case "median":
+			return newMedianWindow(windowSizeNow()), nil
+		case "mean":
+			return newRingWindow(windowSizeNow(), false), nil
+		case "max":
+			return newRingWindow(windowSizeNow(), true), nil
+		}
+		return nil, fmt.Errorf("unknown aggregate %q: must be median, mean or max", *aggregate)
+	case "ema":
+		if *alpha <= 0 || *alpha > 1 {
+			return nil, fmt.Errorf("illegal EMA alpha %v: must be above 0 and at most 1", *alpha)
+		}
+		return &emaSmoother{alpha: *alpha}, nil
+	}
+	return nil, fmt.Errorf("unknown smoothing %q: must be median or ema", *smoothing)
+}
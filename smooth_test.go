@@ -0,0 +1,162 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// TestResizeSmoother resizes filled and part filled windows, larger and
+// smaller, and checks each carries on as a window of the new size that
+// had seen the same readings.
+func TestResizeSmoother(t *testing.T) {
+	readings := []int{300, 100, 4000, 250, 2200, 50, 1800, 900}
+	next := []int{3000, 10, 1500, 1500, 700}
+	windows := map[string]func(size int) Smoother{
+		"median": func(size int) Smoother { return newMedianWindow(size) },
+		"mean":   func(size int) Smoother { return newRingWindow(size, false) },
+		"max":    func(size int) Smoother { return newRingWindow(size, true) },
+	}
+	for name, newWindow := range windows {
+		for _, seen := range []int{1, 3, len(readings)} {
+			for _, sizes := range [][2]int{{5, 2}, {5, 8}, {3, 3}, {4, 1}} {
+				from, to := sizes[0], sizes[1]
+				s := newWindow(from)
+				for _, aout := range readings[:seen] {
+					s.Smooth(aout)
+				}
+				s = resizeSmoother(s, to)
+
+				// what it would hold had it always been of size to
+				want := newWindow(to)
+				kept := readings[:seen]
+				if len(kept) > from {
+					kept = kept[len(kept)-from:]
+				}
+				for _, aout := range kept {
+					want.Smooth(aout)
+				}
+				for _, aout := range next {
+					if got, want := s.Smooth(aout), want.Smooth(aout); got != want {
+						t.Fatalf("%s, %d readings, %d to %d: %v after %d, want %v", name, seen, from, to, got, aout, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestResizeSmootherEMA(t *testing.T) {
+	e := &emaSmoother{alpha: 0.5}
+	e.Smooth(1000)
+	if s := resizeSmoother(e, 10); s != Smoother(e) {
+		t.Errorf("resized an EMA into %#v", s)
+	}
+}
+
+// TestResizeKeepsMedian shrinks a full window and checks the median of
+// the most recent readings carries on.
+func TestResizeKeepsMedian(t *testing.T) {
+	m := newMedianWindow(5)
+	for aout := 1; aout <= 7; aout++ {
+		m.Smooth(aout * 100)
+	}
+	// 300 to 700 held; 500 to 700 kept
+	small := m.resized(3)
+	if got := small.Smooth(0); got != 600 {
+		t.Errorf("median %v after shrinking, want 600", got)
+	}
+	// all five kept, one more added
+	large := m.resized(7)
+	if got := large.Smooth(10000); got != 550 {
+		t.Errorf("median %v after growing, want 550", got)
+	}
+}
+
+// useWindowFlags sets -smooth and the window size for the rest of the
+// test, with -aggregate restored after it too.
+func useWindowFlags(t *testing.T, smooth string, size int) {
+	t.Helper()
+	prevSmooth, prevAggregate, prevSize := *smoothing, *aggregate, windowSizeNow()
+	t.Cleanup(func() {
+		*smoothing, *aggregate = prevSmooth, prevAggregate
+		window.Lock()
+		window.size = prevSize
+		window.Unlock()
+	})
+	*smoothing = smooth
+	window.Lock()
+	window.size = size
+	window.Unlock()
+}
+
+// TestAggregate reduces the same readings to their median, mean and
+// maximum over a window of three.
+func TestAggregate(t *testing.T) {
+	aouts := []int{5, 1, 9, 3, 2, 2, 7}
+	tests := []struct {
+		aggregate string
+		want      []float64
+	}{
+		{"median", []float64{5, 3, 5, 3, 3, 2, 2}},
+		{"mean", []float64{5, 3, 5, 13.0 / 3, 14.0 / 3, 7.0 / 3, 11.0 / 3}},
+		// 9 leaves the window after the fifth reading
+		{"max", []float64{5, 5, 9, 9, 9, 3, 7}},
+	}
+	useWindowFlags(t, "median", 3)
+	for _, tt := range tests {
+		*aggregate = tt.aggregate
+		s, err := newSmoother()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, aout := range aouts {
+			if got := s.Smooth(aout); math.Abs(got-tt.want[i]) > 1e-9 {
+				t.Errorf("%s: reading %d (%d) gives %v, want %v", tt.aggregate, i, aout, got, tt.want[i])
+			}
+		}
+	}
+}
+
+// TestRingWindowRandom checks the running sum and maximum against going
+// over the whole window on every reading.
+func TestRingWindowRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for size := 1; size <= 9; size++ {
+		mean, max := newRingWindow(size, false), newRingWindow(size, true)
+		var readings []int
+		for i := 0; i < 500; i++ {
+			// repeats too, so the maximum can leave with a copy still in
+			aout := rng.Intn(16) * 256
+			readings = append(readings, aout)
+			if len(readings) > size {
+				readings = readings[1:]
+			}
+			sum, top := 0, readings[0]
+			for _, r := range readings {
+				sum += r
+				if r > top {
+					top = r
+				}
+			}
+			if got, want := mean.Smooth(aout), float64(sum)/float64(len(readings)); math.Abs(got-want) > 1e-9 {
+				t.Fatalf("size %d, reading %d: mean %v, want %v of %v", size, i, got, want, readings)
+			}
+			if got := max.Smooth(aout); got != float64(top) {
+				t.Fatalf("size %d, reading %d: max %v, want %v of %v", size, i, got, top, readings)
+			}
+		}
+	}
+}
+
+func TestNewSmootherFlags(t *testing.T) {
+	useWindowFlags(t, "ema", 5)
+	*aggregate = "mean"
+	if _, err := newSmoother(); err == nil {
+		t.Error("-aggregate mean taken with -smooth ema")
+	}
+	*smoothing, *aggregate = "median", "mode"
+	if _, err := newSmoother(); err == nil {
+		t.Error("-aggregate mode taken")
+	}
+}
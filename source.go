@@ -0,0 +1,54 @@
+package main
+
+import "time"
+
+// A controlSource drives the LEDs in place of the potentiometers, e.g. a
+// lighting desk. Each frame maps ADC steps to levels on the same 0-4095
+// scale as the pots, so the levels go through the usual curve and
+// normalization. A source takes over from the pots with its first frame
+// and hands back by sending a nil frame. Auto mode is off while a source
+// is in charge.
+type controlSource interface {
+	name() string
+	frames() <-chan map[byte]int
+}
+
+// sendLatest hands frame to the main loop without ever blocking the
+// source. A frame the loop has not picked up yet is replaced, since only
+// the newest levels matter.
+func sendLatest(ch chan map[byte]int, frame map[byte]int) {
+	for {
+		select {
+		case ch <- frame:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
+
+// watchdogFade is how long the -watchdog takes to fade out a silent source.
+const watchdogFade = 2 * time.Second
+
+// fadeLevels returns levels faded toward off for a source that has been
+// silent for overdue past the watchdog timeout. The source's own frame is
+// left alone, so a new frame picks up where it was.
+func fadeLevels(levels map[byte]int, overdue time.Duration) map[byte]int {
+	f := 1 - float64(overdue)/float64(watchdogFade)
+	if f < 0 {
+		f = 0
+	}
+	faded := make(map[byte]int, len(levels))
+	for step, level := range levels {
+		faded[step] = int(float64(level) * f)
+	}
+	return faded
+}
+
+// scaleLevel converts an input of 0 to max onto the ADC scale.
+func scaleLevel(v, max int) int {
+	return v * (ainLevels - 1) / max
+}
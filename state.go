@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// how often the main loop saves the state file
+	stateInterval = 10 * time.Second
+	// how far a pot must move before it takes over from a restored duty
+	restoreDeadband = 2 * ainMinPad
+)
+
+// savedState is what the fixture was showing, so it can resume after a
+// power cycle.
+type savedState struct {
+	Duties []time.Duration `json:"duties"` // applied duties in nanoseconds
+	Auto   []savedAuto     `json:"auto"`
+}
+
+// savedAuto is one LED's auto mode phase.
+type savedAuto struct {
+	Loop        int `json:"loop"`
+	LoopMax     int `json:"loop_max"`
+	Offset      int `json:"offset"`
+	OffsetDelta int `json:"offset_delta"`
+	OffsetMax   int `json:"offset_max"`
+}
+
+// saveState writes the applied duties and auto mode phase to path.
+func saveState(path string, LEDMap map[byte]*LED, applied []time.Duration) error {
+	s := savedState{
+		Duties: applied,
+		Auto:   make([]savedAuto, len(applied)),
+	}
+	for step, led := range LEDMap {
+		s.Auto[step] = savedAuto{
+			Loop:        led.autoLoop,
+			LoopMax:     led.autoLoopMax,
+			Offset:      led.autoOffset,
+			OffsetDelta: led.autoOffsetDelta,
+			OffsetMax:   led.autoOffsetMax,
+		}
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+// writeFileAtomic writes b beside path and renames it over path, so a power
+// cut leaves either the old file or the new one, never a torn file.
+func writeFileAtomic(path string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// loadState reads a state file written by saveState. A missing file is not
+// an error and returns nil.
+func loadState(path string, ledCount int) (*savedState, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s savedState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	if len(s.Duties) != ledCount || len(s.Auto) != ledCount {
+		return nil, fmt.Errorf("saved for %d LEDs, have %d", len(s.Duties), ledCount)
+	}
+	return &s, nil
+}
+
+// restore puts the saved auto mode phase back on the LEDs and holds each at
+// its saved duty until its pot moves.
+func (s *savedState) restore(LEDMap map[byte]*LED) {
+	for step, led := range LEDMap {
+		a := s.Auto[step]
+		led.autoLoop = a.Loop
+		if a.LoopMax > 0 {
+			led.autoLoopMax = a.LoopMax
+		}
+		if a.OffsetMax > 0 && a.OffsetMax <= conf.AutoOffsetMax {
+			led.autoOffsetMax = a.OffsetMax
+			led.autoOffset = a.Offset
+			led.autoOffsetDelta = a.OffsetDelta
+		}
+		led.restored = true
+		led.restoredDuty = s.Duties[step]
+		led.restoredAout = -1
+	}
+}
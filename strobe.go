@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const maxStrobeHz = 50
+
+// strobe flips one LED between on and off on its own ticker, so the rate
+// does not depend on how fast the main loop runs. The main loop still
+// decides how bright "on" is, after normalization, and leaves the PWM line
+// to the strobe.
+type strobe struct {
+	hz   float64
+	duty int64 // time.Duration while lit; set by the main loop
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startStrobe(led *LED, hz float64) *strobe {
+	s := &strobe{hz: hz, stop: make(chan struct{}), done: make(chan struct{})}
+	go s.run(led)
+	return s
+}
+
+func (s *strobe) run(led *LED) {
+	defer failsafe()
+	defer close(s.done)
+	t := time.NewTicker(time.Duration(float64(time.Second) / (2 * s.hz)))
+	defer t.Stop()
+	lit := false
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			lit = !lit
+			var duty time.Duration
+			if lit {
+				duty = time.Duration(atomic.LoadInt64(&s.duty))
+			}
+			led.setPWM(duty)
+		}
+	}
+}
+
+// setDuty sets how bright the LED is while lit.
+func (s *strobe) setDuty(duty time.Duration) {
+	atomic.StoreInt64(&s.duty, int64(duty))
+}
+
+// halt stops the strobe and waits until it no longer touches the PWM line.
+func (s *strobe) halt() {
+	close(s.stop)
+	<-s.done
+}
+
+// Strobe rates by step, from -strobe or the HTTP API. The main loop starts
+// and stops strobes to match once per iteration.
+var strobes struct {
+	sync.Mutex
+	hz map[byte]float64
+}
+
+func setStrobe(step byte, hz float64) {
+	strobes.Lock()
+	if strobes.hz == nil {
+		strobes.hz = make(map[byte]float64)
+	}
+	if hz > 0 {
+		strobes.hz[step] = hz
+	} else {
+		delete(strobes.hz, step)
+	}
+	strobes.Unlock()
+}
+
+// applyStrobes starts, restarts or stops each LED's strobe to match the
+// requested rates. halted stops them all, for the emergency lights, and
+// they start again once it is cleared. Disabled LEDs do not strobe.
+func applyStrobes(LEDMap map[byte]*LED, halted bool) {
+	strobes.Lock()
+	defer strobes.Unlock()
+	for step, led := range LEDMap {
+		hz := strobes.hz[step]
+		if halted || led.disabled {
+			hz = 0
+		}
+		if led.strobe != nil && led.strobe.hz == hz {
+			continue
+		}
+		if led.strobe != nil {
+			led.strobe.halt()
+			led.strobe = nil
+		}
+		if hz > 0 {
+			led.strobe = startStrobe(led, hz)
+		}
+	}
+}
+
+// parseStrobes reads a -strobe list such as "0=10,2=4.5".
+func parseStrobes(list string, ledCount int) (map[byte]float64, error) {
+	rates := make(map[byte]float64)
+	if list == "" {
+		return rates, nil
+	}
+	for _, item := range strings.Split(list, ",") {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("strobe %q: want step=hz", item)
+		}
+		step, err := strconv.Atoi(parts[0])
+		if err != nil || step < 0 || step >= ledCount {
+			return nil, fmt.Errorf("strobe %q: step must be 0 to %d", item, ledCount-1)
+		}
+		hz, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || hz <= 0 || hz > maxStrobeHz {
+			return nil, fmt.Errorf("strobe %q: rate must be above 0 and at most %d Hz", item, maxStrobeHz)
+		}
+		rates[byte(step)] = hz
+	}
+	return rates, nil
+}
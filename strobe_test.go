@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestStrobeReload reloads the config while a strobe is writing its LED's
+// line, as POST /reload can, which the race detector holds to the
+// locking, and checks the strobe takes up the new period.
+func TestStrobeReload(t *testing.T) {
+	useConfig(t, defaultConfig())
+	prevCurve := brightness
+	t.Cleanup(func() {
+		brightness = prevCurve
+		disableFromConfig(conf)
+	})
+
+	sim := &simPWM{pin: "P9_14"}
+	LEDMap := map[byte]*LED{0: {pwm: sim}}
+	n := len(conf.Channels)
+	minDuties, maxDuties := make([]time.Duration, n), make([]time.Duration, n)
+	s := startStrobe(LEDMap[0], 1000)
+	s.setDuty(pwmPeriod / 2)
+
+	var c *Config
+	for _, period := range []time.Duration{time.Millisecond, 100 * time.Microsecond, 250 * time.Microsecond} {
+		c = defaultConfig()
+		c.PWMPeriod = duration{period}
+		curve, err := newCurve(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		applyConfig(c, curve, LEDMap, minDuties, maxDuties)
+		time.Sleep(20 * time.Millisecond)
+	}
+	s.halt()
+	if period, _ := sim.GetPWM(); period != c.PWMPeriod.Duration {
+		t.Errorf("strobe writes period %v after the reload, want %v", period, c.PWMPeriod.Duration)
+	}
+}
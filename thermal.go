@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often the temperature is read
+const thermalInterval = 5 * time.Second
+
+// A TempSensor reports a temperature in degrees Celsius.
+type TempSensor interface {
+	Temperature() (float64, error)
+}
+
+// sysfsTemp reads a sysfs file holding millidegrees Celsius, such as a
+// thermal zone's temp or an I2C sensor's hwmon temp1_input.
+type sysfsTemp struct {
+	path string
+}
+
+func (s sysfsTemp) Temperature() (float64, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, err
+	}
+	return float64(v) / 1000, nil
+}
+
+// thermalThrottle reads a TempSensor in the background and lowers the total
+// current limit as the fixture heats up: no throttling up to
+// thermal_start, down to thermal_min_scale at thermal_max and above.
+type thermalThrottle struct {
+	sensor TempSensor
+	mu     sync.Mutex
+	temp   float64
+	s      float64
+}
+
+func newThermalThrottle(sensor TempSensor) *thermalThrottle {
+	t := &thermalThrottle{sensor: sensor, s: 1}
+	go t.run()
+	return t
+}
+
+func (t *thermalThrottle) run() {
+	defer failsafe()
+	failing, throttling := false, false
+	for {
+		temp, err := t.sensor.Temperature()
+		if err != nil {
+			// keep the last scale; say so once rather than every read
+			if !failing {
+				slog.Warn("could not read temperature", "err", err)
+			}
+		} else {
+			s := throttleScale(temp)
+			if s < 1 && !throttling {
+				slog.Warn("fixture is hot; throttling", "temperature", temp, "scale", s)
+			} else if s == 1 && throttling {
+				slog.Info("fixture has cooled; throttling stopped", "temperature", temp)
+			}
+			throttling = s < 1
+			t.mu.Lock()
+			t.temp, t.s = temp, s
+			t.mu.Unlock()
+		}
+		failing = err != nil
+		time.Sleep(thermalInterval)
+	}
+}
+
+// throttleScale is the factor for the total current limit at temp.
+func throttleScale(temp float64) float64 {
+	c := currentConfig()
+	switch {
+	case temp <= c.ThermalStart:
+		return 1
+	case temp >= c.ThermalMax:
+		return c.ThermalMinScale
+	}
+	f := (temp - c.ThermalStart) / (c.ThermalMax - c.ThermalStart)
+	return 1 - f*(1-c.ThermalMinScale)
+}
+
+// scale returns the latest temperature and the factor for the limit.
+func (t *thermalThrottle) scale() (temp, s float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.temp, t.s
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsInterval  = 50 * time.Millisecond // status frames pushed 20 times a second
+	wsQueue     = 4                     // frames a client may fall behind before it is dropped
+	wsWriteWait = time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	// the status is read only and the rest of the API is open too, so a
+	// dashboard may be served from anywhere
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsHub pushes the status snapshot to every WebSocket client. It reads the
+// same copy as GET /status, so the main loop never waits on a client, and a
+// client that cannot keep up is dropped instead of being waited for.
+type wsHub struct {
+	mu      sync.Mutex
+	clients map[chan []byte]bool
+}
+
+var hub = &wsHub{clients: make(map[chan []byte]bool)}
+
+func (h *wsHub) run() {
+	defer failsafe()
+	ticker := time.NewTicker(wsInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.mu.Lock()
+		if len(h.clients) > 0 {
+			b, err := json.Marshal(snapshotStatus())
+			if err != nil {
+				slog.Error("could not encode status", "err", err)
+				h.mu.Unlock()
+				continue
+			}
+			for c := range h.clients {
+				select {
+				case c <- b:
+				default:
+					slog.Info("dropping slow WebSocket client")
+					delete(h.clients, c)
+					close(c)
+				}
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *wsHub) add() chan []byte {
+	c := make(chan []byte, wsQueue)
+	h.mu.Lock()
+	h.clients[c] = true
+	h.mu.Unlock()
+	return c
+}
+
+// remove drops a client if the hub has not already.
+func (h *wsHub) remove(c chan []byte) {
+	h.mu.Lock()
+	if h.clients[c] {
+		delete(h.clients, c)
+		close(c)
+	}
+	h.mu.Unlock()
+}
+
+// GET /ws streams the status as JSON text frames.
+func handleWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already answered the request
+		return
+	}
+	defer conn.Close()
+	frames := hub.add()
+
+	// nothing is expected from the client; reading notices when it leaves
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				hub.remove(frames)
+				return
+			}
+		}
+	}()
+
+	for b := range frames {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+			hub.remove(frames)
+			break
+		}
+	}
+}